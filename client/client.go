@@ -0,0 +1,155 @@
+// Package client is a typed Go client for the decks and match services.
+//
+// It follows the OpenAPI documents served by both services at
+// /openapi.json, so tools and tests do not need to build raw requests.
+//
+//	decks := client.NewDecks("http://localhost:8001")
+//	card, err := decks.Claim(ctx, "john")
+//	if errors.Is(err, client.ErrUnavailable) {
+//		// no leader or no card left, try again later
+//	}
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Errors matched by [APIError] according to its status code.
+var (
+	ErrBadRequest  = errors.New("bad request")
+	ErrForbidden   = errors.New("forbidden")
+	ErrNotFound    = errors.New("not found")
+	ErrConflict    = errors.New("conflict")
+	ErrStale       = errors.New("precondition failed")
+	ErrRateLimited = errors.New("too many requests")
+	ErrUnavailable = errors.New("service unavailable")
+)
+
+// APIError is returned for every non-2xx answer.
+type APIError struct {
+	Method     string
+	Path       string
+	StatusCode int
+	Message    string
+	// RetryAfter is set from the Retry-After header of 429 answers.
+	RetryAfter time.Duration
+}
+
+func (err *APIError) Error() string {
+	return fmt.Sprintf("%s %s: %d %s", err.Method, err.Path, err.StatusCode, err.Message)
+}
+
+// Is lets errors.Is compare an APIError with the sentinel errors.
+func (err *APIError) Is(target error) bool {
+	switch target {
+	case ErrBadRequest:
+		return err.StatusCode == http.StatusBadRequest
+	case ErrForbidden:
+		return err.StatusCode == http.StatusForbidden
+	case ErrNotFound:
+		return err.StatusCode == http.StatusNotFound
+	case ErrConflict:
+		return err.StatusCode == http.StatusConflict
+	case ErrStale:
+		return err.StatusCode == http.StatusPreconditionFailed
+	case ErrRateLimited:
+		return err.StatusCode == http.StatusTooManyRequests
+	case ErrUnavailable:
+		return err.StatusCode == http.StatusServiceUnavailable
+	}
+	return false
+}
+
+// Option customizes a client.
+type Option func(*base)
+
+// WithHTTPClient replaces the default HTTP client, which has a 10s timeout.
+func WithHTTPClient(httpClient *http.Client) Option {
+	return func(b *base) { b.http = httpClient }
+}
+
+// WithRequestID sends X-Request-ID on every request, to trace them in the logs.
+func WithRequestID(id string) Option {
+	return func(b *base) { b.header.Set("X-Request-ID", id) }
+}
+
+type base struct {
+	url    string
+	http   *http.Client
+	header http.Header
+}
+
+func newBase(url string, options []Option) base {
+	b := base{
+		url:    strings.TrimRight(url, "/"),
+		http:   &http.Client{Timeout: 10 * time.Second},
+		header: make(http.Header),
+	}
+	for _, option := range options {
+		option(&b)
+	}
+	return b
+}
+
+// do sends body as JSON and decodes a 200 or 201 answer into out, when not nil.
+// It returns the status code so callers can tell them from 202 or 204.
+func (b *base) do(ctx context.Context, method string, path string, body any, out any) (int, error) {
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return 0, err
+		}
+		reader = bytes.NewReader(data)
+	}
+
+	request, err := http.NewRequestWithContext(ctx, method, b.url+path, reader)
+	if err != nil {
+		return 0, err
+	}
+	for key, values := range b.header {
+		request.Header[key] = values
+	}
+	if body != nil {
+		request.Header.Set("Content-Type", "application/json")
+	}
+
+	response, err := b.http.Do(request)
+	if err != nil {
+		return 0, err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode >= 300 {
+		message, _ := io.ReadAll(response.Body)
+		apiErr := &APIError{
+			Method:     method,
+			Path:       path,
+			StatusCode: response.StatusCode,
+			Message:    strings.TrimSpace(string(message)),
+		}
+		if seconds, err := strconv.Atoi(response.Header.Get("Retry-After")); err == nil {
+			apiErr.RetryAfter = time.Duration(seconds) * time.Second
+		}
+		return response.StatusCode, apiErr
+	}
+
+	decodable := response.StatusCode == http.StatusOK || response.StatusCode == http.StatusCreated
+	if out == nil || !decodable {
+		io.Copy(io.Discard, response.Body)
+		return response.StatusCode, nil
+	}
+	if err := json.NewDecoder(response.Body).Decode(out); err != nil {
+		return response.StatusCode, fmt.Errorf("%s %s: decode: %w", method, path, err)
+	}
+	return response.StatusCode, nil
+}
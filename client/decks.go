@@ -0,0 +1,144 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/url"
+	"strconv"
+)
+
+// Card of the decks service.
+type Card struct {
+	ID   int    `json:"id"`
+	Name string `json:"name"`
+}
+
+// Trade proposed by UserA, giving ACardID in exchange for UserB's BCardID.
+type Trade struct {
+	UserA   string `json:"user_a"`
+	UserB   string `json:"user_b"`
+	ACardID int    `json:"a_card_id"`
+	BCardID int    `json:"b_card_id"`
+}
+
+// TradeProposal is the answer to a proposed trade.
+type TradeProposal struct {
+	TradeID int    `json:"trade_id"`
+	Status  string `json:"status"`
+}
+
+// ErrTradeSettling is returned by AcceptTrade when the counterparty lives on
+// another shard that did not answer yet: the trade completes later, and both
+// users get its events.
+var ErrTradeSettling = errors.New("trade is settling")
+
+// TradeResult tells which card each side received.
+type TradeResult struct {
+	UserAReceived Card `json:"user_a_received"`
+	UserBReceived Card `json:"user_b_received"`
+}
+
+// NodeStatus of a decks node.
+type NodeStatus struct {
+	NodeID     int    `json:"node_id"`
+	NodeAddr   string `json:"node_addr"`
+	LeaderID   int    `json:"leader_id"`
+	LeaderAddr string `json:"leader_addr"`
+	// Shard is the replica group of the node, empty when there is one.
+	Shard string `json:"shard"`
+
+	Term         uint64 `json:"term"`
+	AppliedIndex uint64 `json:"applied_index"`
+	// Ready is false while the node is behind the leader, see NotReady for why.
+	Ready    bool     `json:"ready"`
+	NotReady []string `json:"not_ready"`
+	Lag      uint64   `json:"lag"`
+}
+
+// Decks talks to any node of a decks cluster.
+type Decks struct {
+	base
+}
+
+// NewDecks returns a client for the node at url, such as http://localhost:8001.
+func NewDecks(url string, options ...Option) *Decks {
+	return &Decks{base: newBase(url, options)}
+}
+
+func userPath(user string) string {
+	return "/users/" + url.PathEscape(user)
+}
+
+// Cards lists the global deck.
+func (decks *Decks) Cards(ctx context.Context) ([]Card, error) {
+	var cards []Card
+	_, err := decks.do(ctx, http.MethodGet, "/cards", nil, &cards)
+	return cards, err
+}
+
+// AddCard adds a card to the global deck.
+func (decks *Decks) AddCard(ctx context.Context, card Card) (Card, error) {
+	var created Card
+	_, err := decks.do(ctx, http.MethodPost, "/cards", card, &created)
+	return created, err
+}
+
+// DeleteCard removes a card from the global deck.
+func (decks *Decks) DeleteCard(ctx context.Context, id int) error {
+	_, err := decks.do(ctx, http.MethodDelete, "/cards/"+strconv.Itoa(id), nil, nil)
+	return err
+}
+
+// UserCards lists the cards owned by user.
+func (decks *Decks) UserCards(ctx context.Context, user string) ([]Card, error) {
+	var cards []Card
+	_, err := decks.do(ctx, http.MethodGet, userPath(user)+"/cards", nil, &cards)
+	return cards, err
+}
+
+// AddUserCard gives a card to user.
+func (decks *Decks) AddUserCard(ctx context.Context, user string, card Card) (Card, error) {
+	var created Card
+	_, err := decks.do(ctx, http.MethodPost, userPath(user)+"/cards", card, &created)
+	return created, err
+}
+
+// DeleteUserCard removes a card from user.
+func (decks *Decks) DeleteUserCard(ctx context.Context, user string, id int) error {
+	_, err := decks.do(ctx, http.MethodDelete, userPath(user)+"/cards/"+strconv.Itoa(id), nil, nil)
+	return err
+}
+
+// Claim moves a card from the global deck to user and returns it.
+// Claims are rate limited per user: check [ErrRateLimited] and [APIError.RetryAfter].
+func (decks *Decks) Claim(ctx context.Context, user string) (Card, error) {
+	var card Card
+	_, err := decks.do(ctx, http.MethodGet, userPath(user)+"/claim", nil, &card)
+	return card, err
+}
+
+// ProposeTrade registers a trade, pending until UserB accepts it.
+func (decks *Decks) ProposeTrade(ctx context.Context, trade Trade) (TradeProposal, error) {
+	var proposal TradeProposal
+	_, err := decks.do(ctx, http.MethodPost, "/trade", trade, &proposal)
+	return proposal, err
+}
+
+// AcceptTrade accepts a trade on behalf of user, who must be its UserB.
+func (decks *Decks) AcceptTrade(ctx context.Context, tradeID int, user string) (TradeResult, error) {
+	var result TradeResult
+	body := map[string]string{"user": user}
+	status, err := decks.do(ctx, http.MethodPost, "/trade/"+strconv.Itoa(tradeID)+"/accept", body, &result)
+	if err == nil && status == http.StatusAccepted {
+		return TradeResult{}, ErrTradeSettling
+	}
+	return result, err
+}
+
+// Status returns the node status and the leader it knows.
+func (decks *Decks) Status(ctx context.Context) (NodeStatus, error) {
+	var status NodeStatus
+	_, err := decks.do(ctx, http.MethodGet, "/status", nil, &status)
+	return status, err
+}
@@ -0,0 +1,301 @@
+package client
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// MatchCard is a card played in the match service.
+type MatchCard struct {
+	ID    string `json:"id"`
+	Name  string `json:"name"`
+	Power int    `json:"power"`
+}
+
+// PlayerInfo describes one side of a match.
+type PlayerInfo struct {
+	PlayerID string      `json:"player_id"`
+	Server   string      `json:"server"`
+	Cards    []MatchCard `json:"cards"`
+}
+
+// Match between two players, played in rounds.
+type Match struct {
+	ID    string     `json:"id"`
+	Host  PlayerInfo `json:"p1"`
+	Guest PlayerInfo `json:"p2"`
+	// Home is the server running the match.
+	Home   string  `json:"home"`
+	Status string  `json:"status"`
+	Rounds int     `json:"rounds"`
+	Round  int     `json:"round"`
+	Played []Round `json:"played"`
+	Score  Score   `json:"score"`
+	// Pending lists the players who did not move yet in the current round.
+	Pending []string `json:"pending,omitempty"`
+	// Winner is a player ID or "draw", once the match is finished.
+	Winner    string `json:"winner,omitempty"`
+	Forfeited string `json:"forfeited,omitempty"`
+
+	StartedAt time.Time `json:"started_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+	// FinishedAt is zero while the match is played.
+	FinishedAt time.Time `json:"finished_at,omitzero"`
+}
+
+// Match statuses.
+const (
+	MatchPlaying  = "playing"
+	MatchFinished = "finished"
+)
+
+// Tactics of a move.
+const (
+	TacticBalanced  = "balanced"
+	TacticAttacking = "attacking"
+	TacticDefensive = "defensive"
+)
+
+// Move is what a player plays in a round: two cards of their hand and a tactic.
+type Move struct {
+	Attacker string `json:"attacker"`
+	Defender string `json:"defender"`
+	Tactic   string `json:"tactic"`
+}
+
+// Score counts the goals of each side.
+type Score struct {
+	Host  int `json:"p1"`
+	Guest int `json:"p2"`
+}
+
+// Duel is one attacker against the defender of the other player.
+type Duel struct {
+	Attacker    string    `json:"attacker"`
+	AttackCard  MatchCard `json:"attack_card"`
+	DefenseCard MatchCard `json:"defense_card"`
+	Attack      int       `json:"attack"`
+	Defense     int       `json:"defense"`
+	Goal        bool      `json:"goal"`
+}
+
+// Round is a resolved round, with the moves of both players.
+type Round struct {
+	Number    int    `json:"number"`
+	HostMove  Move   `json:"p1_move"`
+	GuestMove Move   `json:"p2_move"`
+	Duels     []Duel `json:"duels"`
+}
+
+// MatchServer talks to a single match server.
+type MatchServer struct {
+	base
+}
+
+// NewMatchServer returns a client for the server at url, such as http://localhost:8081.
+func NewMatchServer(url string, options ...Option) *MatchServer {
+	return &MatchServer{base: newBase(url, options)}
+}
+
+// Play enters a match with the given cards.
+//
+// When no opponent is available the player is queued: Play returns a nil
+// match and the match_start event arrives later on the player's WebSocket.
+func (server *MatchServer) Play(ctx context.Context, playerID string, cards []MatchCard) (*Match, error) {
+	body := map[string]any{"player_id": playerID, "cards": cards}
+
+	var match Match
+	status, err := server.do(ctx, http.MethodPost, "/play", body, &match)
+	if err != nil || status == http.StatusAccepted {
+		return nil, err
+	}
+	return &match, nil
+}
+
+// Cancel takes a queued player out of the queue. It fails with
+// ErrNotFound when the player is not queued.
+func (server *MatchServer) Cancel(ctx context.Context, playerID string) error {
+	_, err := server.do(ctx, http.MethodDelete, "/play?player_id="+url.QueryEscape(playerID), nil, nil)
+	return err
+}
+
+// Move plays the player's move for the current round of a match.
+//
+// Any server works: a move for a match running elsewhere is forwarded to
+// its home server. Errors are ErrForbidden for a player not in the match
+// and ErrConflict when the player already moved or the match is over.
+func (server *MatchServer) Move(ctx context.Context, matchID, playerID string, move Move) (*Match, error) {
+	body := map[string]any{
+		"player_id": playerID,
+		"attacker":  move.Attacker,
+		"defender":  move.Defender,
+		"tactic":    move.Tactic,
+	}
+	return server.move(ctx, matchID, body)
+}
+
+// Forfeit gives the match up; the opponent wins.
+func (server *MatchServer) Forfeit(ctx context.Context, matchID, playerID string) (*Match, error) {
+	return server.move(ctx, matchID, map[string]any{"player_id": playerID, "forfeit": true})
+}
+
+func (server *MatchServer) move(ctx context.Context, matchID string, body any) (*Match, error) {
+	var match Match
+	if _, err := server.do(ctx, http.MethodPost, "/matches/"+url.PathEscape(matchID)+"/moves", body, &match); err != nil {
+		return nil, err
+	}
+	return &match, nil
+}
+
+// Match returns a running or finished match, from any server that knows it.
+func (server *MatchServer) Match(ctx context.Context, matchID string) (*Match, error) {
+	var match Match
+	if _, err := server.do(ctx, http.MethodGet, "/matches/"+url.PathEscape(matchID), nil, &match); err != nil {
+		return nil, err
+	}
+	return &match, nil
+}
+
+// PlayerMatches lists the matches of a player, the most recent first.
+func (server *MatchServer) PlayerMatches(ctx context.Context, playerID string) ([]Match, error) {
+	var matches []Match
+	_, err := server.do(ctx, http.MethodGet, "/players/"+url.PathEscape(playerID)+"/matches", nil, &matches)
+	return matches, err
+}
+
+// Rating is the standing of a player in a season.
+type Rating struct {
+	PlayerID string `json:"player_id"`
+	Rating   int    `json:"rating"`
+	Division string `json:"division"`
+	Matches  int    `json:"matches"`
+	Wins     int    `json:"wins"`
+	Losses   int    `json:"losses"`
+	Draws    int    `json:"draws"`
+}
+
+// Standing is a rating with its rank in the season.
+type Standing struct {
+	Rank int `json:"rank"`
+	Rating
+}
+
+// Leaderboard is a page of the ranked players of a season.
+type Leaderboard struct {
+	Season      int        `json:"season"`
+	SeasonStart time.Time  `json:"season_start"`
+	SeasonEnd   time.Time  `json:"season_end"`
+	Division    string     `json:"division,omitempty"`
+	Total       int        `json:"total"`
+	Offset      int        `json:"offset"`
+	Limit       int        `json:"limit"`
+	Players     []Standing `json:"players"`
+}
+
+// LeaderboardQuery selects a page of the leaderboard. Zero values mean
+// the current season, every division, and the server's default page.
+type LeaderboardQuery struct {
+	Season   int
+	Division string
+	Offset   int
+	Limit    int
+}
+
+// Leaderboard returns a page of the ranked players of a season.
+func (server *MatchServer) Leaderboard(ctx context.Context, query LeaderboardQuery) (*Leaderboard, error) {
+	values := url.Values{}
+	if query.Season > 0 {
+		values.Set("season", strconv.Itoa(query.Season))
+	}
+	if query.Division != "" {
+		values.Set("division", query.Division)
+	}
+	if query.Offset > 0 {
+		values.Set("offset", strconv.Itoa(query.Offset))
+	}
+	if query.Limit > 0 {
+		values.Set("limit", strconv.Itoa(query.Limit))
+	}
+
+	var board Leaderboard
+	if _, err := server.do(ctx, http.MethodGet, "/leaderboard?"+values.Encode(), nil, &board); err != nil {
+		return nil, err
+	}
+	return &board, nil
+}
+
+// Rating returns the rating of a player in a season, or in the current
+// one when season is 0.
+func (server *MatchServer) Rating(ctx context.Context, playerID string, season int) (*Rating, error) {
+	path := "/players/" + url.PathEscape(playerID) + "/rating"
+	if season > 0 {
+		path += "?season=" + strconv.Itoa(season)
+	}
+
+	var rating Rating
+	if _, err := server.do(ctx, http.MethodGet, path, nil, &rating); err != nil {
+		return nil, err
+	}
+	return &rating, nil
+}
+
+// Peers lists the peers of the server that are not dead.
+func (server *MatchServer) Peers(ctx context.Context) ([]string, error) {
+	var peers []string
+	_, err := server.do(ctx, http.MethodGet, "/peers", nil, &peers)
+	return peers, err
+}
+
+// AddPeer adds a peer, given as host:port.
+func (server *MatchServer) AddPeer(ctx context.Context, peer string) error {
+	_, err := server.do(ctx, http.MethodPost, "/peers", map[string]string{"peer": peer}, nil)
+	return err
+}
+
+// Peer states.
+const (
+	PeerHealthy = "healthy"
+	PeerSuspect = "suspect"
+	PeerDead    = "dead"
+)
+
+// Peer is a peer of the server with its health and load, from the probes
+// the server sends it and from gossip.
+type Peer struct {
+	Address string `json:"address"`
+	State   string `json:"state"`
+	// Incarnation is raised by the peer at every start, and to refute
+	// rumors that it failed.
+	Incarnation uint64 `json:"incarnation"`
+	// Heartbeat is raised by the peer at every gossip round.
+	Heartbeat uint64   `json:"heartbeat"`
+	Load      PeerLoad `json:"load"`
+	// Failures counts the probes missed in a row.
+	Failures  int       `json:"failures"`
+	LastSeen  time.Time `json:"last_seen,omitzero"`
+	LastError string    `json:"last_error,omitempty"`
+	// Since is when the peer entered its state.
+	Since time.Time `json:"since"`
+}
+
+// PeerLoad tells how busy a peer is.
+type PeerLoad struct {
+	Waiting int `json:"waiting"`
+	Matches int `json:"matches"`
+}
+
+// PeerStatus lists every peer of the server with its health, dead ones included.
+func (server *MatchServer) PeerStatus(ctx context.Context) ([]Peer, error) {
+	var peers []Peer
+	_, err := server.do(ctx, http.MethodGet, "/peers/status", nil, &peers)
+	return peers, err
+}
+
+// RemovePeer removes a peer, given as host:port.
+func (server *MatchServer) RemovePeer(ctx context.Context, peer string) error {
+	_, err := server.do(ctx, http.MethodDelete, "/peers/"+url.PathEscape(peer), nil, nil)
+	return err
+}
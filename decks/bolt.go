@@ -0,0 +1,319 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// Buckets of the bolt storage: the global deck, one nested bucket per
+// user under users, and one nested bucket per set of the state under
+// state. Cards are JSON, keyed by their big-endian ID; the sequence of
+// a deck bucket is its version.
+var (
+	globalBucket = []byte("global")
+	usersBucket  = []byte("users")
+	stateBucket  = []byte("state")
+)
+
+// / Decks and the state besides them kept in a bolt file, so they
+// / survive restarts.
+// /
+// / A node that restarts still resyncs from the leader, which replaces
+// / what it read from disk; the file matters when the whole cluster
+// / restarts.
+type BoltStorage struct {
+	db *bolt.DB
+}
+
+func OpenBoltStorage(path string) (*BoltStorage, error) {
+	// another node on the same file would block forever otherwise
+	db, err := bolt.Open(path, 0o600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, err
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{globalBucket, usersBucket, stateBucket} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &BoltStorage{db: db}, nil
+}
+
+func cardKey(id int) []byte {
+	return binary.BigEndian.AppendUint64(nil, uint64(id))
+}
+
+func (bs *BoltStorage) Get(owner string, id int) (card Card, ok bool, err error) {
+	err = bs.db.View(func(tx *bolt.Tx) error {
+		card, ok, err = boltTx{tx}.Get(owner, id)
+		return err
+	})
+	return card, ok, err
+}
+
+func (bs *BoltStorage) Put(owner string, card Card) error {
+	return bs.Update(func(tx Tx) error { return tx.Put(owner, card) })
+}
+
+func (bs *BoltStorage) Delete(owner string, id int) (card Card, ok bool, err error) {
+	err = bs.Update(func(tx Tx) error {
+		card, ok, err = tx.Delete(owner, id)
+		return err
+	})
+	return card, ok, err
+}
+
+func (bs *BoltStorage) PutState(set, key string, value []byte) error {
+	return bs.Update(func(tx Tx) error { return tx.PutState(set, key, value) })
+}
+
+func (bs *BoltStorage) List(owner string) (cards []Card, err error) {
+	err = bs.db.View(func(tx *bolt.Tx) error {
+		cards, err = boltTx{tx}.List(owner)
+		return err
+	})
+	return cards, err
+}
+
+func (bs *BoltStorage) Version(owner string) (version uint64, err error) {
+	err = bs.db.View(func(tx *bolt.Tx) error {
+		version, err = boltTx{tx}.Version(owner)
+		return err
+	})
+	return version, err
+}
+
+func (bs *BoltStorage) Update(fn func(tx Tx) error) error {
+	return bs.db.Update(func(tx *bolt.Tx) error {
+		return fn(boltTx{tx})
+	})
+}
+
+func (bs *BoltStorage) View(fn func(tx Tx) error) error {
+	return bs.db.View(func(tx *bolt.Tx) error {
+		return fn(boltTx{tx})
+	})
+}
+
+func (bs *BoltStorage) Owners() (owners []string, err error) {
+	err = bs.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(usersBucket).ForEachBucket(func(name []byte) error {
+			owners = append(owners, string(name))
+			return nil
+		})
+	})
+	return owners, err
+}
+
+func (bs *BoltStorage) Counts() (counts DeckCounts, err error) {
+	err = bs.db.View(func(tx *bolt.Tx) error {
+		counts.Global = tx.Bucket(globalBucket).Stats().KeyN
+
+		users := tx.Bucket(usersBucket)
+		return users.ForEachBucket(func(name []byte) error {
+			counts.Users++
+			counts.UserCards += users.Bucket(name).Stats().KeyN
+			return nil
+		})
+	})
+	return counts, err
+}
+
+func (bs *BoltStorage) Snapshot() (DeckSnapshot, error) {
+	decks := DeckSnapshot{
+		Cards:    make(map[string][]Card),
+		Versions: make(map[string]uint64),
+	}
+
+	err := bs.db.View(func(tx *bolt.Tx) error {
+		global := tx.Bucket(globalBucket)
+		cards, err := readCards(global)
+		decks.Cards[""], decks.Versions[""] = cards, global.Sequence()
+		if err != nil {
+			return err
+		}
+
+		users := tx.Bucket(usersBucket)
+		return users.ForEachBucket(func(name []byte) error {
+			deck := users.Bucket(name)
+			cards, err := readCards(deck)
+			decks.Cards[string(name)], decks.Versions[string(name)] = cards, deck.Sequence()
+			return err
+		})
+	})
+	return decks, err
+}
+
+func (bs *BoltStorage) Restore(decks DeckSnapshot, state StateSnapshot) error {
+	return bs.db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{globalBucket, usersBucket, stateBucket} {
+			if err := tx.DeleteBucket(name); err != nil {
+				return err
+			}
+			if _, err := tx.CreateBucket(name); err != nil {
+				return err
+			}
+		}
+
+		for owner, cards := range decks.Cards {
+			for _, card := range cards {
+				if err := (boltTx{tx}).Put(owner, card); err != nil {
+					return err
+				}
+			}
+		}
+		for owner, version := range decks.Versions {
+			deck, err := boltTx{tx}.deck(owner, true)
+			if err != nil {
+				return err
+			}
+			if err := deck.SetSequence(version); err != nil {
+				return err
+			}
+		}
+		for set, values := range state {
+			for key, value := range values {
+				if err := (boltTx{tx}).PutState(set, key, value); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+}
+
+func (bs *BoltStorage) State() (StateSnapshot, error) {
+	state := make(StateSnapshot)
+	err := bs.db.View(func(tx *bolt.Tx) error {
+		sets := tx.Bucket(stateBucket)
+		return sets.ForEachBucket(func(name []byte) error {
+			values := make(map[string][]byte)
+			state[string(name)] = values
+			return sets.Bucket(name).ForEach(func(key, value []byte) error {
+				// values only live as long as the transaction
+				values[string(key)] = bytes.Clone(value)
+				return nil
+			})
+		})
+	})
+	return state, err
+}
+
+func (bs *BoltStorage) Close() error {
+	return bs.db.Close()
+}
+
+// / A bolt transaction seen as a Tx; writes fail on read-only ones
+type boltTx struct {
+	tx *bolt.Tx
+}
+
+// / Bucket of the deck of owner, created on demand when create is set
+func (tx boltTx) deck(owner string, create bool) (*bolt.Bucket, error) {
+	if owner == "" {
+		return tx.tx.Bucket(globalBucket), nil
+	}
+	users := tx.tx.Bucket(usersBucket)
+	if create {
+		return users.CreateBucketIfNotExists([]byte(owner))
+	}
+	return users.Bucket([]byte(owner)), nil
+}
+
+func (tx boltTx) Get(owner string, id int) (Card, bool, error) {
+	bucket, _ := tx.deck(owner, false)
+	if bucket == nil {
+		return Card{}, false, nil
+	}
+	data := bucket.Get(cardKey(id))
+	if data == nil {
+		return Card{}, false, nil
+	}
+
+	var card Card
+	err := json.Unmarshal(data, &card)
+	return card, err == nil, err
+}
+
+func (tx boltTx) Put(owner string, card Card) error {
+	bucket, err := tx.deck(owner, true)
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(card)
+	if err != nil {
+		return err
+	}
+	if _, err := bucket.NextSequence(); err != nil {
+		return err
+	}
+	return bucket.Put(cardKey(card.ID), data)
+}
+
+func (tx boltTx) Delete(owner string, id int) (Card, bool, error) {
+	card, ok, err := tx.Get(owner, id)
+	if err != nil || !ok {
+		return card, ok, err
+	}
+	bucket, _ := tx.deck(owner, false)
+	if _, err := bucket.NextSequence(); err != nil {
+		return card, true, err
+	}
+	return card, true, bucket.Delete(cardKey(id))
+}
+
+func (tx boltTx) PutState(set, key string, value []byte) error {
+	bucket, err := tx.tx.Bucket(stateBucket).CreateBucketIfNotExists([]byte(set))
+	if err != nil {
+		return err
+	}
+	if value == nil {
+		return bucket.Delete([]byte(key))
+	}
+	return bucket.Put([]byte(key), value)
+}
+
+func (tx boltTx) Version(owner string) (uint64, error) {
+	bucket, _ := tx.deck(owner, false)
+	if bucket == nil {
+		return 0, nil
+	}
+	return bucket.Sequence(), nil
+}
+
+func (tx boltTx) List(owner string) ([]Card, error) {
+	bucket, _ := tx.deck(owner, false)
+	if bucket == nil {
+		return []Card{}, nil
+	}
+	return readCards(bucket)
+}
+
+func readCards(bucket *bolt.Bucket) ([]Card, error) {
+	cards := []Card{}
+	err := bucket.ForEach(func(key, data []byte) error {
+		if data == nil {
+			return errors.New("unexpected nested bucket in a deck")
+		}
+		var card Card
+		if err := json.Unmarshal(data, &card); err != nil {
+			return err
+		}
+		cards = append(cards, card)
+		return nil
+	})
+	return cards, err
+}
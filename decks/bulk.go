@@ -0,0 +1,327 @@
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// / A card and the deck that holds it, as read by imports and written by exports.
+// /
+// / An empty owner is the global deck.
+type DeckEntry struct {
+	Owner string `json:"owner"`
+	ID    int    `json:"id"`
+	Name  string `json:"name"`
+}
+
+// / Problem found in one row of an import; rows are numbered from 1
+type ImportError struct {
+	Row   int    `json:"row"`
+	Error string `json:"error"`
+}
+
+type ImportReport struct {
+	Imported int           `json:"imported"`
+	Errors   []ImportError `json:"errors"`
+}
+
+// Bulk formats: CSV with an owner,id,name header, or one JSON object per line.
+const (
+	FormatCSV   = "csv"
+	FormatJSONL = "jsonl"
+)
+
+var csvHeader = []string{"owner", "id", "name"}
+
+// Largest import body accepted.
+const maxImportSize = 32 << 20
+
+// / Pick the bulk format from ?format=, then from the given header
+func bulkFormat(request *http.Request, header string) (string, error) {
+	format := request.URL.Query().Get("format")
+	if format == "" {
+		if strings.Contains(request.Header.Get(header), "csv") {
+			return FormatCSV, nil
+		}
+		return FormatJSONL, nil
+	}
+
+	switch format {
+	case FormatCSV, FormatJSONL:
+		return format, nil
+	case "ndjson":
+		return FormatJSONL, nil
+	}
+	return "", fmt.Errorf("unknown format %q, use csv or jsonl", format)
+}
+
+// / Read the rows of an import, keeping their row number.
+// /
+// / Malformed rows are reported as errors; the other rows are still read.
+func readEntries(body io.Reader, format string) ([]DeckEntry, []int, []ImportError, error) {
+	var entries []DeckEntry
+	var rows []int
+	var problems []ImportError
+
+	if format == FormatCSV {
+		reader := csv.NewReader(body)
+		reader.FieldsPerRecord = -1
+		reader.TrimLeadingSpace = true
+
+		for row := 1; ; row++ {
+			record, err := reader.Read()
+			if err == io.EOF {
+				break
+			}
+			var parseErr *csv.ParseError
+			if errors.As(err, &parseErr) {
+				return nil, nil, nil, fmt.Errorf("row %d: %w", row, parseErr.Err)
+			}
+			if err != nil {
+				return nil, nil, nil, err
+			}
+
+			if row == 1 && slices.Equal(lower(record), csvHeader) {
+				continue
+			}
+			if len(record) != len(csvHeader) {
+				problems = append(problems, ImportError{row, fmt.Sprintf("expected %d fields (owner,id,name), got %d", len(csvHeader), len(record))})
+				continue
+			}
+			id, err := strconv.Atoi(strings.TrimSpace(record[1]))
+			if err != nil {
+				problems = append(problems, ImportError{row, fmt.Sprintf("id is not a number: %q", record[1])})
+				continue
+			}
+			entries = append(entries, DeckEntry{Owner: strings.TrimSpace(record[0]), ID: id, Name: strings.TrimSpace(record[2])})
+			rows = append(rows, row)
+		}
+		return entries, rows, problems, nil
+	}
+
+	scanner := bufio.NewScanner(body)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for row := 1; scanner.Scan(); row++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+
+		var entry DeckEntry
+		decoder := json.NewDecoder(strings.NewReader(line))
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(&entry); err != nil {
+			problems = append(problems, ImportError{row, "invalid json: " + err.Error()})
+			continue
+		}
+		entry.Owner = strings.TrimSpace(entry.Owner)
+		entry.Name = strings.TrimSpace(entry.Name)
+		entries = append(entries, entry)
+		rows = append(rows, row)
+	}
+	return entries, rows, problems, scanner.Err()
+}
+
+func lower(record []string) []string {
+	out := make([]string, len(record))
+	for i, field := range record {
+		out[i] = strings.ToLower(strings.TrimSpace(field))
+	}
+	return out
+}
+
+// / Check the imported cards against each other and against the decks.
+// /
+// / Card IDs are unique across every deck of the shard, so an ID already
+// / held anywhere is rejected instead of silently moving the card. Decks
+// / of users of other shards are imported on those shards.
+// /
+// / Called with applyMu held, so the decks do not change until the
+// / import is committed.
+func (node *Node) validateEntries(entries []DeckEntry, rows []int) ([]ImportError, error) {
+	current, err := node.exportEntries(nil)
+	if err != nil {
+		return nil, err
+	}
+	held := make(map[int]string)
+	for _, entry := range current {
+		held[entry.ID] = entry.Owner
+	}
+
+	var problems []ImportError
+	seen := make(map[int]int)
+	for i, entry := range entries {
+		row := rows[i]
+		switch {
+		case entry.ID <= 0:
+			problems = append(problems, ImportError{row, fmt.Sprintf("id must be positive, got %d", entry.ID)})
+		case entry.Name == "":
+			problems = append(problems, ImportError{row, "name is required"})
+		case strings.Contains(entry.Owner, "/"):
+			problems = append(problems, ImportError{row, fmt.Sprintf("owner %q contains a slash", entry.Owner)})
+		case node.shardOf(entry.Owner) != node.config.Shard:
+			problems = append(problems, ImportError{row, fmt.Sprintf("owner %q belongs to shard %s, import it there", entry.Owner, node.shardOf(entry.Owner))})
+		default:
+			if first, ok := seen[entry.ID]; ok {
+				problems = append(problems, ImportError{row, fmt.Sprintf("id %d already used on row %d", entry.ID, first)})
+				continue
+			}
+			seen[entry.ID] = row
+
+			if owner, ok := held[entry.ID]; ok {
+				deck := "the global deck"
+				if owner != "" {
+					deck = "the deck of " + owner
+				}
+				problems = append(problems, ImportError{row, fmt.Sprintf("id %d is already in %s", entry.ID, deck)})
+			}
+		}
+	}
+	return problems, nil
+}
+
+// / Cards of every deck, or only of the given owner, sorted by owner and ID
+func (node *Node) exportEntries(owner *string) ([]DeckEntry, error) {
+	owners := []string{""}
+	if owner != nil {
+		owners = []string{*owner}
+	} else {
+		users, err := node.store.Owners()
+		if err != nil {
+			return nil, err
+		}
+		owners = append(owners, users...)
+	}
+	slices.Sort(owners)
+
+	var entries []DeckEntry
+	for _, user := range owners {
+		cards, err := node.store.List(user)
+		if err != nil {
+			return nil, err
+		}
+		slices.SortFunc(cards, func(a, b Card) int { return a.ID - b.ID })
+		for _, card := range cards {
+			entries = append(entries, DeckEntry{Owner: user, ID: card.ID, Name: card.Name})
+		}
+	}
+	return entries, nil
+}
+
+// / Import cards into the global and per-user decks
+// /
+// / The whole body is validated first: one bad row rejects the import,
+// / and every problem is reported. Valid imports are replicated as a
+// / single operation, so followers never see half of them.
+// /
+// / Example:
+// / POST /admin/import?format=csv
+// / owner,id,name
+// / ,1,ace
+// / alice,2,king
+func (node *Node) handleImport(writer http.ResponseWriter, request *http.Request) {
+	if !node.isLeader() {
+		node.forwardToLeader(writer, request)
+		return
+	}
+
+	format, err := bulkFormat(request, "Content-Type")
+	if err != nil {
+		http.Error(writer, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	body := http.MaxBytesReader(writer, request.Body, maxImportSize)
+	entries, rows, problems, err := readEntries(body, format)
+	if err != nil {
+		http.Error(writer, "failed to read import: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	// validated and committed under the commit lock, so two imports
+	// never both pass the duplicate check for the same card
+	node.applyMu.Lock()
+	defer node.applyMu.Unlock()
+
+	invalid, err := node.validateEntries(entries, rows)
+	if err != nil {
+		node.log(request.Context()).Error("import: failed to read the decks", "error", err)
+		http.Error(writer, "failed to read the decks", http.StatusInternalServerError)
+		return
+	}
+	problems = append(problems, invalid...)
+	slices.SortStableFunc(problems, func(a, b ImportError) int { return a.Row - b.Row })
+
+	report := ImportReport{Errors: problems}
+
+	if len(problems) > 0 {
+		writer.Header().Set("Content-Type", "application/json")
+		writer.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(writer).Encode(report)
+		return
+	}
+	if len(entries) > 0 {
+		if err := node.commitLocked(request.Context(), ReplicateRequest{Op: "import", Entries: entries}); err != nil {
+			http.Error(writer, "failed to import cards", http.StatusInternalServerError)
+			return
+		}
+		node.log(request.Context()).Info("import: applied", "cards", len(entries), "format", format)
+	}
+
+	report.Imported = len(entries)
+	report.Errors = []ImportError{}
+	writer.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(writer).Encode(report)
+}
+
+// / Export decks as CSV or JSON lines
+// /
+// / Every deck of the shard is exported unless ?owner= selects one; an
+// / empty owner is the global deck. The deck of a user of another shard
+// / is exported by that shard.
+// /
+// / Example:
+// / GET /admin/export?format=csv&owner=alice
+func (node *Node) handleExport(writer http.ResponseWriter, request *http.Request) {
+	format, err := bulkFormat(request, "Accept")
+	if err != nil {
+		http.Error(writer, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var owner *string
+	if query := request.URL.Query(); query.Has("owner") {
+		selected := query.Get("owner")
+		owner = &selected
+	}
+	entries, err := node.exportEntries(owner)
+	if err != nil {
+		node.log(request.Context()).Error("export: failed to read the decks", "error", err)
+		http.Error(writer, "failed to read the decks", http.StatusInternalServerError)
+		return
+	}
+
+	if format == FormatCSV {
+		writer.Header().Set("Content-Type", "text/csv")
+		out := csv.NewWriter(writer)
+		out.Write(csvHeader)
+		for _, entry := range entries {
+			out.Write([]string{entry.Owner, strconv.Itoa(entry.ID), entry.Name})
+		}
+		out.Flush()
+		return
+	}
+
+	writer.Header().Set("Content-Type", "application/x-ndjson")
+	encoder := json.NewEncoder(writer)
+	for _, entry := range entries {
+		encoder.Encode(entry)
+	}
+}
@@ -1,45 +1,30 @@
 package main
 
+import "errors"
 import "flag"
 import "log"
-import "strconv"
+import "os"
 import "strings"
 
 func NodeFromCLI() (Address, *Node) {
-
-	/// Example: -id=1
-	idFlag := flag.Int("id", 1, "numeric id for this node")
-	/// Example: -addr=http://localhost:8001
-	addressFlag := flag.String("addr", "http://localhost:8001", "public address for this node, used by peers (include scheme and port)")
-	/// Example: -peers=1=http://localhost:8001,2=http://localhost:8002,3=http://localhost:8003
-	peersFlag := flag.String("peers", "", "comma-separated list of peers as id=addr,id=addr")
-
-	flag.Parse()
-
-	peers := make(Peers)
-	if *peersFlag != "" {
-		items := strings.Split(*peersFlag, ",")
-		for _, item := range items {
-			item = strings.TrimSpace(item)
-			if item == "" {
-				continue
-			}
-			parts := strings.SplitN(item, "=", 2)
-			if len(parts) != 2 {
-				log.Fatalf("bad peer entry: %s", item)
-			}
-			pid, err := strconv.Atoi(parts[0])
-			if err != nil {
-				log.Fatalf("bad peer id: %s", parts[0])
-			}
-			peers[pid] = parts[1]
-		}
+	config, err := LoadConfig(os.Args[1:])
+	if errors.Is(err, flag.ErrHelp) {
+		os.Exit(0)
+	}
+	if err != nil {
+		log.Fatal(err)
 	}
 
-	peers[*idFlag] = *addressFlag
+	storage, err := openStorage(config)
+	if err != nil {
+		log.Fatal(err)
+	}
 
-	node := NewNode(*idFlag, *addressFlag, peers)
-	normalizedAddress := normalizeAddress(addressFlag)
+	node, err := NewNode(config, storage)
+	if err != nil {
+		log.Fatalf("storage: %v", err)
+	}
+	normalizedAddress := normalizeAddress(&config.Address)
 	return normalizedAddress, node
 }
 
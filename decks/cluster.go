@@ -0,0 +1,201 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// Roles of a node in the cluster view.
+const (
+	RoleLeader   = "leader"
+	RoleFollower = "follower"
+	RoleLeaving  = "leaving"
+)
+
+// / One node of the cluster, as it describes itself
+type ClusterNode struct {
+	ID        PeerID  `json:"id"`
+	Addr      Address `json:"addr"`
+	Reachable bool    `json:"reachable"`
+	Error     string  `json:"error,omitempty"`
+
+	Role         string     `json:"role,omitempty"`
+	LeaderID     PeerID     `json:"leader_id,omitempty"`
+	Term         uint64     `json:"term"`
+	AppliedIndex uint64     `json:"applied_index"`
+	Ready        bool       `json:"ready"`
+	Decks        DeckCounts `json:"decks"`
+}
+
+// / Something the nodes do not agree on
+type Disagreement struct {
+	// leaders, leader or decks
+	Kind   string   `json:"kind"`
+	Detail string   `json:"detail"`
+	Nodes  []PeerID `json:"nodes"`
+}
+
+type ClusterView struct {
+	// Leader every reachable node agrees on, 0 when they do not
+	Leader        PeerID         `json:"leader"`
+	Nodes         []ClusterNode  `json:"nodes"`
+	Disagreements []Disagreement `json:"disagreements"`
+}
+
+// / Ask every peer for its status, concurrently, and compare the answers.
+// /
+// / Example:
+// / GET /cluster
+func (node *Node) handleCluster(writer http.ResponseWriter, request *http.Request) {
+	ctx, cancel := context.WithTimeout(request.Context(), node.client.Timeout)
+	defer cancel()
+
+	writer.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(writer).Encode(node.clusterView(ctx))
+}
+
+func (node *Node) clusterView(ctx context.Context) ClusterView {
+	ids := make([]PeerID, 0, len(node.peers))
+	for id := range node.peers {
+		ids = append(ids, id)
+	}
+	slices.Sort(ids)
+
+	nodes := make([]ClusterNode, len(ids))
+	var wait sync.WaitGroup
+	for i, id := range ids {
+		nodes[i] = ClusterNode{ID: id, Addr: node.peers[id]}
+		if id == node.id {
+			nodes[i].describe(node.status())
+			continue
+		}
+
+		wait.Add(1)
+		go func() {
+			defer wait.Done()
+			status, err := node.transport.Status(ctx, nodes[i].Addr)
+			if err != nil {
+				nodes[i].Error = err.Error()
+				return
+			}
+			nodes[i].describe(status)
+		}()
+	}
+	wait.Wait()
+
+	return ClusterView{
+		Leader:        agreedLeader(nodes),
+		Nodes:         nodes,
+		Disagreements: disagreements(nodes),
+	}
+}
+
+func (clusterNode *ClusterNode) describe(status NodeStatus) {
+	clusterNode.Reachable = true
+	clusterNode.Role = RoleFollower
+	switch {
+	case status.Leaving:
+		clusterNode.Role = RoleLeaving
+	case status.LeaderID == status.NodeID:
+		clusterNode.Role = RoleLeader
+	}
+	clusterNode.LeaderID = status.LeaderID
+	clusterNode.Term = status.Term
+	clusterNode.AppliedIndex = status.AppliedIndex
+	clusterNode.Ready = status.Ready
+	clusterNode.Decks = status.Decks
+}
+
+func agreedLeader(nodes []ClusterNode) PeerID {
+	leader := 0
+	for _, clusterNode := range nodes {
+		if !clusterNode.Reachable {
+			continue
+		}
+		if leader != 0 && clusterNode.LeaderID != leader {
+			return 0
+		}
+		leader = clusterNode.LeaderID
+	}
+	return leader
+}
+
+// / Compare what the reachable nodes say.
+// /
+// / Deck sizes are only compared between nodes at the same applied
+// / index: a follower behind the leader is lagging, not diverging.
+func disagreements(nodes []ClusterNode) []Disagreement {
+	found := []Disagreement{}
+
+	var leaders []PeerID
+	beliefs := make(map[PeerID][]PeerID)
+	atIndex := make(map[uint64][]ClusterNode)
+	for _, clusterNode := range nodes {
+		if !clusterNode.Reachable {
+			continue
+		}
+		if clusterNode.Role == RoleLeader {
+			leaders = append(leaders, clusterNode.ID)
+		}
+		beliefs[clusterNode.LeaderID] = append(beliefs[clusterNode.LeaderID], clusterNode.ID)
+		atIndex[clusterNode.AppliedIndex] = append(atIndex[clusterNode.AppliedIndex], clusterNode)
+	}
+
+	if len(leaders) > 1 {
+		found = append(found, Disagreement{
+			Kind:   "leaders",
+			Detail: fmt.Sprintf("%d nodes declare themselves leader", len(leaders)),
+			Nodes:  leaders,
+		})
+	}
+
+	if len(beliefs) > 1 {
+		var parts []string
+		var believers []PeerID
+		for _, clusterNode := range nodes {
+			if clusterNode.Reachable {
+				parts = append(parts, fmt.Sprintf("node %d follows %d (term %d)", clusterNode.ID, clusterNode.LeaderID, clusterNode.Term))
+				believers = append(believers, clusterNode.ID)
+			}
+		}
+		found = append(found, Disagreement{
+			Kind:   "leader",
+			Detail: strings.Join(parts, ", "),
+			Nodes:  believers,
+		})
+	}
+
+	indices := make([]uint64, 0, len(atIndex))
+	for index := range atIndex {
+		indices = append(indices, index)
+	}
+	slices.Sort(indices)
+	for _, index := range indices {
+		group := atIndex[index]
+		diverged := slices.ContainsFunc(group, func(clusterNode ClusterNode) bool {
+			return clusterNode.Decks != group[0].Decks
+		})
+		if !diverged {
+			continue
+		}
+
+		var parts []string
+		var ids []PeerID
+		for _, clusterNode := range group {
+			decks := clusterNode.Decks
+			parts = append(parts, fmt.Sprintf("node %d: global=%d users=%d user_cards=%d", clusterNode.ID, decks.Global, decks.Users, decks.UserCards))
+			ids = append(ids, clusterNode.ID)
+		}
+		found = append(found, Disagreement{
+			Kind:   "decks",
+			Detail: fmt.Sprintf("different decks at index %d: %s", index, strings.Join(parts, ", ")),
+			Nodes:  ids,
+		})
+	}
+	return found
+}
@@ -0,0 +1,504 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/goccy/go-yaml"
+	"github.com/pelletier/go-toml/v2"
+)
+
+// / Node configuration
+// /
+// / Values are resolved in layers, each one overriding the previous:
+// / built-in defaults, the config file, DECKS_* environment variables
+// / and finally the command-line flags that were explicitly set.
+type Config struct {
+	ID      PeerID  `yaml:"id" toml:"id"`
+	Address Address `yaml:"addr" toml:"addr"`
+	Peers   Peers   `yaml:"peers" toml:"peers"`
+	DataDir string  `yaml:"data_dir" toml:"data_dir"`
+	// Where decks are kept: "memory", or "bolt" (a file in DataDir)
+	Storage string `yaml:"storage" toml:"storage"`
+
+	// Replica group of this node, and the members of every group; users
+	// are spread over the groups, none when Shards is empty
+	Shard  string               `yaml:"shard" toml:"shard"`
+	Shards map[string][]Address `yaml:"shards" toml:"shards"`
+
+	// Interval between two bully elections
+	ElectionInterval Duration `yaml:"election_interval" toml:"election_interval"`
+	// Timeout of every request sent to peers
+	ClientTimeout Duration `yaml:"client_timeout" toml:"client_timeout"`
+	// Time given to drain requests and hand leadership over on SIGTERM
+	ShutdownTimeout Duration `yaml:"shutdown_timeout" toml:"shutdown_timeout"`
+	// Longest time a follower may go without hearing from the leader and stay ready
+	MaxLag Duration `yaml:"max_lag" toml:"max_lag"`
+	// Most operations a follower may be behind the leader and stay ready
+	MaxLagOps uint64 `yaml:"max_lag_ops" toml:"max_lag_ops"`
+	// Peer transport: "rest" (JSON over HTTP) or "gob" (binary, persistent)
+	Transport string `yaml:"transport" toml:"transport"`
+
+	// Amount of cards generated when the global deck runs empty
+	RegenSize int `yaml:"regen_size" toml:"regen_size"`
+
+	// Attempts made to deliver a webhook before it becomes a dead letter
+	WebhookAttempts int `yaml:"webhook_attempts" toml:"webhook_attempts"`
+	// Delay before the first webhook retry, doubled on every attempt
+	WebhookBackoff Duration `yaml:"webhook_backoff" toml:"webhook_backoff"`
+
+	// Per-user token buckets by endpoint: claim, trade and accept
+	RateLimits map[string]RateLimit `yaml:"rate_limits" toml:"rate_limits"`
+	// Minimum time between two successful claims of a user, 0 to disable
+	ClaimCooldown Duration `yaml:"claim_cooldown" toml:"claim_cooldown"`
+}
+
+// Duration is a time.Duration that reads as "3s", "500ms"...
+// from config files and the environment.
+type Duration time.Duration
+
+func (d *Duration) UnmarshalText(text []byte) error {
+	parsed, err := time.ParseDuration(string(text))
+	if err != nil {
+		return err
+	}
+	*d = Duration(parsed)
+	return nil
+}
+
+func (d Duration) MarshalText() ([]byte, error) {
+	return []byte(time.Duration(d).String()), nil
+}
+
+func (d Duration) String() string {
+	return time.Duration(d).String()
+}
+
+func DefaultConfig() Config {
+	return Config{
+		ID:               1,
+		Address:          "http://localhost:8001",
+		Peers:            make(Peers),
+		Storage:          StorageMemory,
+		ElectionInterval: Duration(3 * time.Second),
+		ClientTimeout:    Duration(5 * time.Second),
+		ShutdownTimeout:  Duration(15 * time.Second),
+		MaxLag:           Duration(10 * time.Second),
+		MaxLagOps:        100,
+		Transport:        TransportREST,
+		RegenSize:        20,
+		WebhookAttempts:  5,
+		WebhookBackoff:   Duration(time.Second),
+		RateLimits: map[string]RateLimit{
+			LimitClaim: {Every: Duration(time.Second), Burst: 5},
+		},
+	}
+}
+
+// / Load the configuration from the config file, environment and flags.
+// /
+// / The file is taken from -config or DECKS_CONFIG. Its format is
+// / picked by extension: .yaml, .yml or .toml.
+func LoadConfig(args []string) (Config, error) {
+	config := DefaultConfig()
+
+	flags := flag.NewFlagSet("decks", flag.ContinueOnError)
+
+	/// Example: -config=decks.yaml
+	configFlag := flags.String("config", "", "path to a YAML or TOML config file")
+	/// Example: -id=1
+	idFlag := flags.Int("id", config.ID, "numeric id for this node")
+	/// Example: -addr=http://localhost:8001
+	addressFlag := flags.String("addr", config.Address, "public address for this node, used by peers (include scheme and port)")
+	/// Example: -peers=1=http://localhost:8001,2=http://localhost:8002,3=http://localhost:8003
+	peersFlag := flags.String("peers", "", "comma-separated list of peers as id=addr,id=addr")
+	dataDirFlag := flags.String("data-dir", "", "directory for persistent node data")
+	storageFlag := flags.String("storage", config.Storage, "deck storage: memory or bolt (needs -data-dir)")
+	shardFlag := flags.String("shard", "", "replica group of this node, one of -shards")
+	/// Example: -shards=a=http://localhost:8001|http://localhost:8002,b=http://localhost:8011|http://localhost:8012
+	shardsFlag := flags.String("shards", "", "members of every replica group as name=addr|addr,name=addr|addr")
+	electionFlag := flags.Duration("election-interval", time.Duration(config.ElectionInterval), "interval between leader elections")
+	timeoutFlag := flags.Duration("client-timeout", time.Duration(config.ClientTimeout), "timeout for requests sent to peers")
+	shutdownFlag := flags.Duration("shutdown-timeout", time.Duration(config.ShutdownTimeout), "time to drain requests and hand leadership over on SIGTERM")
+	maxLagFlag := flags.Duration("max-lag", time.Duration(config.MaxLag), "longest silence from the leader before a follower is not ready")
+	maxLagOpsFlag := flags.Uint64("max-lag-ops", config.MaxLagOps, "most operations a follower may be behind the leader and stay ready")
+	transportFlag := flags.String("transport", config.Transport, "peer transport: rest or gob")
+	regenFlag := flags.Int("regen-size", config.RegenSize, "cards generated when the global deck is empty")
+	attemptsFlag := flags.Int("webhook-attempts", config.WebhookAttempts, "webhook delivery attempts before giving up")
+	backoffFlag := flags.Duration("webhook-backoff", time.Duration(config.WebhookBackoff), "delay before the first webhook retry")
+	/// Example: -rate-limits=claim=2s/3,trade=1s/10
+	limitsFlag := flags.String("rate-limits", "", "per-user rate limits as endpoint=every/burst,...")
+	cooldownFlag := flags.Duration("claim-cooldown", time.Duration(config.ClaimCooldown), "minimum time between two claims of a user")
+
+	if err := flags.Parse(args); err != nil {
+		return config, err
+	}
+
+	path := os.Getenv("DECKS_CONFIG")
+	if *configFlag != "" {
+		path = *configFlag
+	}
+	if path != "" {
+		if err := config.loadFile(path); err != nil {
+			return config, err
+		}
+	}
+
+	if err := config.loadEnv(); err != nil {
+		return config, err
+	}
+
+	var errs []error
+	flags.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "id":
+			config.ID = *idFlag
+		case "addr":
+			config.Address = *addressFlag
+		case "peers":
+			peers, err := parsePeers(*peersFlag)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("flag -peers: %w", err))
+				return
+			}
+			config.Peers = peers
+		case "data-dir":
+			config.DataDir = *dataDirFlag
+		case "storage":
+			config.Storage = *storageFlag
+		case "shard":
+			config.Shard = *shardFlag
+		case "shards":
+			shards, err := parseShards(*shardsFlag)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("flag -shards: %w", err))
+				return
+			}
+			config.Shards = shards
+		case "election-interval":
+			config.ElectionInterval = Duration(*electionFlag)
+		case "client-timeout":
+			config.ClientTimeout = Duration(*timeoutFlag)
+		case "shutdown-timeout":
+			config.ShutdownTimeout = Duration(*shutdownFlag)
+		case "max-lag":
+			config.MaxLag = Duration(*maxLagFlag)
+		case "max-lag-ops":
+			config.MaxLagOps = *maxLagOpsFlag
+		case "transport":
+			config.Transport = *transportFlag
+		case "regen-size":
+			config.RegenSize = *regenFlag
+		case "webhook-attempts":
+			config.WebhookAttempts = *attemptsFlag
+		case "webhook-backoff":
+			config.WebhookBackoff = Duration(*backoffFlag)
+		case "rate-limits":
+			limits, err := parseRateLimits(*limitsFlag)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("flag -rate-limits: %w", err))
+				return
+			}
+			config.RateLimits = limits
+		case "claim-cooldown":
+			config.ClaimCooldown = Duration(*cooldownFlag)
+		}
+	})
+	if len(errs) > 0 {
+		return config, errors.Join(errs...)
+	}
+
+	if config.Peers == nil {
+		config.Peers = make(Peers)
+	}
+	if err := config.Validate(); err != nil {
+		return config, err
+	}
+
+	// a node always knows itself
+	config.Peers[config.ID] = config.Address
+
+	if config.DataDir != "" {
+		if err := os.MkdirAll(config.DataDir, 0o755); err != nil {
+			return config, fmt.Errorf("config: data_dir: %w", err)
+		}
+	}
+	return config, nil
+}
+
+func (config *Config) loadFile(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("config: %w", err)
+	}
+
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		err = yaml.UnmarshalWithOptions(data, config, yaml.Strict())
+	case ".toml":
+		decoder := toml.NewDecoder(bytes.NewReader(data))
+		decoder.DisallowUnknownFields()
+		err = decoder.Decode(config)
+	default:
+		return fmt.Errorf("config: %s: unsupported format, use .yaml, .yml or .toml", path)
+	}
+
+	if err != nil {
+		return fmt.Errorf("config: %s: %w", path, err)
+	}
+	return nil
+}
+
+func (config *Config) loadEnv() error {
+	var errs []error
+
+	if value, ok := os.LookupEnv("DECKS_ID"); ok {
+		id, err := strconv.Atoi(value)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("DECKS_ID: not a number: %q", value))
+		}
+		config.ID = id
+	}
+	if value, ok := os.LookupEnv("DECKS_ADDR"); ok {
+		config.Address = value
+	}
+	if value, ok := os.LookupEnv("DECKS_PEERS"); ok {
+		peers, err := parsePeers(value)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("DECKS_PEERS: %w", err))
+		}
+		config.Peers = peers
+	}
+	if value, ok := os.LookupEnv("DECKS_DATA_DIR"); ok {
+		config.DataDir = value
+	}
+	if value, ok := os.LookupEnv("DECKS_STORAGE"); ok {
+		config.Storage = value
+	}
+	if value, ok := os.LookupEnv("DECKS_SHARD"); ok {
+		config.Shard = value
+	}
+	if value, ok := os.LookupEnv("DECKS_SHARDS"); ok {
+		shards, err := parseShards(value)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("DECKS_SHARDS: %w", err))
+		}
+		config.Shards = shards
+	}
+	if value, ok := os.LookupEnv("DECKS_ELECTION_INTERVAL"); ok {
+		if err := config.ElectionInterval.UnmarshalText([]byte(value)); err != nil {
+			errs = append(errs, fmt.Errorf("DECKS_ELECTION_INTERVAL: %w", err))
+		}
+	}
+	if value, ok := os.LookupEnv("DECKS_CLIENT_TIMEOUT"); ok {
+		if err := config.ClientTimeout.UnmarshalText([]byte(value)); err != nil {
+			errs = append(errs, fmt.Errorf("DECKS_CLIENT_TIMEOUT: %w", err))
+		}
+	}
+	if value, ok := os.LookupEnv("DECKS_SHUTDOWN_TIMEOUT"); ok {
+		if err := config.ShutdownTimeout.UnmarshalText([]byte(value)); err != nil {
+			errs = append(errs, fmt.Errorf("DECKS_SHUTDOWN_TIMEOUT: %w", err))
+		}
+	}
+	if value, ok := os.LookupEnv("DECKS_MAX_LAG"); ok {
+		if err := config.MaxLag.UnmarshalText([]byte(value)); err != nil {
+			errs = append(errs, fmt.Errorf("DECKS_MAX_LAG: %w", err))
+		}
+	}
+	if value, ok := os.LookupEnv("DECKS_MAX_LAG_OPS"); ok {
+		ops, err := strconv.ParseUint(value, 10, 64)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("DECKS_MAX_LAG_OPS: not a number: %q", value))
+		}
+		config.MaxLagOps = ops
+	}
+	if value, ok := os.LookupEnv("DECKS_TRANSPORT"); ok {
+		config.Transport = value
+	}
+	if value, ok := os.LookupEnv("DECKS_REGEN_SIZE"); ok {
+		size, err := strconv.Atoi(value)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("DECKS_REGEN_SIZE: not a number: %q", value))
+		}
+		config.RegenSize = size
+	}
+	if value, ok := os.LookupEnv("DECKS_WEBHOOK_ATTEMPTS"); ok {
+		attempts, err := strconv.Atoi(value)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("DECKS_WEBHOOK_ATTEMPTS: not a number: %q", value))
+		}
+		config.WebhookAttempts = attempts
+	}
+	if value, ok := os.LookupEnv("DECKS_WEBHOOK_BACKOFF"); ok {
+		if err := config.WebhookBackoff.UnmarshalText([]byte(value)); err != nil {
+			errs = append(errs, fmt.Errorf("DECKS_WEBHOOK_BACKOFF: %w", err))
+		}
+	}
+	if value, ok := os.LookupEnv("DECKS_RATE_LIMITS"); ok {
+		limits, err := parseRateLimits(value)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("DECKS_RATE_LIMITS: %w", err))
+		}
+		config.RateLimits = limits
+	}
+	if value, ok := os.LookupEnv("DECKS_CLAIM_COOLDOWN"); ok {
+		if err := config.ClaimCooldown.UnmarshalText([]byte(value)); err != nil {
+			errs = append(errs, fmt.Errorf("DECKS_CLAIM_COOLDOWN: %w", err))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// / Check that the configuration is usable, reporting every problem at once.
+func (config *Config) Validate() error {
+	var errs []error
+
+	if config.ID <= 0 {
+		errs = append(errs, fmt.Errorf("id must be a positive number, got %d", config.ID))
+	}
+	if config.Address == "" {
+		errs = append(errs, errors.New("addr is required"))
+	}
+	for id, address := range config.Peers {
+		if id <= 0 {
+			errs = append(errs, fmt.Errorf("peer id must be a positive number, got %d", id))
+		}
+		if address == "" {
+			errs = append(errs, fmt.Errorf("peer %d has an empty address", id))
+		}
+		if id == config.ID && address != config.Address {
+			errs = append(errs, fmt.Errorf("peer %d is this node but has address %s instead of %s", id, address, config.Address))
+		}
+	}
+	switch config.Storage {
+	case StorageMemory:
+	case StorageBolt:
+		if config.DataDir == "" {
+			errs = append(errs, fmt.Errorf("storage %q needs data_dir", StorageBolt))
+		}
+	default:
+		errs = append(errs, fmt.Errorf("storage must be %q or %q, got %q", StorageMemory, StorageBolt, config.Storage))
+	}
+	errs = append(errs, config.validateShards()...)
+	if config.ElectionInterval <= 0 {
+		errs = append(errs, fmt.Errorf("election_interval must be positive, got %s", config.ElectionInterval))
+	}
+	if config.ClientTimeout <= 0 {
+		errs = append(errs, fmt.Errorf("client_timeout must be positive, got %s", config.ClientTimeout))
+	}
+	if config.ShutdownTimeout <= 0 {
+		errs = append(errs, fmt.Errorf("shutdown_timeout must be positive, got %s", config.ShutdownTimeout))
+	}
+	// followers hear from the leader once per election at least
+	if config.MaxLag <= config.ElectionInterval {
+		errs = append(errs, fmt.Errorf("max_lag must be longer than election_interval (%s), got %s", config.ElectionInterval, config.MaxLag))
+	}
+	if config.Transport != TransportREST && config.Transport != TransportGob {
+		errs = append(errs, fmt.Errorf("transport must be %q or %q, got %q", TransportREST, TransportGob, config.Transport))
+	}
+	if config.RegenSize <= 0 {
+		errs = append(errs, fmt.Errorf("regen_size must be positive, got %d", config.RegenSize))
+	}
+	if config.WebhookAttempts <= 0 {
+		errs = append(errs, fmt.Errorf("webhook_attempts must be positive, got %d", config.WebhookAttempts))
+	}
+	if config.WebhookBackoff <= 0 {
+		errs = append(errs, fmt.Errorf("webhook_backoff must be positive, got %s", config.WebhookBackoff))
+	}
+	errs = append(errs, validateRateLimits(config.RateLimits)...)
+	if config.ClaimCooldown < 0 {
+		errs = append(errs, fmt.Errorf("claim_cooldown must not be negative, got %s", config.ClaimCooldown))
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("invalid config: %w", errors.Join(errs...))
+	}
+	return nil
+}
+
+// / Parse peers written as id=addr,id=addr
+func parsePeers(raw string) (Peers, error) {
+	peers := make(Peers)
+
+	for _, item := range strings.Split(raw, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		parts := strings.SplitN(item, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("bad peer entry: %s", item)
+		}
+		pid, err := strconv.Atoi(parts[0])
+		if err != nil {
+			return nil, fmt.Errorf("bad peer id: %s", parts[0])
+		}
+		peers[pid] = parts[1]
+	}
+	return peers, nil
+}
+
+// / Shards must list this node in its own shard, and its peers with it
+func (config *Config) validateShards() []error {
+	if len(config.Shards) == 0 {
+		if config.Shard != "" {
+			return []error{fmt.Errorf("shard %q is set but shards is empty", config.Shard)}
+		}
+		return nil
+	}
+
+	var errs []error
+	for name, members := range config.Shards {
+		if name == "" || strings.ContainsAny(name, ",=|") {
+			errs = append(errs, fmt.Errorf("shard name %q must be non-empty, without , = or |", name))
+		}
+		if len(members) == 0 {
+			errs = append(errs, fmt.Errorf("shard %q has no members", name))
+		}
+	}
+
+	members, ok := config.Shards[config.Shard]
+	if !ok {
+		return append(errs, fmt.Errorf("shard must be one of shards, got %q", config.Shard))
+	}
+	if !slices.Contains(members, config.Address) {
+		errs = append(errs, fmt.Errorf("shard %q does not list this node (%s)", config.Shard, config.Address))
+	}
+	for id, address := range config.Peers {
+		if !slices.Contains(members, address) {
+			errs = append(errs, fmt.Errorf("peer %d (%s) is not a member of shard %q", id, address, config.Shard))
+		}
+	}
+	return errs
+}
+
+// / Parse shards written as name=addr|addr,name=addr|addr
+func parseShards(raw string) (map[string][]Address, error) {
+	shards := make(map[string][]Address)
+
+	for _, item := range strings.Split(raw, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		name, members, ok := strings.Cut(item, "=")
+		if !ok || members == "" {
+			return nil, fmt.Errorf("bad shard entry: %s", item)
+		}
+		for _, member := range strings.Split(members, "|") {
+			if member = strings.TrimSpace(member); member != "" {
+				shards[name] = append(shards[name], member)
+			}
+		}
+	}
+	return shards, nil
+}
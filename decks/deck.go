@@ -4,11 +4,10 @@ import "sync"
 
 // In-Memoty Deck
 //
-// This deck could use a distributed database,
-// on real implementations.
+// Cards by ID. Decks are guarded by the storage holding them.
 type Deck struct {
-	mu    sync.RWMutex
-	cards map[int]Card
+	cards   map[int]Card
+	version uint64
 }
 
 func NewDeck() *Deck {
@@ -17,69 +16,262 @@ func NewDeck() *Deck {
 	}
 }
 
-// DeckStore holds the global deck and per-user decks.
-type DeckStore struct {
+// / Size of the decks held by a node
+type DeckCounts struct {
+	Global    int `json:"global"`
+	Users     int `json:"users"`
+	UserCards int `json:"user_cards"`
+}
+
+// MemoryStorage holds the global deck and per-user decks in memory.
+//
+// This is the default storage: nothing survives a restart, and a
+// node gets its decks back from the leader's snapshot. The state
+// besides the decks is only kept by the node itself.
+type MemoryStorage struct {
 	mu     sync.RWMutex
 	global *Deck
 	users  map[string]*Deck
 }
 
-func NewDeckStore() *DeckStore {
-	return &DeckStore{
+func NewMemoryStorage() *MemoryStorage {
+	return &MemoryStorage{
 		global: NewDeck(),
 		users:  make(map[string]*Deck),
 	}
 }
 
-// resolveDeck returns the deck for a user; empty user -> global
-func (ds *DeckStore) resolveDeck(user string) *Deck {
+// resolveDeck returns the deck for a user; empty user -> global.
+// A missing user deck is created when create is set, nil otherwise.
+func (ms *MemoryStorage) resolveDeck(user string, create bool) *Deck {
 	if user == "" {
-		return ds.global
+		return ms.global
 	}
 
-	ds.mu.Lock()
-	defer ds.mu.Unlock()
-	d, ok := ds.users[user]
-	if !ok {
+	d, ok := ms.users[user]
+	if !ok && create {
 		d = NewDeck()
-		ds.users[user] = d
+		ms.users[user] = d
 	}
 	return d
 }
 
-func (ds *DeckStore) Add(user string, card Card) {
-	d := ds.resolveDeck(user)
-	d.Add(card)
+func (ms *MemoryStorage) Get(owner string, id int) (Card, bool, error) {
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+
+	return memoryTx{ms, nil}.Get(owner, id)
+}
+
+func (ms *MemoryStorage) Put(owner string, card Card) error {
+	return ms.Update(func(tx Tx) error { return tx.Put(owner, card) })
+}
+
+func (ms *MemoryStorage) Delete(owner string, id int) (Card, bool, error) {
+	var card Card
+	var ok bool
+	err := ms.Update(func(tx Tx) error {
+		var err error
+		card, ok, err = tx.Delete(owner, id)
+		return err
+	})
+	return card, ok, err
 }
 
-func (ds *DeckStore) Remove(user string, card_id int) {
-	d := ds.resolveDeck(user)
-	d.Remove(card_id)
+func (ms *MemoryStorage) PutState(set, key string, value []byte) error {
+	return nil
 }
 
-func (ds *DeckStore) List(user string) []Card {
-	d := ds.resolveDeck(user)
-	return d.List()
+func (ms *MemoryStorage) List(owner string) ([]Card, error) {
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+
+	return memoryTx{ms, nil}.List(owner)
 }
 
-func (deck *Deck) Add(card Card) {
-	deck.mu.Lock()
-	defer deck.mu.Unlock()
+// / Run fn with the storage locked, undoing its writes when it fails
+func (ms *MemoryStorage) Update(fn func(tx Tx) error) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
 
-	deck.cards[card.ID] = card
+	var undo []func()
+	if err := fn(memoryTx{ms, &undo}); err != nil {
+		for i := len(undo) - 1; i >= 0; i-- {
+			undo[i]()
+		}
+		return err
+	}
+	return nil
 }
 
-func (deck *Deck) Remove(card_id int) {
-	deck.mu.Lock()
-	defer deck.mu.Unlock()
+func (ms *MemoryStorage) Version(owner string) (uint64, error) {
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
 
-	delete(deck.cards, card_id)
+	return memoryTx{ms, nil}.Version(owner)
 }
 
-func (deck *Deck) List() []Card {
-	deck.mu.RLock()
-	defer deck.mu.RUnlock()
+func (ms *MemoryStorage) View(fn func(tx Tx) error) error {
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+
+	return fn(memoryTx{ms, nil})
+}
+
+func (ms *MemoryStorage) Owners() ([]string, error) {
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+
+	owners := make([]string, 0, len(ms.users))
+	for user := range ms.users {
+		owners = append(owners, user)
+	}
+	return owners, nil
+}
+
+func (ms *MemoryStorage) Counts() (DeckCounts, error) {
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+
+	counts := DeckCounts{Global: len(ms.global.cards), Users: len(ms.users)}
+	for _, d := range ms.users {
+		counts.UserCards += len(d.cards)
+	}
+	return counts, nil
+}
+
+func (ms *MemoryStorage) Snapshot() (DeckSnapshot, error) {
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+
+	decks := DeckSnapshot{
+		Cards:    map[string][]Card{"": ms.global.List()},
+		Versions: map[string]uint64{"": ms.global.version},
+	}
+	for user, d := range ms.users {
+		decks.Cards[user] = d.List()
+		decks.Versions[user] = d.version
+	}
+	return decks, nil
+}
+
+func (ms *MemoryStorage) Restore(decks DeckSnapshot, state StateSnapshot) error {
+	global := NewDeck()
+	users := make(map[string]*Deck)
+	deck := func(owner string) *Deck {
+		if owner == "" {
+			return global
+		}
+		if _, ok := users[owner]; !ok {
+			users[owner] = NewDeck()
+		}
+		return users[owner]
+	}
+
+	for owner, cards := range decks.Cards {
+		d := deck(owner)
+		for _, card := range cards {
+			d.cards[card.ID] = card
+		}
+	}
+	for owner, version := range decks.Versions {
+		deck(owner).version = version
+	}
+
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	ms.global = global
+	ms.users = users
+	return nil
+}
+
+func (ms *MemoryStorage) State() (StateSnapshot, error) {
+	return StateSnapshot{}, nil
+}
+
+func (ms *MemoryStorage) Close() error {
+	return nil
+}
+
+// / Access to a locked MemoryStorage; writes record how to undo them,
+// / and are not allowed without an undo log (read-only transactions)
+type memoryTx struct {
+	ms   *MemoryStorage
+	undo *[]func()
+}
+
+func (tx memoryTx) Get(owner string, id int) (Card, bool, error) {
+	d := tx.ms.resolveDeck(owner, false)
+	if d == nil {
+		return Card{}, false, nil
+	}
+	card, ok := d.cards[id]
+	return card, ok, nil
+}
+
+func (tx memoryTx) Put(owner string, card Card) error {
+	created := tx.ms.resolveDeck(owner, false) == nil
+	d := tx.ms.resolveDeck(owner, true)
+	previous, existed := d.cards[card.ID]
+	d.cards[card.ID] = card
+	d.version++
+
+	*tx.undo = append(*tx.undo, func() {
+		d.version--
+		switch {
+		case created:
+			delete(tx.ms.users, owner)
+		case existed:
+			d.cards[card.ID] = previous
+		default:
+			delete(d.cards, card.ID)
+		}
+	})
+	return nil
+}
 
+func (tx memoryTx) Delete(owner string, id int) (Card, bool, error) {
+	d := tx.ms.resolveDeck(owner, false)
+	if d == nil {
+		return Card{}, false, nil
+	}
+	card, ok := d.cards[id]
+	if !ok {
+		return Card{}, false, nil
+	}
+	delete(d.cards, id)
+	d.version++
+
+	*tx.undo = append(*tx.undo, func() {
+		d.cards[id] = card
+		d.version--
+	})
+	return card, true, nil
+}
+
+func (tx memoryTx) List(owner string) ([]Card, error) {
+	d := tx.ms.resolveDeck(owner, false)
+	if d == nil {
+		return []Card{}, nil
+	}
+	return d.List(), nil
+}
+
+// / Nothing to keep: the state lives in the node until it stops
+func (tx memoryTx) PutState(set, key string, value []byte) error {
+	return nil
+}
+
+func (tx memoryTx) Version(owner string) (uint64, error) {
+	d := tx.ms.resolveDeck(owner, false)
+	if d == nil {
+		return 0, nil
+	}
+	return d.version, nil
+}
+
+func (deck *Deck) List() []Card {
 	result := make([]Card, 0, len(deck.cards))
 
 	for _, card := range deck.cards {
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+var errVersionMismatch = errors.New("version mismatch")
+
+// / ETag of a deck at version; decks are versioned by the leader, so
+// / every node gives the same ETag to the same deck state
+func etag(version uint64) string {
+	return strconv.Quote(strconv.FormatUint(version, 10))
+}
+
+// / Version required by the If-Match header, nil when there is none or it is *
+func ifMatch(request *http.Request) (*uint64, error) {
+	header := strings.TrimSpace(request.Header.Get("If-Match"))
+	if header == "" || header == "*" {
+		return nil, nil
+	}
+	if strings.Contains(header, ",") {
+		return nil, errors.New("If-Match takes a single ETag")
+	}
+
+	raw, err := strconv.Unquote(header)
+	if err != nil {
+		return nil, fmt.Errorf("If-Match: not an ETag of this service: %s", header)
+	}
+	version, err := strconv.ParseUint(raw, 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("If-Match: not an ETag of this service: %s", header)
+	}
+	return &version, nil
+}
+
+// / Tell a client its copy of the deck is stale, with the current ETag to refresh
+func preconditionFailed(writer http.ResponseWriter, version uint64, err error) {
+	writer.Header().Set("ETag", etag(version))
+	http.Error(writer, err.Error()+", reload the deck", http.StatusPreconditionFailed)
+}
@@ -0,0 +1,254 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// / Event pushed to subscribers when a node applies an operation.
+// /
+// / Every node publishes the operations it applies, replicated ones
+// / included, so clients may subscribe to any node of the cluster.
+type Event struct {
+	Type    string        `json:"type"`
+	User    string        `json:"user"`
+	Card    *Card         `json:"card,omitempty"`
+	TradeID int           `json:"trade_id,omitempty"`
+	Trade   *TradeRequest `json:"trade,omitempty"`
+	Reason  string        `json:"reason,omitempty"`
+	Time    time.Time     `json:"time"`
+}
+
+const (
+	EventCardAdded      = "card_added"
+	EventCardRemoved    = "card_removed"
+	EventTradeProposed  = "trade_proposed"
+	EventTradeAccepted  = "trade_accepted"
+	EventTradeCancelled = "trade_cancelled"
+	EventClaimSucceeded = "claim_succeeded"
+	EventClaimFailed    = "claim_failed"
+)
+
+// Events buffered per subscriber; a subscriber that falls further
+// behind loses events instead of slowing the node down.
+const subscriberBuffer = 64
+
+// / Fan-out of events to the subscribers of each user
+type EventHub struct {
+	mu          sync.Mutex
+	subscribers map[string]map[chan Event]struct{}
+	closed      bool
+}
+
+func NewEventHub() *EventHub {
+	return &EventHub{
+		subscribers: make(map[string]map[chan Event]struct{}),
+	}
+}
+
+// / Subscribe to the events of user.
+// /
+// / The returned function must be called to unsubscribe.
+func (hub *EventHub) Subscribe(user string) (<-chan Event, func()) {
+	events := make(chan Event, subscriberBuffer)
+
+	hub.mu.Lock()
+	if hub.closed {
+		hub.mu.Unlock()
+		close(events)
+		return events, func() {}
+	}
+	if hub.subscribers[user] == nil {
+		hub.subscribers[user] = make(map[chan Event]struct{})
+	}
+	hub.subscribers[user][events] = struct{}{}
+	hub.mu.Unlock()
+
+	unsubscribe := func() {
+		hub.mu.Lock()
+		defer hub.mu.Unlock()
+
+		if _, ok := hub.subscribers[user][events]; !ok {
+			return
+		}
+		delete(hub.subscribers[user], events)
+		if len(hub.subscribers[user]) == 0 {
+			delete(hub.subscribers, user)
+		}
+	}
+	return events, unsubscribe
+}
+
+// / End every stream; later subscriptions are closed right away
+func (hub *EventHub) Close() {
+	hub.mu.Lock()
+	defer hub.mu.Unlock()
+
+	hub.closed = true
+	for _, subscribers := range hub.subscribers {
+		for subscriber := range subscribers {
+			close(subscriber)
+		}
+	}
+	hub.subscribers = make(map[string]map[chan Event]struct{})
+}
+
+// / Deliver event to the subscribers of every given user
+func (hub *EventHub) Publish(event Event, users ...string) {
+	if event.Time.IsZero() {
+		event.Time = time.Now().UTC()
+	}
+
+	hub.mu.Lock()
+	defer hub.mu.Unlock()
+
+	for _, user := range users {
+		for subscriber := range hub.subscribers[user] {
+			select {
+			case subscriber <- event:
+			default:
+			}
+		}
+	}
+}
+
+// / An event and the user it is delivered to
+type delivery struct {
+	event Event
+	user  string
+}
+
+// / Events derived from an applied operation.
+// /
+// / Trade events are delivered to both sides of the trade. moved is the
+// / card a remove or a claim took out, or the card a trade with another
+// / shard moved (zero when it moved nothing).
+func eventsOf(op ReplicateRequest, moved Card) []delivery {
+	switch op.Op {
+	case "add":
+		card := op.Card
+		return []delivery{{Event{Type: EventCardAdded, User: op.User, Card: &card}, op.User}}
+	case "remove":
+		return []delivery{{Event{Type: EventCardRemoved, User: op.User, Card: &moved}, op.User}}
+	case "import":
+		deliveries := make([]delivery, 0, len(op.Entries))
+		for _, entry := range op.Entries {
+			card := Card{ID: entry.ID, Name: entry.Name}
+			deliveries = append(deliveries, delivery{Event{Type: EventCardAdded, User: entry.Owner, Card: &card}, entry.Owner})
+		}
+		return deliveries
+	case "trade_propose", "trade_exchange", "trade_accept", "trade_cancel":
+		types := map[string]string{
+			"trade_propose":  EventTradeProposed,
+			"trade_exchange": EventTradeAccepted,
+			"trade_accept":   EventTradeAccepted,
+			"trade_cancel":   EventTradeCancelled,
+		}
+		if op.Trade == nil {
+			return nil
+		}
+		trade := *op.Trade
+		var deliveries []delivery
+
+		// the swap of a trade within this shard
+		if op.Op == "trade_exchange" {
+			given, received := op.Card, op.Other
+			deliveries = append(deliveries,
+				delivery{Event{Type: EventCardRemoved, User: trade.UserA, Card: &given}, trade.UserA},
+				delivery{Event{Type: EventCardRemoved, User: trade.UserB, Card: &received}, trade.UserB},
+				delivery{Event{Type: EventCardAdded, User: trade.UserA, Card: &received}, trade.UserA},
+				delivery{Event{Type: EventCardAdded, User: trade.UserB, Card: &given}, trade.UserB},
+			)
+		}
+
+		event := Event{Type: types[op.Op], TradeID: op.TradeID, Trade: &trade, Reason: op.Reason}
+		a, b := event, event
+		a.User, b.User = trade.UserA, trade.UserB
+		deliveries = append(deliveries, delivery{a, trade.UserA}, delivery{b, trade.UserB})
+
+		// the escrow of a trade with another shard was settled
+		if moved.ID != 0 {
+			deliveries = append(deliveries, delivery{Event{Type: EventCardAdded, User: trade.UserA, Card: &moved}, trade.UserA})
+		}
+		return deliveries
+	case "trade_escrow":
+		if moved.ID == 0 {
+			return nil
+		}
+		return []delivery{{Event{Type: EventCardRemoved, User: op.User, Card: &moved}, op.User}}
+	case "trade_swap":
+		if moved.ID == 0 || op.Trade == nil {
+			return nil
+		}
+		user, card := op.Trade.UserB, op.Card
+		return []delivery{
+			{Event{Type: EventCardRemoved, User: user, Card: &moved}, user},
+			{Event{Type: EventCardAdded, User: user, Card: &card}, user},
+		}
+	case "relay":
+		return []delivery{{*op.Event, op.Event.User}}
+	case "claim":
+		if op.Reason != "" {
+			return []delivery{{Event{Type: EventClaimFailed, User: op.User, Reason: op.Reason}, op.User}}
+		}
+		card := moved
+		return []delivery{
+			{Event{Type: EventCardRemoved, Card: &moved}, ""},
+			{Event{Type: EventCardAdded, User: op.User, Card: &card}, op.User},
+			{Event{Type: EventClaimSucceeded, User: op.User, Card: &card}, op.User},
+		}
+	}
+	return nil
+}
+
+// Interval between two keep-alive comments on an idle stream.
+const keepAliveInterval = 15 * time.Second
+
+// / Stream the events of a user as Server-Sent Events
+// /
+// / Example:
+// / GET /users/:user/events
+func (node *Node) handleEvents(writer http.ResponseWriter, request *http.Request) {
+	user := getUserFromRequest(request)
+
+	flusher, ok := writer.(http.Flusher)
+	if !ok {
+		http.Error(writer, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	events, unsubscribe := node.events.Subscribe(user)
+	defer unsubscribe()
+
+	writer.Header().Set("Content-Type", "text/event-stream")
+	writer.Header().Set("Cache-Control", "no-cache")
+	writer.Header().Set("Connection", "keep-alive")
+	writer.WriteHeader(http.StatusOK)
+
+	// tells the client it is subscribed before the first event
+	fmt.Fprint(writer, ": subscribed\n\n")
+	flusher.Flush()
+
+	keepAlive := time.NewTicker(keepAliveInterval)
+	defer keepAlive.Stop()
+
+	for {
+		select {
+		case <-request.Context().Done():
+			return
+		case <-keepAlive.C:
+			fmt.Fprint(writer, ": keep-alive\n\n")
+			flusher.Flush()
+		case event, ok := <-events:
+			if !ok {
+				return
+			}
+			data, _ := json.Marshal(event)
+			fmt.Fprintf(writer, "event: %s\ndata: %s\n\n", event.Type, data)
+			flusher.Flush()
+		}
+	}
+}
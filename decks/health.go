@@ -0,0 +1,151 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+	"time"
+)
+
+// / Replication state of a follower, as seen by the leader
+type FollowerStatus struct {
+	ID           PeerID  `json:"id"`
+	Addr         Address `json:"addr"`
+	AppliedIndex uint64  `json:"applied_index"`
+	// Operations the follower is behind the leader
+	Lag uint64 `json:"lag"`
+	// Last replication or heartbeat answered by the follower
+	LastContact time.Time `json:"last_contact,omitzero"`
+}
+
+// / Process is up
+// /
+// / Example:
+// / GET /healthz
+func (node *Node) handleHealthz(writer http.ResponseWriter, request *http.Request) {
+	writer.Header().Set("Content-Type", "text/plain")
+	writer.Write([]byte("ok\n"))
+}
+
+// / Node can serve reads: it is the leader, or a follower synced from
+// / the leader and within the lag bounds. Answers 503 with the reasons
+// / otherwise.
+// /
+// / Example:
+// / GET /readyz
+func (node *Node) handleReadyz(writer http.ResponseWriter, request *http.Request) {
+	status := node.status()
+
+	writer.Header().Set("Content-Type", "application/json")
+	if !status.Ready {
+		writer.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(writer).Encode(status)
+}
+
+// / Why the node is not ready, nothing when it is
+func (node *Node) notReady(status NodeStatus) []string {
+	var reasons []string
+
+	if status.Leaving {
+		reasons = append(reasons, "shutting down")
+	}
+	if status.LeaderID == node.id {
+		return reasons
+	}
+
+	if !status.Synced {
+		reasons = append(reasons, "not synced from the leader")
+	}
+	if node.resyncing.Load() {
+		reasons = append(reasons, "resyncing from the leader")
+	}
+
+	maxLag := time.Duration(node.config.MaxLag)
+	if status.LastHeartbeat.IsZero() {
+		reasons = append(reasons, "never heard from the leader")
+	} else if silence := time.Since(status.LastHeartbeat); silence > maxLag {
+		reasons = append(reasons, fmt.Sprintf("no contact with the leader for %s, over %s", silence.Round(time.Millisecond), maxLag))
+	}
+	if status.Lag > node.config.MaxLagOps {
+		reasons = append(reasons, fmt.Sprintf("%d operations behind the leader, over %d", status.Lag, node.config.MaxLagOps))
+	}
+	return reasons
+}
+
+// / Replication state of every follower, by ID. Only meaningful on the leader.
+func (node *Node) replicationStatus() []FollowerStatus {
+	applied := node.applied.Load()
+
+	statuses := make([]FollowerStatus, 0, len(node.followers))
+	for _, f := range node.followers {
+		status := FollowerStatus{
+			ID:           f.id,
+			Addr:         f.address,
+			AppliedIndex: f.acked.Load(),
+		}
+		if status.AppliedIndex < applied {
+			status.Lag = applied - status.AppliedIndex
+		}
+		if contact := f.contact.Load(); contact != 0 {
+			status.LastContact = time.Unix(0, contact)
+		}
+		statuses = append(statuses, status)
+	}
+
+	slices.SortFunc(statuses, func(a, b FollowerStatus) int { return a.ID - b.ID })
+	return statuses
+}
+
+// / Record what a heartbeat told about a peer.
+// /
+// / A follower learns how far the leader is; the leader learns how far
+// / each follower is, including the idle ones it has nothing to send.
+func (node *Node) heard(status NodeStatus, leaderID PeerID) {
+	now := time.Now().UnixNano()
+
+	switch {
+	case status.NodeID == leaderID:
+		node.heartbeat.Store(now)
+		node.leaderIndex.Store(status.AppliedIndex)
+	case leaderID == node.id:
+		if f, ok := node.followers[status.NodeID]; ok {
+			f.acked.Store(status.AppliedIndex)
+			f.contact.Store(now)
+		}
+	}
+}
+
+// / Pick the leader of a new term among the reachable nodes.
+// /
+// / Only nodes synced from the previous leader, and at most MaxLagOps
+// / behind the most up-to-date one, can be elected; the highest ID
+// / wins among them (bully algorithm). Without such a node, any node
+// / that is not leaving is elected.
+func (node *Node) candidate(statuses map[PeerID]NodeStatus) PeerID {
+	var newest uint64
+	for _, status := range statuses {
+		if status.Synced && !status.Leaving {
+			newest = max(newest, status.AppliedIndex)
+		}
+	}
+
+	highestID := -1
+	for id, status := range statuses {
+		upToDate := status.Synced && status.AppliedIndex+node.config.MaxLagOps >= newest
+		if !status.Leaving && upToDate && id > highestID {
+			highestID = id
+		}
+	}
+	if highestID != -1 {
+		return highestID
+	}
+
+	for id, status := range statuses {
+		if !status.Leaving && id > highestID {
+			highestID = id
+		}
+	}
+	return highestID
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"log/slog"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// / Header carrying the correlation ID of a request.
+// /
+// / It is created at the edge (or taken from the client) and copied
+// / into every request the node makes on its behalf: forwards to the
+// / leader, claim sub-requests and replication.
+const RequestIDHeader = "X-Request-ID"
+
+type requestIDKey struct{}
+
+func newRequestID() string {
+	b := make([]byte, 8)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func withRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDKey{}, id)
+}
+
+// / Request ID carried by ctx, empty if there is none
+func requestIDFrom(ctx context.Context) string {
+	if ctx == nil {
+		return ""
+	}
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// / Copy the request ID of ctx into an outgoing request
+func propagateRequestID(ctx context.Context, request *http.Request) {
+	if id := requestIDFrom(ctx); id != "" {
+		request.Header.Set(RequestIDHeader, id)
+	}
+}
+
+// / JSON logger shared by the node.
+// /
+// / It also becomes the default slog logger, so lines written through the
+// / standard log package come out as JSON as well.
+func newLogger(id PeerID) *slog.Logger {
+	logger := slog.New(slog.NewJSONHandler(os.Stderr, nil)).With("node", id)
+	slog.SetDefault(logger)
+	return logger
+}
+
+// / Logger annotated with the request ID of ctx, when there is one
+func (node *Node) log(ctx context.Context) *slog.Logger {
+	if id := requestIDFrom(ctx); id != "" {
+		return node.logger.With("request_id", id)
+	}
+	return node.logger
+}
+
+// / Gin middleware assigning a request ID to every request.
+// /
+// / The ID is echoed back to the client and stored both in the request
+// / context and in its headers, so proxies reuse it unchanged.
+func (node *Node) requestID() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id := c.GetHeader(RequestIDHeader)
+		if id == "" {
+			id = newRequestID()
+		}
+
+		c.Request.Header.Set(RequestIDHeader, id)
+		c.Request = c.Request.WithContext(withRequestID(c.Request.Context(), id))
+		c.Header(RequestIDHeader, id)
+
+		c.Next()
+	}
+}
+
+// / Gin middleware writing one JSON access log line per request
+func (node *Node) accessLog() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start := time.Now()
+		c.Next()
+
+		node.log(c.Request.Context()).Info("request",
+			"method", c.Request.Method,
+			"path", c.Request.URL.Path,
+			"status", c.Writer.Status(),
+			"duration_ms", float64(time.Since(start).Microseconds())/1000,
+			"client", c.ClientIP(),
+		)
+	}
+}
@@ -1,28 +1,60 @@
 package main
 
 import (
-	"log"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	"github.com/gin-gonic/gin"
 )
 
 func main() {
-	router := gin.Default()
+	router := gin.New()
+	router.Use(gin.Recovery())
 	address, node := NodeFromCLI()
 
 	node.StartLeaderLoop()
 	node.AddRoutes(router)
 
 	if err := node.SyncFromLeader(); err != nil {
-		log.Printf("warning: could not sync from leader on startup: %v", err)
+		node.logger.Warn("could not sync from leader on startup", "error", err)
 	}
 
-	log.Printf("Node%d@%s: Leader%d@%s, peers=[%v]",
-		node.id,
-		address,
-		node.leaderID,
-		node.leaderAddr,
-		node.peers,
+	node.logger.Info(
+		fmt.Sprintf("Node%d@%s: Leader%d@%s", node.id, address, node.leaderID, node.leaderAddr),
+		"peers", node.peers,
 	)
-	router.Run(address)
+
+	stopped, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stop()
+
+	server := &http.Server{Addr: address, Handler: router}
+	go func() {
+		if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			node.logger.Error("server failed", "error", err)
+			os.Exit(1)
+		}
+	}()
+
+	<-stopped.Done()
+	stop()
+	node.logger.Info("shutdown: signal received")
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(node.config.ShutdownTimeout))
+	defer cancel()
+
+	// hand leadership over while still serving, so held writes can be forwarded
+	node.Shutdown(ctx)
+	if err := server.Shutdown(ctx); err != nil {
+		node.logger.Warn("shutdown: requests still running", "error", err)
+	}
+	if err := node.store.Close(); err != nil {
+		node.logger.Warn("shutdown: failed to close the storage", "error", err)
+	}
+	node.logger.Info("shutdown: done")
 }
@@ -0,0 +1,457 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// / In-process metrics registry
+// /
+// / This is a tiny subset of Prometheus: counters, histograms and
+// / gauges computed on scrape, all exposed in the text format at /metrics.
+type Metrics struct {
+	mu         sync.Mutex
+	counters   []*CounterVec
+	histograms []*HistogramVec
+	gauges     []*GaugeFunc
+}
+
+// / Counters by label values
+type CounterVec struct {
+	name   string
+	help   string
+	labels []string
+
+	mu     sync.Mutex
+	values map[string]float64
+}
+
+// / Histograms by label values, sharing the same buckets
+type HistogramVec struct {
+	name    string
+	help    string
+	labels  []string
+	buckets []float64
+
+	mu     sync.Mutex
+	series map[string]*histogram
+}
+
+type histogram struct {
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+// / Gauge whose samples are computed when scraped
+type GaugeFunc struct {
+	name    string
+	help    string
+	labels  []string
+	collect func() []Sample
+}
+
+type Sample struct {
+	Labels []string
+	Value  float64
+}
+
+// Default latency buckets, in seconds.
+var defaultBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+func NewMetrics() *Metrics {
+	return &Metrics{}
+}
+
+func (metrics *Metrics) Counter(name, help string, labels ...string) *CounterVec {
+	counter := &CounterVec{
+		name:   name,
+		help:   help,
+		labels: labels,
+		values: make(map[string]float64),
+	}
+
+	metrics.mu.Lock()
+	metrics.counters = append(metrics.counters, counter)
+	metrics.mu.Unlock()
+	return counter
+}
+
+func (metrics *Metrics) Histogram(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	hist := &HistogramVec{
+		name:    name,
+		help:    help,
+		labels:  labels,
+		buckets: buckets,
+		series:  make(map[string]*histogram),
+	}
+
+	metrics.mu.Lock()
+	metrics.histograms = append(metrics.histograms, hist)
+	metrics.mu.Unlock()
+	return hist
+}
+
+func (metrics *Metrics) Gauge(name, help string, collect func() []Sample, labels ...string) {
+	metrics.mu.Lock()
+	defer metrics.mu.Unlock()
+
+	metrics.gauges = append(metrics.gauges, &GaugeFunc{
+		name:    name,
+		help:    help,
+		labels:  labels,
+		collect: collect,
+	})
+}
+
+// Label values are joined into a single map key. The separator is not
+// valid UTF-8, so it never shows up inside a well-formed label value.
+const labelSeparator = "\xff"
+
+func (counter *CounterVec) Inc(values ...string) {
+	counter.Add(1, values...)
+}
+
+func (counter *CounterVec) Add(delta float64, values ...string) {
+	key := strings.Join(values, labelSeparator)
+
+	counter.mu.Lock()
+	counter.values[key] += delta
+	counter.mu.Unlock()
+}
+
+func (hist *HistogramVec) Observe(value float64, values ...string) {
+	key := strings.Join(values, labelSeparator)
+
+	hist.mu.Lock()
+	defer hist.mu.Unlock()
+
+	series, ok := hist.series[key]
+	if !ok {
+		series = &histogram{counts: make([]uint64, len(hist.buckets))}
+		hist.series[key] = series
+	}
+
+	for i, bound := range hist.buckets {
+		if value <= bound {
+			series.counts[i]++
+		}
+	}
+	series.count++
+	series.sum += value
+}
+
+// / Observe the seconds elapsed since start
+func (hist *HistogramVec) Since(start time.Time, values ...string) {
+	hist.Observe(time.Since(start).Seconds(), values...)
+}
+
+// / Write every metric in the Prometheus text exposition format (0.0.4)
+func (metrics *Metrics) Expose(writer io.Writer) {
+	metrics.mu.Lock()
+	counters := append([]*CounterVec(nil), metrics.counters...)
+	histograms := append([]*HistogramVec(nil), metrics.histograms...)
+	gauges := append([]*GaugeFunc(nil), metrics.gauges...)
+	metrics.mu.Unlock()
+
+	for _, counter := range counters {
+		fmt.Fprintf(writer, "# HELP %s %s\n# TYPE %s counter\n", counter.name, counter.help, counter.name)
+
+		counter.mu.Lock()
+		for _, key := range sortedKeys(counter.values) {
+			fmt.Fprintf(writer, "%s%s %s\n",
+				counter.name,
+				formatLabels(counter.labels, splitKey(key), "", ""),
+				formatValue(counter.values[key]),
+			)
+		}
+		counter.mu.Unlock()
+	}
+
+	for _, hist := range histograms {
+		fmt.Fprintf(writer, "# HELP %s %s\n# TYPE %s histogram\n", hist.name, hist.help, hist.name)
+
+		hist.mu.Lock()
+		for _, key := range sortedKeys(hist.series) {
+			series := hist.series[key]
+			values := splitKey(key)
+
+			for i, bound := range hist.buckets {
+				fmt.Fprintf(writer, "%s_bucket%s %d\n",
+					hist.name,
+					formatLabels(hist.labels, values, "le", formatValue(bound)),
+					series.counts[i],
+				)
+			}
+			fmt.Fprintf(writer, "%s_bucket%s %d\n", hist.name, formatLabels(hist.labels, values, "le", "+Inf"), series.count)
+			fmt.Fprintf(writer, "%s_sum%s %s\n", hist.name, formatLabels(hist.labels, values, "", ""), formatValue(series.sum))
+			fmt.Fprintf(writer, "%s_count%s %d\n", hist.name, formatLabels(hist.labels, values, "", ""), series.count)
+		}
+		hist.mu.Unlock()
+	}
+
+	for _, gauge := range gauges {
+		fmt.Fprintf(writer, "# HELP %s %s\n# TYPE %s gauge\n", gauge.name, gauge.help, gauge.name)
+
+		for _, sample := range gauge.collect() {
+			fmt.Fprintf(writer, "%s%s %s\n",
+				gauge.name,
+				formatLabels(gauge.labels, sample.Labels, "", ""),
+				formatValue(sample.Value),
+			)
+		}
+	}
+}
+
+func (metrics *Metrics) handleMetrics(writer http.ResponseWriter, request *http.Request) {
+	writer.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	metrics.Expose(writer)
+}
+
+// / Gin middleware observing the latency of every handler.
+// /
+// / The route pattern is used as label instead of the raw path,
+// / so /users/alice/cards and /users/bob/cards share a series.
+func (metrics *Metrics) instrument(latency *HistogramVec) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start := time.Now()
+		c.Next()
+
+		route := c.FullPath()
+		if route == "" {
+			route = "unmatched"
+		}
+		latency.Since(start, c.Request.Method, route, strconv.Itoa(c.Writer.Status()))
+	}
+}
+
+func sortedKeys[V any](values map[string]V) []string {
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func splitKey(key string) []string {
+	if key == "" {
+		return nil
+	}
+	return strings.Split(key, labelSeparator)
+}
+
+func formatLabels(names []string, values []string, extraName string, extraValue string) string {
+	pairs := make([]string, 0, len(names)+1)
+	for i, name := range names {
+		value := ""
+		if i < len(values) {
+			value = values[i]
+		}
+		pairs = append(pairs, name+"="+escapeLabel(value))
+	}
+	if extraName != "" {
+		pairs = append(pairs, extraName+"="+escapeLabel(extraValue))
+	}
+
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func escapeLabel(value string) string {
+	value = strings.ReplaceAll(value, `\`, `\\`)
+	value = strings.ReplaceAll(value, "\n", `\n`)
+	value = strings.ReplaceAll(value, `"`, `\"`)
+	return `"` + value + `"`
+}
+
+func formatValue(value float64) string {
+	switch {
+	case math.IsInf(value, 1):
+		return "+Inf"
+	case math.IsInf(value, -1):
+		return "-Inf"
+	default:
+		return strconv.FormatFloat(value, 'g', -1, 64)
+	}
+}
+
+// / Metrics exposed by a decks node
+type NodeMetrics struct {
+	registry *Metrics
+
+	requestLatency   *HistogramVec
+	replicateTotal   *CounterVec
+	replicateLatency *HistogramVec
+	leaderChanges    *CounterVec
+	forwardFailures  *CounterVec
+	claims           *CounterVec
+
+	webhookDeliveries *CounterVec
+	rateLimited       *CounterVec
+	shardForwards     *CounterVec
+}
+
+func newNodeMetrics(node *Node) *NodeMetrics {
+	registry := NewMetrics()
+
+	metrics := &NodeMetrics{
+		registry: registry,
+		requestLatency: registry.Histogram(
+			"decks_http_request_duration_seconds",
+			"Latency of HTTP handlers by method, route and status code.",
+			defaultBuckets, "method", "route", "status",
+		),
+		replicateTotal: registry.Counter(
+			"decks_replicate_total",
+			"Replication requests sent to followers by peer and result.",
+			"peer", "result",
+		),
+		replicateLatency: registry.Histogram(
+			"decks_replicate_duration_seconds",
+			"Round-trip time of replication requests by peer.",
+			defaultBuckets, "peer",
+		),
+		leaderChanges: registry.Counter(
+			"decks_leader_changes_total",
+			"Times this node saw the elected leader change.",
+		),
+		forwardFailures: registry.Counter(
+			"decks_forward_failures_total",
+			"Requests that could not be forwarded to the leader.",
+		),
+		claims: registry.Counter(
+			"decks_claims_total",
+			"Card claims handled by the leader by result.",
+			"result",
+		),
+		webhookDeliveries: registry.Counter(
+			"decks_webhook_deliveries_total",
+			"Webhook delivery attempts by the leader by result: success, retry or dead.",
+			"result",
+		),
+		rateLimited: registry.Counter(
+			"decks_rate_limited_total",
+			"Requests rejected with 429 by endpoint, or cooldown for claim cooldowns.",
+			"endpoint",
+		),
+		shardForwards: registry.Counter(
+			"decks_shard_forwards_total",
+			"Requests routed to the leader of another shard by shard and result.",
+			"shard", "result",
+		),
+	}
+
+	// unlabeled counters are exported as zero before their first event
+	metrics.leaderChanges.Add(0)
+	metrics.forwardFailures.Add(0)
+
+	registry.Gauge(
+		"decks_cards",
+		"Cards held in the global deck and in every user deck together.",
+		func() []Sample {
+			counts, err := node.store.Counts()
+			if err != nil {
+				return nil
+			}
+			return []Sample{
+				{Labels: []string{"global"}, Value: float64(counts.Global)},
+				{Labels: []string{"users"}, Value: float64(counts.UserCards)},
+			}
+		},
+		"deck",
+	)
+
+	registry.Gauge(
+		"decks_deck_owners",
+		"Users holding a deck.",
+		func() []Sample {
+			counts, err := node.store.Counts()
+			if err != nil {
+				return nil
+			}
+			return []Sample{{Value: float64(counts.Users)}}
+		},
+	)
+
+	registry.Gauge(
+		"decks_pending_trades",
+		"Trades proposed and not accepted yet.",
+		func() []Sample {
+			node.mu.RLock()
+			defer node.mu.RUnlock()
+			return []Sample{{Value: float64(len(node.trades))}}
+		},
+	)
+
+	registry.Gauge(
+		"decks_trade_escrows",
+		"Cards held while a trade with another shard settles.",
+		func() []Sample {
+			node.mu.RLock()
+			defer node.mu.RUnlock()
+			return []Sample{{Value: float64(len(node.escrows))}}
+		},
+	)
+
+	registry.Gauge(
+		"decks_leader",
+		"ID of the leader known by this node.",
+		func() []Sample {
+			node.mu.RLock()
+			defer node.mu.RUnlock()
+			return []Sample{{Value: float64(node.leaderID)}}
+		},
+	)
+
+	registry.Gauge(
+		"decks_is_leader",
+		"1 if this node is the leader, 0 otherwise.",
+		func() []Sample {
+			if node.isLeader() {
+				return []Sample{{Value: 1}}
+			}
+			return []Sample{{Value: 0}}
+		},
+	)
+
+	registry.Gauge(
+		"decks_ready",
+		"1 if this node is ready, see /readyz, 0 otherwise.",
+		func() []Sample {
+			if node.status().Ready {
+				return []Sample{{Value: 1}}
+			}
+			return []Sample{{Value: 0}}
+		},
+	)
+
+	registry.Gauge(
+		"decks_replication_lag",
+		"Operations each follower is behind the leader, by peer. Exported by the leader.",
+		func() []Sample {
+			if !node.isLeader() {
+				return nil
+			}
+			var samples []Sample
+			for _, f := range node.replicationStatus() {
+				samples = append(samples, Sample{Labels: []string{strconv.Itoa(f.ID)}, Value: float64(f.Lag)})
+			}
+			return samples
+		},
+		"peer",
+	)
+
+	return metrics
+}
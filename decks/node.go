@@ -2,14 +2,19 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
+	"maps"
 	"net/http"
+	"slices"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -18,6 +23,33 @@ type ReplicateRequest struct {
 	Op   string `json:"op"`
 	Card Card   `json:"card"`
 	User string `json:"user,omitempty"`
+
+	// Position in the leader's log, see commit
+	Term  uint64 `json:"term"`
+	Index uint64 `json:"index"`
+
+	// Trade operations: trade_propose, trade_exchange, trade_accept and trade_cancel,
+	// and trade_escrow, trade_swap and trade_forget for trades across shards
+	TradeID int           `json:"trade_id,omitempty"`
+	Trade   *TradeRequest `json:"trade,omitempty"`
+	// Card of user_b swapped for Card by trade_exchange
+	Other Card `json:"other,omitzero"`
+
+	// Why a claim or a trade failed
+	Reason string `json:"reason,omitempty"`
+
+	// Webhook operations: webhook_add, webhook_remove and webhook_dead
+	Webhook    *Webhook    `json:"webhook,omitempty"`
+	DeadLetter *DeadLetter `json:"dead_letter,omitempty"`
+
+	// Cards of a bulk import, applied at once
+	Entries []DeckEntry `json:"entries,omitempty"`
+
+	// Claim cooldown started by the leader
+	Limit *LimitState `json:"limit,omitempty"`
+
+	// Event of a user of this shard raised by another shard: relay
+	Event *Event `json:"event,omitempty"`
 }
 
 // TradeRequest describes a swap between two users' cards.
@@ -38,11 +70,47 @@ type Node struct {
 	peers       Peers
 	leaderID    PeerID
 	leaderAddr  Address
-	deck        *DeckStore
+	store       Storage
 	client      *http.Client
+	transport   Transport
 	mu          sync.RWMutex
 	trades      map[int]*TradeRequest
 	nextTradeID int
+	config      Config
+	metrics     *NodeMetrics
+	logger      *slog.Logger
+	events      *EventHub
+	webhooks    *WebhookStore
+	limits      *RateLimiter
+
+	// term of the current leader, guarded by mu
+	term uint64
+
+	// replication log, see commit and applyReplicate
+	applyMu     sync.Mutex
+	applied     atomic.Uint64
+	appliedTerm uint64
+	resyncing   atomic.Bool
+	followers   map[PeerID]*follower
+
+	// replication health, see notReady
+	synced      atomic.Bool
+	heartbeat   atomic.Int64
+	leaderIndex atomic.Uint64
+	snapshotAt  atomic.Int64
+
+	writes  WriteGate
+	leaving atomic.Bool
+	claimMu sync.Mutex
+
+	// placement of users over the shards, nil when there is one group
+	ring   *Ring
+	router *shardRouter
+	// trades with other shards, guarded by mu, see acceptAcrossShards
+	escrows     map[int]Escrow
+	swaps       map[int]SwapResult
+	settling    sync.Map
+	settlingAll atomic.Bool
 }
 
 // / Representation of the Leader state
@@ -51,22 +119,60 @@ type Snapshot struct {
 	Users       map[string][]Card    `json:"users"`
 	Trades      map[int]TradeRequest `json:"trades"`
 	NextTradeID int                  `json:"next_trade_id"`
+
+	// Version of every deck, the global one under ""
+	Versions map[string]uint64 `json:"versions"`
+
+	// Trades with other shards: cards held here, and swaps made for them
+	Escrows map[int]Escrow     `json:"escrows"`
+	Swaps   map[int]SwapResult `json:"swaps"`
+
+	Webhooks      []Webhook    `json:"webhooks"`
+	NextWebhookID int          `json:"next_webhook_id"`
+	DeadLetters   []DeadLetter `json:"dead_letters"`
+
+	Limits map[string]time.Time `json:"limits"`
+
+	// Last operation included in the snapshot
+	Term  uint64 `json:"term"`
+	Index uint64 `json:"index"`
 }
 
-func NewNode(id PeerID, addr Address, peers Peers) *Node {
+// / A node on store, with the state it kept from its last run.
+// /
+// / The state is read before the first election, so the node takes part
+// / in it at the term it had reached.
+func NewNode(config Config, store Storage) (*Node, error) {
 	node := &Node{
-		id:    id,
-		addr:  addr,
-		peers: peers,
-		deck:  NewDeckStore(),
+		id:    config.ID,
+		addr:  config.Address,
+		peers: config.Peers,
+		store: store,
 		client: &http.Client{
-			Timeout: 5 * time.Second,
+			Timeout: time.Duration(config.ClientTimeout),
 		},
-		trades: make(map[int]*TradeRequest),
+		trades:   make(map[int]*TradeRequest),
+		escrows:  make(map[int]Escrow),
+		swaps:    make(map[int]SwapResult),
+		config:   config,
+		logger:   newLogger(config.ID),
+		events:   NewEventHub(),
+		webhooks: NewWebhookStore(),
+		limits:   NewRateLimiter(),
+	}
+	node.transport = newTransport(config.Transport, node.client)
+	if len(config.Shards) > 0 {
+		node.ring = NewRing(slices.Collect(maps.Keys(config.Shards)))
+		node.router = newShardRouter(config.Shards)
 	}
 
+	node.metrics = newNodeMetrics(node)
+	node.startReplication()
+	if err := node.loadState(); err != nil {
+		return nil, err
+	}
 	node.electLeader()
-	return node
+	return node, nil
 }
 
 func (node *Node) isLeader() bool {
@@ -76,85 +182,134 @@ func (node *Node) isLeader() bool {
 	return node.leaderID == node.id
 }
 
-// / Elect a leader via bully algorithm.
+// / Elect a leader.
 // /
-// / The highest available ID is the leader.
+// / The leader of the most recent term is kept while it is reachable,
+// / so a handed over leadership sticks. Without one, a new term starts
+// / and the highest available ID is the leader (bully algorithm).
 func (node *Node) electLeader() {
-	// choose the highest *reachable* ID (bully algorithm variant)
-	isAvailable := func(id PeerID, address Address) bool {
-		// self is always considered available
-		if id == node.id {
-			return true
+	// status of every reachable node, self included
+	statuses := map[PeerID]NodeStatus{node.id: node.status()}
+	for peerID, peerAddress := range node.peers {
+		if peerID == node.id {
+			continue
 		}
 
-		url := strings.TrimRight(address, "/") + "/status"
-		resp, err := node.client.Get(url)
-		if err != nil {
-			return false
+		ctx, cancel := context.WithTimeout(context.Background(), node.client.Timeout)
+		status, err := node.transport.Status(ctx, peerAddress)
+		cancel()
+		if err == nil {
+			statuses[peerID] = status
 		}
-		io.Copy(io.Discard, resp.Body)
-		resp.Body.Close()
-		return resp.StatusCode == http.StatusOK
 	}
 
-	highestID := -1
-	highestAddress := ""
-
-	// consider self
-	if isAvailable(node.id, node.addr) {
-		highestID = node.id
-		highestAddress = node.addr
+	var term uint64
+	for _, status := range statuses {
+		term = max(term, status.Term)
 	}
 
-	for peer_id, peer_address := range node.peers {
-		if !isAvailable(peer_id, peer_address) {
-			continue
+	// the reachable leader of the last term, the highest one if nodes disagree
+	highestID := -1
+	for _, status := range statuses {
+		leader, reachable := statuses[status.LeaderID]
+		if reachable && !leader.Leaving && status.Term == term && status.LeaderID > highestID {
+			highestID = status.LeaderID
 		}
+	}
 
-		if peer_id > highestID {
-			highestID = peer_id
-			highestAddress = peer_address
-		}
+	if highestID == -1 {
+		term++
+		highestID = node.candidate(statuses)
 	}
 
 	// fallback to self if nothing reachable (shouldn't normally happen)
 	if highestID == -1 {
 		highestID = node.id
-		highestAddress = node.addr
 	}
+	highestAddress := node.peers[highestID]
 
 	node.mu.Lock()
+	previousID := node.leaderID
+	node.term = max(node.term, term)
 	node.leaderID = highestID
 	node.leaderAddr = highestAddress
 	node.mu.Unlock()
+
+	for id, status := range statuses {
+		if id != node.id {
+			node.heard(status, highestID)
+		}
+	}
+
+	// a former leader may hold writes the new one never saw
+	if previousID == node.id && highestID != node.id {
+		node.synced.Store(false)
+	}
+
+	if previousID != 0 && previousID != highestID {
+		node.metrics.leaderChanges.Inc()
+		node.logger.Info("election: leader changed", "from", previousID, "to", highestID, "term", term)
+	}
 }
 
 func (node *Node) StartLeaderLoop() {
-	ticker := time.NewTicker(3 * time.Second)
+	ticker := time.NewTicker(time.Duration(node.config.ElectionInterval))
 	go func() {
 		for range ticker.C {
+			if node.leaving.Load() {
+				ticker.Stop()
+				return
+			}
 			node.electLeader()
+
+			// a follower that could not sync yet keeps trying
+			if !node.isLeader() && !node.synced.Load() {
+				go node.resync()
+			}
+			if node.isLeader() {
+				go node.settleEscrows()
+			}
 		}
 	}()
 }
 
 // / Return the state of the current node for recovery or replication.
+// /
+// / Anyone can read it, so webhook secrets are left out: peers only learn
+// / them from webhook_add.
 func (node *Node) handleSnapshot(writer http.ResponseWriter, request *http.Request) {
-	// build snapshot from the in-memory DeckStore
-	node.mu.RLock()
-	ds := node.deck
-	node.mu.RUnlock()
+	snap, err := node.buildSnapshot()
+	if err != nil {
+		node.log(request.Context()).Error("snapshot: failed to read the decks", "error", err)
+		http.Error(writer, "failed to read the decks", http.StatusInternalServerError)
+		return
+	}
+	snap.Webhooks = withoutSecrets(snap.Webhooks)
+
+	writer.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(writer).Encode(snap)
+}
 
-	ds.mu.RLock()
-	defer ds.mu.RUnlock()
+// / Copy the current state of the node
+func (node *Node) buildSnapshot() (Snapshot, error) {
+	// no operation is applied while copying
+	node.applyMu.Lock()
+	defer node.applyMu.Unlock()
 
-	snap := Snapshot{
-		Global: ds.global.List(),
-		Users:  make(map[string][]Card),
+	decks, err := node.store.Snapshot()
+	if err != nil {
+		return Snapshot{}, err
 	}
 
-	for u, d := range ds.users {
-		snap.Users[u] = d.List()
+	snap := Snapshot{
+		Global:   decks.Cards[""],
+		Users:    make(map[string][]Card),
+		Versions: decks.Versions,
+	}
+	for u, cards := range decks.Cards {
+		if u != "" {
+			snap.Users[u] = cards
+		}
 	}
 
 	// copy pending trades and nextTradeID under node lock
@@ -167,10 +322,15 @@ func (node *Node) handleSnapshot(writer http.ResponseWriter, request *http.Reque
 		snap.Trades[id] = *tr
 	}
 	snap.NextTradeID = node.nextTradeID
+	snap.Escrows = maps.Clone(node.escrows)
+	snap.Swaps = maps.Clone(node.swaps)
 	node.mu.RUnlock()
 
-	writer.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(writer).Encode(snap)
+	node.webhooks.snapshot(&snap)
+	node.limits.snapshot(&snap)
+	snap.Term = node.appliedTerm
+	snap.Index = node.applied.Load()
+	return snap, nil
 }
 
 // SyncFromLeader attempts to fetch the leader snapshot and replace local state.
@@ -183,42 +343,61 @@ func (node *Node) SyncFromLeader() error {
 	node.mu.RUnlock()
 
 	if leader == "" || leader == selfAddr {
+		node.synced.Store(true)
 		return nil
 	}
 
-	url := strings.TrimRight(leader, "/") + "/snapshot"
-	resp, err := node.client.Get(url)
+	ctx, cancel := context.WithTimeout(context.Background(), node.client.Timeout)
+	defer cancel()
+
+	snap, err := node.transport.Snapshot(ctx, leader)
 	if err != nil {
-		log.Printf("sync: failed to GET snapshot from leader %s: %v", leader, err)
+		node.logger.Warn("sync: failed to fetch snapshot", "leader", leader, "error", err)
 		return err
 	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode != http.StatusOK {
-		body, _ := io.ReadAll(resp.Body)
-		log.Printf("sync: leader %s returned non-200: %s", leader, string(body))
-		return fmt.Errorf("non-200 from leader: %d", resp.StatusCode)
-	}
 
-	var snap Snapshot
-	if err := json.NewDecoder(resp.Body).Decode(&snap); err != nil {
-		log.Printf("sync: failed to decode snapshot from leader %s: %v", leader, err)
+	if err := node.restoreSnapshot(snap); err != nil {
+		node.logger.Error("sync: failed to store the snapshot", "leader", leader, "error", err)
 		return err
 	}
+	node.synced.Store(true)
+	node.heartbeat.Store(time.Now().UnixNano())
+	node.leaderIndex.Store(snap.Index)
+	node.logger.Info("sync: synced state from leader", "leader", leader, "global", len(snap.Global), "users", len(snap.Users))
+	return nil
+}
 
-	// build a new DeckStore populated from snapshot
-	newStore := NewDeckStore()
-	for _, c := range snap.Global {
-		newStore.Add("", c)
+// / Replace the local state by the content of snap
+func (node *Node) restoreSnapshot(snap Snapshot) error {
+	node.applyMu.Lock()
+	defer node.applyMu.Unlock()
+
+	decks := DeckSnapshot{
+		Cards:    map[string][]Card{"": snap.Global},
+		Versions: snap.Versions,
 	}
 	for u, cards := range snap.Users {
-		for _, c := range cards {
-			newStore.Add(u, c)
-		}
+		decks.Cards[u] = cards
+	}
+	// secrets never come with a snapshot; keep those known here
+	snap.Webhooks = node.webhooks.withKnownSecrets(snap.Webhooks)
+	state, err := encodeState(snap)
+	if err != nil {
+		return err
+	}
+	if err := node.store.Restore(decks, state); err != nil {
+		return err
 	}
 
+	node.restoreState(snap)
+	node.snapshotAt.Store(time.Now().UnixNano())
+	return nil
+}
+
+// / Replace the state besides the decks by the content of snap.
+// / Called with applyMu held.
+func (node *Node) restoreState(snap Snapshot) {
 	node.mu.Lock()
-	node.deck = newStore
 
 	// restore trades
 	node.trades = make(map[int]*TradeRequest)
@@ -227,47 +406,21 @@ func (node *Node) SyncFromLeader() error {
 		node.trades[id] = &t
 	}
 	node.nextTradeID = snap.NextTradeID
+	node.escrows = make(map[int]Escrow)
+	maps.Copy(node.escrows, snap.Escrows)
+	node.swaps = make(map[int]SwapResult)
+	maps.Copy(node.swaps, snap.Swaps)
+	// the term never goes back, or the next commit would be older than
+	// the operations already applied
+	node.term = max(node.term, snap.Term)
 
 	node.mu.Unlock()
 
-	log.Printf("sync: successfully synced state from leader %s (global=%d users=%d)", leader, len(snap.Global), len(snap.Users))
-	return nil
-}
-
-// / Send commands to other peers to replace the same behavior.
-func (node *Node) replicateToFollowers(request ReplicateRequest) {
-	data, _ := json.Marshal(request)
+	node.webhooks.restore(snap)
+	node.limits.restore(snap)
 
-	for peerID, peerAddress := range node.peers {
-		if peerID == node.id {
-			continue
-		}
-
-		go func(address string, id int) {
-			url := strings.TrimRight(address, "/") + "/replicate"
-			httpRequest, err := http.NewRequest("POST", url, bytes.NewReader(data))
-
-			if err != nil {
-				log.Printf("replicate: create request to %s: %v", address, err)
-				return
-			}
-
-			httpRequest.Header.Set("Content-Type", "application/json")
-
-			response, err := node.client.Do(httpRequest)
-			if err != nil {
-				log.Printf("replicate: POST %s failed: %v", url, err)
-				return
-			}
-
-			io.Copy(io.Discard, response.Body)
-			response.Body.Close()
-
-			if response.StatusCode >= 300 {
-				log.Printf("replicate: non-2xx from %s: %s", url, response.Status)
-			}
-		}(peerAddress, peerID)
-	}
+	node.appliedTerm = snap.Term
+	node.applied.Store(snap.Index)
 }
 
 // / Forward incoming requests to the leader and proxy the response
@@ -281,12 +434,14 @@ func (node *Node) forwardToLeader(
 	node.mu.RUnlock()
 
 	if leader == "" {
+		node.metrics.forwardFailures.Inc()
 		http.Error(writer, "no leader known", http.StatusServiceUnavailable)
 		return
 	}
 
 	// build URL to leader
-	destinationURL := strings.TrimRight(leader, "/") + request.URL.Path
+	destinationURL := strings.TrimRight(leader, "/") + request.URL.RequestURI()
+	node.log(request.Context()).Info("forward: proxying to leader", "leader", leader, "method", request.Method, "path", request.URL.Path)
 
 	// read body
 	var bodyBytes []byte
@@ -302,10 +457,13 @@ func (node *Node) forwardToLeader(
 	}
 
 	req.Header = request.Header.Clone()
+	propagateRequestID(request.Context(), req)
 	resp, err := node.client.Do(req)
 	if err != nil {
+		node.metrics.forwardFailures.Inc()
+
 		// leader failed to respond — trigger immediate re-election and retry once
-		newLeader := TriggerReElection(leader, err, node)
+		newLeader := TriggerReElection(request.Context(), leader, err, node)
 
 		isNewLeader := newLeader != "" && newLeader != leader
 
@@ -314,6 +472,7 @@ func (node *Node) forwardToLeader(
 			if success {
 				return
 			}
+			node.metrics.forwardFailures.Inc()
 		}
 
 		http.Error(writer, "leader unreachable: "+err.Error(), http.StatusServiceUnavailable)
@@ -336,11 +495,12 @@ func forwardRequest(
 	node *Node,
 	writer http.ResponseWriter,
 ) bool {
-	url := strings.TrimRight(newLeader, "/") + request.URL.Path
+	url := strings.TrimRight(newLeader, "/") + request.URL.RequestURI()
 	retryRequest, error := http.NewRequest(request.Method, url, bytes.NewReader(bodyBytes))
 
 	if error == nil {
 		retryRequest.Header = request.Header.Clone()
+		propagateRequestID(request.Context(), retryRequest)
 		response, requestError := node.client.Do(retryRequest)
 		if requestError == nil {
 			defer response.Body.Close()
@@ -356,8 +516,8 @@ func forwardRequest(
 	return false
 }
 
-func TriggerReElection(leader Address, err error, node *Node) Address {
-	log.Printf("forward: leader %s unreachable: %v; triggering re-election", leader, err)
+func TriggerReElection(ctx context.Context, leader Address, err error, node *Node) Address {
+	node.log(ctx).Warn("forward: leader unreachable; triggering re-election", "leader", leader, "error", err)
 	node.electLeader()
 
 	node.mu.RLock()
@@ -395,15 +555,34 @@ func (node *Node) handleGetCards(
 	request *http.Request,
 ) {
 	user := getUserFromRequest(request)
-	cards := node.deck.List(user)
+
+	var cards []Card
+	var version uint64
+	err := node.store.View(func(tx Tx) error {
+		var err error
+		if cards, err = tx.List(user); err != nil {
+			return err
+		}
+		version, err = tx.Version(user)
+		return err
+	})
+	if err != nil {
+		node.log(request.Context()).Error("cards: failed to read the deck", "user", user, "error", err)
+		http.Error(writer, "failed to read the deck", http.StatusInternalServerError)
+		return
+	}
+
+	tag := etag(version)
+	writer.Header().Set("ETag", tag)
+	if request.Header.Get("If-None-Match") == tag {
+		writer.WriteHeader(http.StatusNotModified)
+		return
+	}
 	writer.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(writer).Encode(cards)
 }
 
 // / Move the last card from the global deck to the specific user
-// /
-// / To have consistent behavior, this reuses the routes
-// / DELETE /cards/:id and POST /users/:user/cards
 func (node *Node) handleClaim(writer http.ResponseWriter, request *http.Request) {
 
 	if !node.isLeader() {
@@ -419,107 +598,76 @@ func (node *Node) handleClaim(writer http.ResponseWriter, request *http.Request)
 	}
 	user := parts[1]
 
+	if !node.allow(writer, LimitClaim, user) {
+		return
+	}
+
+	ctx := request.Context()
+	claimed := false
+	defer func() {
+		if !claimed {
+			node.cancelCooldown(user)
+		}
+	}()
+
+	// claims are serialized, so two users never get the same card
+	node.claimMu.Lock()
+	defer node.claimMu.Unlock()
+
 	// get global list and pick last card
-	list := node.deck.List("")
+	list, _ := node.store.List("")
 
 	if len(list) == 0 {
-		node.regenGlobalDeck(20)
-		list = node.deck.List("")
+		node.regenGlobalDeck(ctx, node.config.RegenSize)
+		list, _ = node.store.List("")
+	}
+
+	// claim results are replicated so every node can notify the user
+	claimFailed := func(reason string) {
+		node.commit(ctx, ReplicateRequest{Op: "claim", User: user, Reason: reason})
 	}
 
 	if len(list) == 0 {
+		node.metrics.claims.Inc("no_cards")
+		claimFailed("no cards available")
 		http.Error(writer, "no cards available", http.StatusServiceUnavailable)
 		return
 	}
 
 	card := list[len(list)-1]
 
-	// DELETE /cards/:id (re-use route)
-	node.mu.RLock()
-	leader := node.leaderAddr
-	node.mu.RUnlock()
-
-	// build URLs against leader so followers that forward will reach the true leader
-	deleteURL := strings.TrimRight(leader, "/") + "/cards/" + strconv.Itoa(card.ID)
-	reqDel, err := http.NewRequest("DELETE", deleteURL, nil)
-	if err != nil {
-		http.Error(writer, "failed to build delete request", http.StatusInternalServerError)
-		return
-	}
-
-	respDel, err := node.client.Do(reqDel)
-	if err != nil || respDel.StatusCode >= 300 {
-		if respDel != nil {
-			io.Copy(io.Discard, respDel.Body)
-			respDel.Body.Close()
-		}
-		http.Error(writer, "failed to remove from global deck", http.StatusServiceUnavailable)
-		return
-	}
-	io.Copy(io.Discard, respDel.Body)
-	respDel.Body.Close()
-
-	// POST /users/:user/cards
-	postURL := strings.TrimRight(leader, "/") + "/users/" + user + "/cards"
-	body, _ := json.Marshal(card)
-	reqPost, err := http.NewRequest("POST", postURL, bytes.NewReader(body))
-	if err != nil {
-		http.Error(writer, "failed to build post request", http.StatusInternalServerError)
+	// one operation moves the card from the global deck to the user, so
+	// no node ever sees it in neither deck
+	if err := node.commit(ctx, ReplicateRequest{Op: "claim", Card: card, User: user}); err != nil {
+		node.metrics.claims.Inc("failure")
+		claimFailed("failed to move the card to the user")
+		http.Error(writer, "failed to move the card to the user", http.StatusServiceUnavailable)
 		return
 	}
-	reqPost.Header.Set("Content-Type", "application/json")
 
-	respPost, err := node.client.Do(reqPost)
-	if err != nil {
-		if respPost != nil {
-			io.Copy(io.Discard, respPost.Body)
-			respPost.Body.Close()
-		}
-		http.Error(writer, "failed to add card to user", http.StatusServiceUnavailable)
-		return
+	claimed = true
+	node.metrics.claims.Inc("success")
+	if err := node.startCooldown(ctx, user); err != nil {
+		node.log(ctx).Warn("claim: failed to replicate the cooldown", "user", user, "error", err)
 	}
-	defer respPost.Body.Close()
 
-	// proxy response back to client
-	for k, v := range respPost.Header {
-		writer.Header()[k] = v
-	}
-	writer.WriteHeader(respPost.StatusCode)
-	io.Copy(writer, respPost.Body)
+	writer.Header().Set("Content-Type", "application/json")
+	writer.WriteHeader(http.StatusCreated)
+	json.NewEncoder(writer).Encode(card)
 }
 
 // / Generate n random cards and adds to the global deck.
-func (node *Node) regenGlobalDeck(n int) {
-	node.mu.RLock()
-	leader := node.leaderAddr
-	node.mu.RUnlock()
-
-	if leader == "" {
-		log.Printf("regen: no leader known, aborting regen")
-		return
-	}
-
+// /
+// / The cards are committed as one import, so followers get them at once.
+func (node *Node) regenGlobalDeck(ctx context.Context, n int) {
+	entries := make([]DeckEntry, 0, n)
 	for i := range n {
 		id := int(time.Now().UnixNano()%1e9) + i
-		c := Card{ID: id, Name: fmt.Sprintf("Card-%d", id)}
-		url := strings.TrimRight(leader, "/") + "/cards"
-		body, _ := json.Marshal(c)
-		req, err := http.NewRequest("POST", url, bytes.NewReader(body))
-		if err != nil {
-			log.Printf("regen: failed to build POST request: %v", err)
-			continue
-		}
-		req.Header.Set("Content-Type", "application/json")
-		resp, err := node.client.Do(req)
-		if err != nil {
-			log.Printf("regen: POST /cards failed: %v", err)
-			continue
-		}
-		io.Copy(io.Discard, resp.Body)
-		resp.Body.Close()
-		if resp.StatusCode >= 300 {
-			log.Printf("regen: non-2xx from POST /cards: %s", resp.Status)
-		}
+		entries = append(entries, DeckEntry{ID: id, Name: fmt.Sprintf("Card-%d", id)})
+	}
+
+	if err := node.commit(ctx, ReplicateRequest{Op: "import", Entries: entries}); err != nil {
+		node.log(ctx).Warn("regen: failed to add cards", "error", err)
 	}
 }
 
@@ -538,11 +686,24 @@ func (node *Node) handlePostCard(
 	}
 
 	user := getUserFromRequest(request)
+	expected, err := ifMatch(request)
+	if err != nil {
+		http.Error(writer, err.Error(), http.StatusBadRequest)
+		return
+	}
 
-	node.deck.Add(user, c)
+	// include user so followers update the same user's deck
+	version, err := node.commitDeck(request.Context(), ReplicateRequest{Op: "add", Card: c, User: user}, expected)
+	if errors.Is(err, errVersionMismatch) {
+		preconditionFailed(writer, version, err)
+		return
+	}
+	if err != nil {
+		http.Error(writer, "failed to add card", http.StatusInternalServerError)
+		return
+	}
 
-	// replicate (include user so followers update the same user's deck)
-	node.replicateToFollowers(ReplicateRequest{Op: "add", Card: c, User: user})
+	writer.Header().Set("ETag", etag(version))
 	writer.WriteHeader(http.StatusCreated)
 	json.NewEncoder(writer).Encode(c)
 }
@@ -569,13 +730,25 @@ func (node *Node) handleTrade(writer http.ResponseWriter, request *http.Request)
 		return
 	}
 
-	// create and store proposal
+	if !node.allow(writer, LimitTrade, trade.UserA) {
+		return
+	}
+
+	// reserve an id, then store the proposal on every node
 	node.mu.Lock()
 	node.nextTradeID++
+	// IDs are unique across shards, see Ring.TradeShard
+	for node.ring != nil && node.ring.TradeShard(node.nextTradeID) != node.config.Shard {
+		node.nextTradeID++
+	}
 	id := node.nextTradeID
-	node.trades[id] = &trade
 	node.mu.Unlock()
 
+	if err := node.commit(request.Context(), ReplicateRequest{Op: "trade_propose", TradeID: id, Trade: &trade}); err != nil {
+		http.Error(writer, "failed to propose trade", http.StatusInternalServerError)
+		return
+	}
+
 	out := map[string]interface{}{"trade_id": id, "status": "pending"}
 	writer.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(writer).Encode(out)
@@ -612,6 +785,10 @@ func (node *Node) handleTradeAccept(writer http.ResponseWriter, request *http.Re
 		return
 	}
 
+	if !node.allow(writer, LimitAccept, payload.User) {
+		return
+	}
+
 	node.mu.Lock()
 	tr, ok := node.trades[id]
 	if !ok {
@@ -629,42 +806,52 @@ func (node *Node) handleTradeAccept(writer http.ResponseWriter, request *http.Re
 	delete(node.trades, id)
 	node.mu.Unlock()
 
-	// verify both cards still exist
-	aCard, okA := findCardInList(node.deck.List(tr.UserA), tr.ACardID)
-	bCard, okB := findCardInList(node.deck.List(tr.UserB), tr.BCardID)
-	if !okA || !okB {
-		http.Error(writer, "one or both cards not found", http.StatusBadRequest)
+	if node.shardOf(tr.UserB) != node.config.Shard {
+		node.acceptAcrossShards(writer, request, id, tr)
 		return
 	}
 
-	// execute swap (leader does the mutating and replicates)
-	node.deck.Remove(tr.UserA, tr.ACardID)
-	node.replicateToFollowers(ReplicateRequest{Op: "remove", Card: Card{ID: tr.ACardID}, User: tr.UserA})
+	ctx := request.Context()
+	failed := func(message string) {
+		// the trade can be accepted again
+		node.mu.Lock()
+		node.trades[id] = tr
+		node.mu.Unlock()
+		http.Error(writer, message, http.StatusInternalServerError)
+	}
 
-	node.deck.Remove(tr.UserB, tr.BCardID)
-	node.replicateToFollowers(ReplicateRequest{Op: "remove", Card: Card{ID: tr.BCardID}, User: tr.UserB})
+	// the cards are read and swapped under the commit lock, so neither
+	// leaves its deck in between
+	node.applyMu.Lock()
+	defer node.applyMu.Unlock()
 
-	node.deck.Add(tr.UserA, bCard)
-	node.replicateToFollowers(ReplicateRequest{Op: "add", Card: bCard, User: tr.UserA})
+	aCard, okA, errA := node.store.Get(tr.UserA, tr.ACardID)
+	bCard, okB, errB := node.store.Get(tr.UserB, tr.BCardID)
+	if err := errors.Join(errA, errB); err != nil {
+		node.log(ctx).Error("trade: failed to read the decks", "trade", id, "error", err)
+		failed("failed to read the decks")
+		return
+	}
+	if !okA || !okB {
+		if err := node.commitLocked(ctx, ReplicateRequest{Op: "trade_cancel", TradeID: id, Trade: tr, Reason: "one or both cards not found"}); err != nil {
+			failed("failed to cancel trade")
+			return
+		}
+		http.Error(writer, "one or both cards not found", http.StatusBadRequest)
+		return
+	}
 
-	node.deck.Add(tr.UserB, aCard)
-	node.replicateToFollowers(ReplicateRequest{Op: "add", Card: aCard, User: tr.UserB})
+	// both cards move in one operation, so no node sees half a swap
+	if err := node.commitLocked(ctx, ReplicateRequest{Op: "trade_exchange", TradeID: id, Trade: tr, Card: aCard, Other: bCard}); err != nil {
+		failed("failed to swap the cards")
+		return
+	}
 
 	out := map[string]Card{"user_a_received": bCard, "user_b_received": aCard}
 	writer.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(writer).Encode(out)
 }
 
-// findCardInList returns the card with id from list and a bool indicating presence
-func findCardInList(list []Card, id int) (Card, bool) {
-	for _, c := range list {
-		if c.ID == id {
-			return c, true
-		}
-	}
-	return Card{}, false
-}
-
 func (node *Node) handleDeleteCard(
 	writer http.ResponseWriter,
 	request *http.Request,
@@ -701,9 +888,23 @@ func (node *Node) handleDeleteCard(
 	}
 
 	user := getUserFromRequest(request)
+	expected, err := ifMatch(request)
+	if err != nil {
+		http.Error(writer, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	version, err := node.commitDeck(request.Context(), ReplicateRequest{Op: "remove", Card: Card{ID: id}, User: user}, expected)
+	if errors.Is(err, errVersionMismatch) {
+		preconditionFailed(writer, version, err)
+		return
+	}
+	if err != nil {
+		http.Error(writer, "failed to remove card", http.StatusInternalServerError)
+		return
+	}
 
-	node.deck.Remove(user, id)
-	node.replicateToFollowers(ReplicateRequest{Op: "remove", Card: Card{ID: id}, User: user})
+	writer.Header().Set("ETag", etag(version))
 	writer.WriteHeader(http.StatusNoContent)
 }
 
@@ -718,17 +919,262 @@ func (node *Node) handleReplicate(
 		return
 	}
 
+	if err := node.applyReplicate(request.Context(), req); err != nil {
+		http.Error(writer, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	writer.WriteHeader(http.StatusOK)
+}
+
+// / Apply an operation decided by the leader and publish its events.
+// /
+// / Its writes, and the log position it moves to, are one transaction
+// / of the storage; the state in memory follows once it is kept.
+func (node *Node) apply(ctx context.Context, req ReplicateRequest) error {
+	// card taken out of a deck, or settled by a trade with another shard
+	var moved Card
+	var changes []func()
+
+	err := node.store.Update(func(tx Tx) error {
+		var err error
+		moved, changes, err = node.applyTx(tx, req)
+		if err != nil {
+			return err
+		}
+		return putState(tx, stateNode, "position", LogPosition{Term: req.Term, Index: req.Index})
+	})
+	if err != nil {
+		return fmt.Errorf("op %q: %w", req.Op, err)
+	}
+	for _, change := range changes {
+		change()
+	}
+
+	// only the leader calls webhooks, so each event is sent once
+	leader := node.isLeader()
+	for _, delivery := range eventsOf(req, moved) {
+		delivery.event.Time = time.Now().UTC()
+		if shard := node.shardOf(delivery.user); shard != node.config.Shard {
+			// the user listens to its own shard, which publishes it
+			if leader {
+				node.relayEvent(ctx, shard, delivery.event)
+			}
+			continue
+		}
+		node.events.Publish(delivery.event, delivery.user)
+		if leader {
+			node.dispatchWebhooks(ctx, delivery.event)
+		}
+	}
+
+	node.log(ctx).Info("replicate: applied", "op", req.Op, "index", req.Index, "user", req.User, "card", req.Card.ID, "trade", req.TradeID)
+	return nil
+}
+
+// / Write an operation in tx, returning the card it moved and the
+// / changes to make to the state in memory once tx is kept
+func (node *Node) applyTx(tx Tx, req ReplicateRequest) (moved Card, changes []func(), err error) {
+	change := func(fn func()) { changes = append(changes, fn) }
+	tradeKey := strconv.Itoa(req.TradeID)
+
 	switch req.Op {
 	case "add":
-		node.deck.Add(req.User, req.Card)
+		err = tx.Put(req.User, req.Card)
 	case "remove":
-		node.deck.Remove(req.User, req.Card.ID)
+		moved, _, err = tx.Delete(req.User, req.Card.ID)
+		moved.ID = req.Card.ID
+	case "trade_propose":
+		if req.Trade == nil {
+			return moved, nil, errors.New("without trade")
+		}
+		trade := *req.Trade
+		node.mu.RLock()
+		next := max(node.nextTradeID, req.TradeID)
+		node.mu.RUnlock()
+
+		err = errors.Join(
+			putState(tx, stateTrades, tradeKey, trade),
+			putState(tx, stateNode, "next_trade_id", next),
+		)
+		change(func() {
+			node.mu.Lock()
+			node.trades[req.TradeID] = &trade
+			node.nextTradeID = max(node.nextTradeID, req.TradeID)
+			node.mu.Unlock()
+		})
+	case "trade_exchange":
+		if req.Trade == nil {
+			return moved, nil, errors.New("without trade")
+		}
+		trade := *req.Trade
+		for _, side := range []struct {
+			user string
+			card Card
+		}{{trade.UserA, req.Card}, {trade.UserB, req.Other}} {
+			_, ok, err := tx.Delete(side.user, side.card.ID)
+			if err != nil {
+				return moved, nil, err
+			}
+			if !ok {
+				return moved, nil, fmt.Errorf("card %d is not in the deck of %q", side.card.ID, side.user)
+			}
+		}
+		err = errors.Join(
+			tx.Put(trade.UserA, req.Other),
+			tx.Put(trade.UserB, req.Card),
+			putState(tx, stateTrades, tradeKey, nil),
+		)
+		change(func() {
+			node.mu.Lock()
+			delete(node.trades, req.TradeID)
+			node.mu.Unlock()
+		})
+	case "trade_accept", "trade_cancel":
+		node.mu.RLock()
+		escrow, held := node.escrows[req.TradeID]
+		node.mu.RUnlock()
+
+		err = putState(tx, stateTrades, tradeKey, nil)
+		if held && err == nil {
+			// the proposer gets the card of the other shard, or its own back
+			moved = escrow.Card
+			if req.Op == "trade_accept" {
+				moved = req.Card
+			}
+			err = errors.Join(
+				tx.Put(escrow.Trade.UserA, moved),
+				putState(tx, stateEscrows, tradeKey, nil),
+			)
+		}
+		change(func() {
+			node.mu.Lock()
+			delete(node.trades, req.TradeID)
+			delete(node.escrows, req.TradeID)
+			node.mu.Unlock()
+		})
+	case "trade_escrow":
+		if req.Trade == nil {
+			return moved, nil, errors.New("without trade")
+		}
+		var held bool
+		moved, held, err = tx.Delete(req.User, req.Card.ID)
+		if err != nil {
+			return moved, nil, err
+		}
+		escrow := Escrow{TradeID: req.TradeID, Trade: *req.Trade, Card: moved}
+		err = putState(tx, stateTrades, tradeKey, nil)
+		if held && err == nil {
+			err = putState(tx, stateEscrows, tradeKey, escrow)
+		}
+		change(func() {
+			node.mu.Lock()
+			delete(node.trades, req.TradeID)
+			if held {
+				node.escrows[req.TradeID] = escrow
+			}
+			node.mu.Unlock()
+		})
+	case "trade_swap":
+		if req.Trade == nil {
+			return moved, nil, errors.New("without trade")
+		}
+		node.mu.RLock()
+		_, swapped := node.swaps[req.TradeID]
+		node.mu.RUnlock()
+		if swapped {
+			// asked again by the other shard: the first answer stands
+			break
+		}
+
+		var result SwapResult
+		var ok bool
+		if moved, ok, err = tx.Delete(req.Trade.UserB, req.Trade.BCardID); err != nil {
+			return moved, nil, err
+		}
+		if ok {
+			result.Card = moved
+			err = tx.Put(req.Trade.UserB, req.Card)
+		} else {
+			result.Reason = "one or both cards not found"
+		}
+		err = errors.Join(err, putState(tx, stateSwaps, tradeKey, result))
+		change(func() {
+			node.mu.Lock()
+			node.swaps[req.TradeID] = result
+			node.mu.Unlock()
+		})
+	case "trade_forget":
+		err = putState(tx, stateSwaps, tradeKey, nil)
+		change(func() {
+			node.mu.Lock()
+			delete(node.swaps, req.TradeID)
+			node.mu.Unlock()
+		})
+	case "relay":
+		if req.Event == nil {
+			return moved, nil, errors.New("without event")
+		}
+	case "claim":
+		if req.Reason != "" {
+			// a failed claim only notifies the user
+			break
+		}
+		var ok bool
+		if moved, ok, err = tx.Delete("", req.Card.ID); err != nil {
+			return moved, nil, err
+		}
+		if !ok {
+			return moved, nil, fmt.Errorf("card %d is not in the global deck", req.Card.ID)
+		}
+		err = tx.Put(req.User, moved)
+	case "noop":
+		// only moves the log forward, see handOff
+	case "import":
+		for _, entry := range req.Entries {
+			if err := tx.Put(entry.Owner, Card{ID: entry.ID, Name: entry.Name}); err != nil {
+				return moved, nil, err
+			}
+		}
+	case "limit":
+		if req.Limit == nil {
+			return moved, nil, errors.New("without limit")
+		}
+		limit := *req.Limit
+		err = putState(tx, stateLimits, limit.Key, limit.Until)
+		change(func() {
+			if refilled := node.limits.apply(limit); len(refilled) > 0 {
+				node.forgetLimits(refilled)
+			}
+		})
+	case "webhook_add":
+		if req.Webhook == nil {
+			return moved, nil, errors.New("without webhook")
+		}
+		hook := *req.Webhook
+		err = errors.Join(
+			putState(tx, stateWebhooks, strconv.Itoa(hook.ID), hook),
+			putState(tx, stateNode, "next_webhook_id", max(node.webhooks.next(), hook.ID)),
+		)
+		change(func() { node.webhooks.add(hook) })
+	case "webhook_remove":
+		if req.Webhook == nil {
+			return moved, nil, errors.New("without webhook")
+		}
+		id := req.Webhook.ID
+		err = putState(tx, stateWebhooks, strconv.Itoa(id), nil)
+		change(func() { node.webhooks.remove(id) })
+	case "webhook_dead":
+		if req.DeadLetter == nil {
+			return moved, nil, errors.New("without dead letter")
+		}
+		letter := *req.DeadLetter
+		err = putState(tx, stateNode, "dead_letters", lastDeadLetters(append(node.webhooks.deadLetters(), letter)))
+		change(func() { node.webhooks.bury(letter) })
 	default:
-		http.Error(writer, "unknown op", http.StatusBadRequest)
-		return
+		return moved, nil, errors.New("unknown op")
 	}
-
-	writer.WriteHeader(http.StatusOK)
+	return moved, changes, err
 }
 
 func (node *Node) handleStatus(
@@ -736,18 +1182,49 @@ func (node *Node) handleStatus(
 	request *http.Request,
 ) {
 
-	node.mu.RLock()
+	writer.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(writer).Encode(node.status())
+}
 
-	leaderID := node.leaderID
-	leaderAddr := node.leaderAddr
+func (node *Node) status() NodeStatus {
+	// the applied index and the deck counts describe the same state
+	node.applyMu.Lock()
+	node.mu.RLock()
+	status := NodeStatus{
+		NodeID:       node.id,
+		NodeAddr:     node.addr,
+		Shard:        node.config.Shard,
+		LeaderID:     node.leaderID,
+		LeaderAddr:   node.leaderAddr,
+		Term:         node.term,
+		AppliedIndex: node.applied.Load(),
+		Leaving:      node.leaving.Load(),
+	}
 	node.mu.RUnlock()
-	out := map[string]interface{}{
-		"node_id":     node.id,
-		"node_addr":   node.addr,
-		"leader_id":   leaderID,
-		"leader_addr": leaderAddr,
+
+	status.Decks, _ = node.store.Counts()
+	node.applyMu.Unlock()
+
+	if at := node.snapshotAt.Load(); at != 0 {
+		status.SnapshotAge = time.Since(time.Unix(0, at)).Seconds()
 	}
-	writer.Header().Set("Content-Type", "application/json")
 
-	json.NewEncoder(writer).Encode(out)
+	if status.LeaderID == node.id {
+		status.Synced = true
+		status.LeaderIndex = status.AppliedIndex
+		status.Followers = node.replicationStatus()
+	} else {
+		status.Synced = node.synced.Load()
+		status.LeaderIndex = node.leaderIndex.Load()
+		if status.LeaderIndex > status.AppliedIndex {
+			status.Lag = status.LeaderIndex - status.AppliedIndex
+		}
+		if at := node.heartbeat.Load(); at != 0 {
+			status.LastHeartbeat = time.Unix(0, at)
+		}
+	}
+
+	status.NotReady = node.notReady(status)
+	status.Ready = len(status.NotReady) == 0
+	return status
 }
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"context"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestClaimMovesCardInOneOperation(t *testing.T) {
+	node, err := NewNode(DefaultConfig(), NewMemoryStorage())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	if err := node.commit(ctx, ReplicateRequest{Op: "add", Card: Card{ID: 7, Name: "Pelé"}}); err != nil {
+		t.Fatal(err)
+	}
+	index := node.applied.Load()
+
+	if err := node.commit(ctx, ReplicateRequest{Op: "claim", User: "alice", Card: Card{ID: 7}}); err != nil {
+		t.Fatal(err)
+	}
+	if node.applied.Load() != index+1 {
+		t.Fatalf("claim took %d log entries, want 1", node.applied.Load()-index)
+	}
+	global, _ := node.store.List("")
+	cards, _ := node.store.List("alice")
+	if len(global) != 0 || len(cards) != 1 || cards[0].Name != "Pelé" {
+		t.Fatalf("global deck %v, alice %v after the claim", global, cards)
+	}
+
+	// the card is gone, so a second claim of it moves nothing
+	if err := node.commit(ctx, ReplicateRequest{Op: "claim", User: "bob", Card: Card{ID: 7}}); err == nil {
+		t.Fatal("claimed a card missing from the global deck")
+	}
+	if cards, _ := node.store.List("bob"); len(cards) != 0 {
+		t.Fatalf("bob has %v", cards)
+	}
+}
+
+func TestRateLimitDoesNotWriteTheLog(t *testing.T) {
+	config := DefaultConfig()
+	config.RateLimits = map[string]RateLimit{LimitTrade: {Every: Duration(time.Hour), Burst: 2}}
+	node, err := NewNode(config, NewMemoryStorage())
+	if err != nil {
+		t.Fatal(err)
+	}
+	index := node.applied.Load()
+
+	for i, want := range []bool{true, true, false} {
+		if allowed := node.allow(httptest.NewRecorder(), LimitTrade, "alice"); allowed != want {
+			t.Fatalf("request %d allowed %v, want %v", i+1, allowed, want)
+		}
+	}
+	if node.applied.Load() != index {
+		t.Fatalf("rate limited requests wrote %d log entries", node.applied.Load()-index)
+	}
+}
@@ -0,0 +1,283 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// / Token bucket of one endpoint: a token every Every, at most Burst saved.
+// /
+// / A zero Burst disables the limit.
+type RateLimit struct {
+	Every Duration `yaml:"every" toml:"every"`
+	Burst int      `yaml:"burst" toml:"burst"`
+}
+
+// Endpoints that can be limited per user.
+const (
+	LimitClaim  = "claim"
+	LimitTrade  = "trade"
+	LimitAccept = "accept"
+)
+
+var limitEndpoints = []string{LimitClaim, LimitTrade, LimitAccept}
+
+// Key prefix of the claim cooldowns, kept next to the buckets.
+const cooldownKey = "cooldown"
+
+// / Replicated claim cooldown of one user, see RateLimiter
+type LimitState struct {
+	Key   string    `json:"key"`
+	Until time.Time `json:"until"`
+}
+
+// / Per-user rate limits, enforced by the leader.
+// /
+// / Each bucket is stored as the single time at which it will be full
+// / again (the "theoretical arrival time" of GCRA). Cooldowns are stored
+// / the same way, as the time of the next allowed claim.
+// /
+// / Only the cooldowns are replicated, one operation per successful
+// / claim, so a new leader keeps enforcing them. The buckets stay on the
+// / leader: replicating them would write the log on every request, and a
+// / new leader only starts with full buckets.
+type RateLimiter struct {
+	mu     sync.Mutex
+	until  map[string]time.Time
+	writes int
+}
+
+func NewRateLimiter() *RateLimiter {
+	return &RateLimiter{
+		until: make(map[string]time.Time),
+	}
+}
+
+func limitKey(endpoint, user string) string {
+	return endpoint + "/" + user
+}
+
+// / Take a token from a bucket.
+// /
+// / Returns how long to wait before the next token when the bucket is
+// / empty.
+func (limiter *RateLimiter) take(key string, limit RateLimit, now time.Time) (time.Duration, bool) {
+	limiter.mu.Lock()
+	defer limiter.mu.Unlock()
+
+	every := time.Duration(limit.Every)
+	tolerance := every * time.Duration(limit.Burst)
+
+	until := limiter.until[key]
+	if until.Before(now) {
+		until = now
+	}
+	next := until.Add(every)
+
+	if wait := next.Sub(now) - tolerance; wait > 0 {
+		return wait, false
+	}
+
+	// stored right away, so concurrent requests do not share a token
+	limiter.until[key] = next
+	return 0, true
+}
+
+// / Reserve a cooldown: key allows again after cooldown.
+// /
+// / Returns how long to wait when key does not allow yet. The check and
+// / the reservation are one step, so concurrent requests cannot both
+// / pass; the reservation is replicated once the request succeeds, see
+// / startCooldown, or dropped by cancel.
+func (limiter *RateLimiter) reserve(key string, cooldown time.Duration, now time.Time) (time.Duration, bool) {
+	limiter.mu.Lock()
+	defer limiter.mu.Unlock()
+
+	if wait := limiter.until[key].Sub(now); wait > 0 {
+		return wait, false
+	}
+	limiter.until[key] = now.Add(cooldown)
+	return 0, true
+}
+
+// / Drop the reservation of key; no other request passed it meanwhile
+func (limiter *RateLimiter) cancel(key string) {
+	limiter.mu.Lock()
+	defer limiter.mu.Unlock()
+
+	delete(limiter.until, key)
+}
+
+// / Time at which key allows again
+func (limiter *RateLimiter) next(key string) time.Time {
+	limiter.mu.Lock()
+	defer limiter.mu.Unlock()
+
+	return limiter.until[key]
+}
+
+// / Record a replicated cooldown; it only moves forward in time.
+// /
+// / Returns the keys of the buckets that refilled, forgotten every now
+// / and then.
+func (limiter *RateLimiter) apply(state LimitState) []string {
+	limiter.mu.Lock()
+	defer limiter.mu.Unlock()
+
+	if state.Until.After(limiter.until[state.Key]) {
+		limiter.until[state.Key] = state.Until
+	}
+
+	limiter.writes++
+	if limiter.writes%1024 == 0 {
+		return limiter.prune(time.Now())
+	}
+	return nil
+}
+
+func (limiter *RateLimiter) prune(now time.Time) []string {
+	var pruned []string
+	for key, until := range limiter.until {
+		if until.Before(now) {
+			delete(limiter.until, key)
+			pruned = append(pruned, key)
+		}
+	}
+	return pruned
+}
+
+// / Copy the state into a snapshot, without the refilled buckets
+func (limiter *RateLimiter) snapshot(snap *Snapshot) {
+	limiter.mu.Lock()
+	defer limiter.mu.Unlock()
+
+	limiter.prune(time.Now())
+	snap.Limits = make(map[string]time.Time, len(limiter.until))
+	for key, until := range limiter.until {
+		snap.Limits[key] = until
+	}
+}
+
+func (limiter *RateLimiter) restore(snap Snapshot) {
+	limiter.mu.Lock()
+	defer limiter.mu.Unlock()
+
+	limiter.until = make(map[string]time.Time, len(snap.Limits))
+	for key, until := range snap.Limits {
+		limiter.until[key] = until
+	}
+}
+
+// / Consume a token of endpoint for user, answering 429 when there is none.
+// /
+// / Only the leader calls it, before doing any work for the request.
+// / A claim also reserves the cooldown of the user: the claim then ends
+// / with startCooldown, or with cancelCooldown when it fails.
+// / Returns false when the request was rejected.
+func (node *Node) allow(writer http.ResponseWriter, endpoint, user string) bool {
+	now := time.Now()
+
+	cooldown := endpoint == LimitClaim && node.config.ClaimCooldown > 0
+	if cooldown {
+		if wait, ok := node.limits.reserve(limitKey(cooldownKey, user), time.Duration(node.config.ClaimCooldown), now); !ok {
+			node.metrics.rateLimited.Inc("cooldown")
+			tooManyRequests(writer, wait, "claim cooldown")
+			return false
+		}
+	}
+
+	limit, ok := node.config.RateLimits[endpoint]
+	if !ok || limit.Burst == 0 {
+		return true
+	}
+
+	wait, ok := node.limits.take(limitKey(endpoint, user), limit, now)
+	if !ok {
+		if cooldown {
+			node.cancelCooldown(user)
+		}
+		node.metrics.rateLimited.Inc(endpoint)
+		tooManyRequests(writer, wait, "rate limit exceeded")
+		return false
+	}
+	return true
+}
+
+// / Replicate the claim cooldown reserved by allow, after a successful claim
+func (node *Node) startCooldown(ctx context.Context, user string) error {
+	if node.config.ClaimCooldown <= 0 {
+		return nil
+	}
+	key := limitKey(cooldownKey, user)
+	state := LimitState{Key: key, Until: node.limits.next(key)}
+	return node.commit(ctx, ReplicateRequest{Op: "limit", Limit: &state})
+}
+
+// / Drop the claim cooldown reserved by allow, after a failed claim
+func (node *Node) cancelCooldown(user string) {
+	if node.config.ClaimCooldown <= 0 {
+		return
+	}
+	node.limits.cancel(limitKey(cooldownKey, user))
+}
+
+func tooManyRequests(writer http.ResponseWriter, wait time.Duration, reason string) {
+	seconds := int(math.Ceil(wait.Seconds()))
+	writer.Header().Set("Retry-After", strconv.Itoa(seconds))
+	http.Error(writer, fmt.Sprintf("%s, retry in %ds", reason, seconds), http.StatusTooManyRequests)
+}
+
+// / Parse limits written as endpoint=every/burst,endpoint=every/burst
+func parseRateLimits(raw string) (map[string]RateLimit, error) {
+	limits := make(map[string]RateLimit)
+
+	for _, item := range strings.Split(raw, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		endpoint, value, ok := strings.Cut(item, "=")
+		if !ok {
+			return nil, fmt.Errorf("bad rate limit entry: %s", item)
+		}
+		every, burst, ok := strings.Cut(value, "/")
+		if !ok {
+			return nil, fmt.Errorf("bad rate limit entry: %s, expected endpoint=every/burst", item)
+		}
+
+		var limit RateLimit
+		if err := limit.Every.UnmarshalText([]byte(every)); err != nil {
+			return nil, fmt.Errorf("bad rate limit entry: %s: %w", item, err)
+		}
+		count, err := strconv.Atoi(burst)
+		if err != nil {
+			return nil, fmt.Errorf("bad rate limit burst: %s", burst)
+		}
+		limit.Burst = count
+		limits[endpoint] = limit
+	}
+	return limits, nil
+}
+
+func validateRateLimits(limits map[string]RateLimit) []error {
+	var errs []error
+	for endpoint, limit := range limits {
+		if !slices.Contains(limitEndpoints, endpoint) {
+			errs = append(errs, fmt.Errorf("rate_limits: unknown endpoint %q, use one of %s", endpoint, strings.Join(limitEndpoints, ", ")))
+		}
+		if limit.Burst < 0 {
+			errs = append(errs, fmt.Errorf("rate_limits: %s: burst must not be negative, got %d", endpoint, limit.Burst))
+		}
+		if limit.Burst > 0 && limit.Every <= 0 {
+			errs = append(errs, fmt.Errorf("rate_limits: %s: every must be positive, got %s", endpoint, limit.Every))
+		}
+	}
+	return errs
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// / Operations waiting to be sent to one follower.
+// /
+// / Every follower has its own queue and sender, so operations reach it
+// / in the order the leader committed them, and a slow follower does not
+// / hold back the others. A full queue drops the operation: the follower
+// / finds the hole on the next one and resyncs.
+type follower struct {
+	id      PeerID
+	address Address
+	queue   chan queuedOp
+
+	// last index the follower acknowledged, and when
+	acked   atomic.Uint64
+	contact atomic.Int64
+}
+
+type queuedOp struct {
+	ctx context.Context
+	op  ReplicateRequest
+}
+
+// Operations queued per follower before new ones are dropped.
+const replicationQueueSize = 4096
+
+func (node *Node) startReplication() {
+	node.followers = make(map[PeerID]*follower)
+	for id, address := range node.peers {
+		if id == node.id {
+			continue
+		}
+		f := &follower{
+			id:      id,
+			address: address,
+			queue:   make(chan queuedOp, replicationQueueSize),
+		}
+		node.followers[id] = f
+		go node.replicateLoop(f)
+	}
+}
+
+// / Number, apply and replicate an operation. Only the leader commits.
+// /
+// / Commits are serialized: the index gives the order in which every
+// / node applies the operations. The operation is only queued for the
+// / followers when commit returns, so no follower may have it yet: an
+// / operation the leader acknowledged is lost if the leader fails before
+// / sending it, as the next leader does not know of it.
+func (node *Node) commit(ctx context.Context, op ReplicateRequest) error {
+	node.applyMu.Lock()
+	defer node.applyMu.Unlock()
+
+	return node.commitLocked(ctx, op)
+}
+
+// / Commit a write to the deck of op.User, if the deck is still at the
+// / expected version, and return the version it moved the deck to.
+// /
+// / A nil expected version commits unconditionally.
+func (node *Node) commitDeck(ctx context.Context, op ReplicateRequest, expected *uint64) (uint64, error) {
+	node.applyMu.Lock()
+	defer node.applyMu.Unlock()
+
+	current, err := node.store.Version(op.User)
+	if err != nil {
+		return 0, err
+	}
+	if expected != nil && *expected != current {
+		return current, fmt.Errorf("%w: deck is at version %d, not %d", errVersionMismatch, current, *expected)
+	}
+
+	if err := node.commitLocked(ctx, op); err != nil {
+		return current, err
+	}
+	return node.store.Version(op.User)
+}
+
+func (node *Node) commitLocked(ctx context.Context, op ReplicateRequest) error {
+	node.mu.RLock()
+	op.Term = node.term
+	node.mu.RUnlock()
+	op.Index = node.applied.Load() + 1
+
+	if err := node.apply(ctx, op); err != nil {
+		node.log(ctx).Error("commit: failed to apply", "op", op.Op, "error", err)
+		return err
+	}
+	node.appliedTerm = op.Term
+	node.applied.Store(op.Index)
+
+	node.replicateToFollowers(ctx, op)
+	return nil
+}
+
+// / Apply an operation replicated by the leader, in log order.
+// /
+// / Operations already covered by a snapshot are skipped. A hole in the
+// / log, or a leader of the current term whose log is behind the one
+// / applied here, makes the node resync from the leader. Operations of
+// / a leader of an older term are refused.
+func (node *Node) applyReplicate(ctx context.Context, req ReplicateRequest) error {
+	node.applyMu.Lock()
+	defer node.applyMu.Unlock()
+
+	node.mu.RLock()
+	term := node.term
+	node.mu.RUnlock()
+
+	applied := node.applied.Load()
+	switch {
+	case req.Term < node.appliedTerm && req.Term < term:
+		return fmt.Errorf("stale leader: term %d, this node is at term %d", req.Term, term)
+	case req.Term < node.appliedTerm:
+		// the leader this node follows never saw the operations of
+		// the later term applied here: take its state instead
+		node.log(ctx).Warn("replicate: leader is behind the log applied here, resyncing", "term", req.Term, "applied_term", node.appliedTerm)
+		node.synced.Store(false)
+		go node.resync()
+		return fmt.Errorf("log of term %d applied here is ahead of the leader at term %d, resyncing", node.appliedTerm, req.Term)
+	case req.Term == node.appliedTerm && req.Index <= applied:
+		return nil
+	case req.Index != applied+1:
+		// applying past a hole would skip operations: the snapshot
+		// replaces the state instead
+		node.log(ctx).Warn("replicate: log does not follow, resyncing", "index", req.Index, "applied", applied, "term", req.Term)
+		go node.resync()
+		return fmt.Errorf("log does not follow: index %d after %d, resyncing", req.Index, applied)
+	}
+
+	if err := node.apply(ctx, req); err != nil {
+		return err
+	}
+	node.appliedTerm = req.Term
+	node.applied.Store(req.Index)
+
+	node.heartbeat.Store(time.Now().UnixNano())
+	node.leaderIndex.Store(req.Index)
+	return nil
+}
+
+// / Fetch a snapshot from the leader, unless a resync is already running
+func (node *Node) resync() {
+	if !node.resyncing.CompareAndSwap(false, true) {
+		return
+	}
+	defer node.resyncing.Store(false)
+
+	node.SyncFromLeader()
+}
+
+// / Queue an operation for every follower
+func (node *Node) replicateToFollowers(ctx context.Context, request ReplicateRequest) {
+	// replication outlives the client request that caused it
+	ctx = context.WithoutCancel(ctx)
+
+	for _, f := range node.followers {
+		select {
+		case f.queue <- queuedOp{ctx, request}:
+		default:
+			node.log(ctx).Warn("replicate: queue full, dropping", "peer", f.id, "index", request.Index)
+			node.metrics.replicateTotal.Inc(strconv.Itoa(f.id), "failure")
+		}
+	}
+}
+
+// / Send the queued operations of a follower, one at a time
+func (node *Node) replicateLoop(f *follower) {
+	peer := strconv.Itoa(f.id)
+
+	for queued := range f.queue {
+		ctx, cancel := context.WithTimeout(queued.ctx, node.client.Timeout)
+		start := time.Now()
+		err := node.transport.Replicate(ctx, f.address, queued.op)
+		cancel()
+		node.metrics.replicateLatency.Since(start, peer)
+
+		if err != nil {
+			// a follower that is down would cost a timeout per queued
+			// operation: drop them, it resyncs on the next one it gets
+			dropped := f.drain()
+			node.log(queued.ctx).Warn("replicate: failed", "peer", f.id, "address", f.address, "index", queued.op.Index, "dropped", dropped, "error", err)
+			node.metrics.replicateTotal.Add(float64(1+dropped), peer, "failure")
+			go node.checkTerm(f, queued.op.Term)
+			continue
+		}
+
+		f.acked.Store(queued.op.Index)
+		f.contact.Store(time.Now().UnixNano())
+		node.metrics.replicateTotal.Inc(peer, "success")
+	}
+}
+
+// / Hold an election at once when a follower that refused an operation
+// / of term is at a later term: this leader is stale, and would only be
+// / refused until the next election otherwise
+func (node *Node) checkTerm(f *follower, term uint64) {
+	ctx, cancel := context.WithTimeout(context.Background(), node.client.Timeout)
+	defer cancel()
+
+	status, err := node.transport.Status(ctx, f.address)
+	if err != nil || status.Term <= term {
+		return
+	}
+	node.logger.Warn("replicate: follower is at a later term, electing", "peer", f.id, "term", term, "follower_term", status.Term)
+	node.electLeader()
+}
+
+func (f *follower) drain() int {
+	for dropped := 0; ; dropped++ {
+		select {
+		case <-f.queue:
+		default:
+			return dropped
+		}
+	}
+}
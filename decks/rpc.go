@@ -0,0 +1,498 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// / Binary peer transport: gob frames over one persistent connection per peer.
+// /
+// / The connection is opened as an HTTP upgrade on GET /rpc, so peers
+// / keep using the same address they use for REST. Calls are multiplexed
+// / by ID, and a snapshot is streamed as several frames instead of one
+// / big JSON document.
+const rpcProtocol = "decks-gob"
+
+type rpcMethod uint8
+
+const (
+	rpcReplicate rpcMethod = iota + 1
+	rpcStatus
+	rpcSnapshot
+	rpcAnnounce
+)
+
+type rpcRequest struct {
+	ID        uint64
+	Method    rpcMethod
+	RequestID string
+	Replicate ReplicateRequest
+	Announce  Leadership
+}
+
+// / One frame of an answer. Every call ends on a frame with Done set.
+type rpcResponse struct {
+	ID     uint64
+	Error  string
+	Done   bool
+	Status NodeStatus
+	Part   snapshotPart
+}
+
+// / A slice of a streamed snapshot: a single deck, or the other state on the last frame
+type snapshotPart struct {
+	User        string
+	Cards       []Card
+	Trades      map[int]TradeRequest
+	NextTradeID int
+	Escrows     map[int]Escrow
+	Swaps       map[int]SwapResult
+
+	Webhooks      []Webhook
+	NextWebhookID int
+	DeadLetters   []DeadLetter
+	Limits        map[string]time.Time
+	Versions      map[string]uint64
+	Term          uint64
+	Index         uint64
+}
+
+var errConnectionLost = errors.New("rpc: connection lost")
+
+type GobTransport struct {
+	timeout time.Duration
+
+	mu    sync.Mutex
+	conns map[Address]*rpcConn
+}
+
+func NewGobTransport(timeout time.Duration) *GobTransport {
+	return &GobTransport{
+		timeout: timeout,
+		conns:   make(map[Address]*rpcConn),
+	}
+}
+
+type rpcConn struct {
+	conn    net.Conn
+	timeout time.Duration
+
+	writeMu sync.Mutex
+	encoder *gob.Encoder
+	decoder *gob.Decoder
+
+	mu      sync.Mutex
+	nextID  uint64
+	pending map[uint64]*rpcCall
+	broken  bool
+}
+
+type rpcCall struct {
+	frames    chan rpcResponse
+	abandoned chan struct{}
+}
+
+func (transport *GobTransport) Replicate(ctx context.Context, peer Address, request ReplicateRequest) error {
+	frames, err := transport.call(ctx, peer, rpcRequest{Method: rpcReplicate, Replicate: request})
+	if err != nil {
+		return err
+	}
+	_, err = lastFrame(frames)
+	return err
+}
+
+func (transport *GobTransport) Announce(ctx context.Context, peer Address, leadership Leadership) error {
+	frames, err := transport.call(ctx, peer, rpcRequest{Method: rpcAnnounce, Announce: leadership})
+	if err != nil {
+		return err
+	}
+	_, err = lastFrame(frames)
+	return err
+}
+
+func (transport *GobTransport) Status(ctx context.Context, peer Address) (NodeStatus, error) {
+	frames, err := transport.call(ctx, peer, rpcRequest{Method: rpcStatus})
+	if err != nil {
+		return NodeStatus{}, err
+	}
+	frame, err := lastFrame(frames)
+	return frame.Status, err
+}
+
+func (transport *GobTransport) Snapshot(ctx context.Context, peer Address) (Snapshot, error) {
+	snap := Snapshot{Users: make(map[string][]Card)}
+
+	frames, err := transport.call(ctx, peer, rpcRequest{Method: rpcSnapshot})
+	if err != nil {
+		return snap, err
+	}
+
+	for frame := range frames {
+		if frame.Error != "" {
+			return snap, errors.New(frame.Error)
+		}
+
+		part := frame.Part
+		if part.User == "" {
+			snap.Global = append(snap.Global, part.Cards...)
+		} else {
+			snap.Users[part.User] = append(snap.Users[part.User], part.Cards...)
+		}
+
+		if frame.Done {
+			snap.Trades = part.Trades
+			snap.NextTradeID = part.NextTradeID
+			snap.Escrows = part.Escrows
+			snap.Swaps = part.Swaps
+			snap.Webhooks = part.Webhooks
+			snap.NextWebhookID = part.NextWebhookID
+			snap.DeadLetters = part.DeadLetters
+			snap.Limits = part.Limits
+			snap.Versions = part.Versions
+			snap.Term = part.Term
+			snap.Index = part.Index
+			return snap, nil
+		}
+	}
+	return snap, errConnectionLost
+}
+
+// / Wait for the final frame of a single-frame call
+func lastFrame(frames <-chan rpcResponse) (rpcResponse, error) {
+	for frame := range frames {
+		if frame.Error != "" {
+			return frame, errors.New(frame.Error)
+		}
+		if frame.Done {
+			return frame, nil
+		}
+	}
+	return rpcResponse{}, errConnectionLost
+}
+
+// / Send a request and return the channel its frames arrive on.
+// /
+// / The channel is closed after the Done frame, or early if the connection
+// / drops. Leaving ctx abandons the call without waiting for the peer.
+func (transport *GobTransport) call(ctx context.Context, peer Address, request rpcRequest) (<-chan rpcResponse, error) {
+	conn, err := transport.connection(peer)
+	if err != nil {
+		return nil, err
+	}
+
+	request.RequestID = requestIDFrom(ctx)
+	call, err := conn.send(&request)
+	if err != nil {
+		transport.drop(peer, conn)
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, transport.timeout)
+	frames := make(chan rpcResponse, 1)
+	go func() {
+		defer cancel()
+		defer close(frames)
+		for {
+			select {
+			case frame, ok := <-call.frames:
+				if !ok {
+					return
+				}
+				select {
+				case frames <- frame:
+				case <-ctx.Done():
+					conn.abandon(request.ID, call)
+					return
+				}
+			case <-ctx.Done():
+				conn.abandon(request.ID, call)
+				select {
+				case frames <- rpcResponse{Error: fmt.Sprintf("rpc: %v", ctx.Err()), Done: true}:
+				default:
+				}
+				return
+			}
+		}
+	}()
+	return frames, nil
+}
+
+func (transport *GobTransport) connection(peer Address) (*rpcConn, error) {
+	transport.mu.Lock()
+	if conn, ok := transport.conns[peer]; ok && !conn.isBroken() {
+		transport.mu.Unlock()
+		return conn, nil
+	}
+	transport.mu.Unlock()
+
+	// dial without the lock, so a dead peer does not hold back the others
+	conn, err := dialRPC(peer, transport.timeout)
+	if err != nil {
+		return nil, err
+	}
+
+	transport.mu.Lock()
+	if existing, ok := transport.conns[peer]; ok && !existing.isBroken() {
+		transport.mu.Unlock()
+		conn.conn.Close()
+		return existing, nil
+	}
+	transport.conns[peer] = conn
+	transport.mu.Unlock()
+
+	go func() {
+		conn.readLoop()
+		transport.drop(peer, conn)
+	}()
+	return conn, nil
+}
+
+func (transport *GobTransport) drop(peer Address, conn *rpcConn) {
+	transport.mu.Lock()
+	if transport.conns[peer] == conn {
+		delete(transport.conns, peer)
+	}
+	transport.mu.Unlock()
+	conn.conn.Close()
+}
+
+// / Open a connection to peer and upgrade it to the gob protocol
+func dialRPC(peer Address, timeout time.Duration) (*rpcConn, error) {
+	target, err := url.Parse(peer)
+	if err != nil || target.Host == "" {
+		return nil, fmt.Errorf("rpc: bad peer address %q", peer)
+	}
+
+	conn, err := net.DialTimeout("tcp", target.Host, timeout)
+	if err != nil {
+		return nil, err
+	}
+
+	conn.SetDeadline(time.Now().Add(timeout))
+	request, _ := http.NewRequest("GET", "http://"+target.Host+"/rpc", nil)
+	request.Header.Set("Connection", "Upgrade")
+	request.Header.Set("Upgrade", rpcProtocol)
+
+	if err := request.Write(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	reader := bufio.NewReader(conn)
+	response, err := http.ReadResponse(reader, request)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	response.Body.Close()
+	if response.StatusCode != http.StatusSwitchingProtocols {
+		conn.Close()
+		return nil, fmt.Errorf("rpc: %s refused upgrade: %s", peer, response.Status)
+	}
+	conn.SetDeadline(time.Time{})
+
+	rc := &rpcConn{
+		conn:    conn,
+		timeout: timeout,
+		encoder: gob.NewEncoder(conn),
+		pending: make(map[uint64]*rpcCall),
+		decoder: gob.NewDecoder(reader),
+	}
+	return rc, nil
+}
+
+func (conn *rpcConn) isBroken() bool {
+	conn.mu.Lock()
+	defer conn.mu.Unlock()
+	return conn.broken
+}
+
+// / Register a call, assign its ID and write the request
+func (conn *rpcConn) send(request *rpcRequest) (*rpcCall, error) {
+	call := &rpcCall{
+		frames:    make(chan rpcResponse),
+		abandoned: make(chan struct{}),
+	}
+
+	conn.mu.Lock()
+	if conn.broken {
+		conn.mu.Unlock()
+		return nil, errConnectionLost
+	}
+	conn.nextID++
+	request.ID = conn.nextID
+	conn.pending[request.ID] = call
+	conn.mu.Unlock()
+
+	conn.writeMu.Lock()
+	conn.conn.SetWriteDeadline(time.Now().Add(conn.timeout))
+	err := conn.encoder.Encode(request)
+	conn.writeMu.Unlock()
+
+	if err != nil {
+		conn.abandon(request.ID, call)
+		return nil, err
+	}
+	return call, nil
+}
+
+func (conn *rpcConn) abandon(id uint64, call *rpcCall) {
+	conn.mu.Lock()
+	defer conn.mu.Unlock()
+
+	if conn.pending[id] == call {
+		delete(conn.pending, id)
+		close(call.abandoned)
+	}
+}
+
+// / Dispatch incoming frames to their calls until the connection fails
+func (conn *rpcConn) readLoop() {
+	for {
+		var frame rpcResponse
+		if err := conn.decoder.Decode(&frame); err != nil {
+			break
+		}
+
+		conn.mu.Lock()
+		call, ok := conn.pending[frame.ID]
+		if ok && frame.Done {
+			delete(conn.pending, frame.ID)
+		}
+		conn.mu.Unlock()
+
+		if !ok {
+			continue
+		}
+
+		select {
+		case call.frames <- frame:
+		case <-call.abandoned:
+		}
+		if frame.Done {
+			close(call.frames)
+		}
+	}
+
+	conn.mu.Lock()
+	conn.broken = true
+	pending := conn.pending
+	conn.pending = make(map[uint64]*rpcCall)
+	conn.mu.Unlock()
+
+	for _, call := range pending {
+		close(call.frames)
+	}
+}
+
+// / Serve the gob protocol on an upgraded peer connection
+func (node *Node) handleRPC(writer http.ResponseWriter, request *http.Request) {
+	if request.Header.Get("Upgrade") != rpcProtocol {
+		http.Error(writer, "expected Upgrade: "+rpcProtocol, http.StatusBadRequest)
+		return
+	}
+
+	hijacker, ok := writer.(http.Hijacker)
+	if !ok {
+		http.Error(writer, "connection cannot be upgraded", http.StatusInternalServerError)
+		return
+	}
+
+	conn, buffer, err := hijacker.Hijack()
+	if err != nil {
+		node.logger.Error("rpc: hijack failed", "error", err)
+		return
+	}
+	defer conn.Close()
+
+	buffer.WriteString("HTTP/1.1 101 Switching Protocols\r\n")
+	buffer.WriteString("Connection: Upgrade\r\n")
+	buffer.WriteString("Upgrade: " + rpcProtocol + "\r\n\r\n")
+	if err := buffer.Flush(); err != nil {
+		return
+	}
+
+	var writeMu sync.Mutex
+	encoder := gob.NewEncoder(conn)
+	reply := func(frame rpcResponse) error {
+		writeMu.Lock()
+		defer writeMu.Unlock()
+		return encoder.Encode(frame)
+	}
+
+	decoder := gob.NewDecoder(buffer.Reader)
+	for {
+		var call rpcRequest
+		if err := decoder.Decode(&call); err != nil {
+			return
+		}
+
+		ctx := withRequestID(context.Background(), call.RequestID)
+
+		switch call.Method {
+		case rpcReplicate:
+			// applied in order, so replication keeps the sending order
+			frame := rpcResponse{ID: call.ID, Done: true}
+			if err := node.applyReplicate(ctx, call.Replicate); err != nil {
+				frame.Error = err.Error()
+			}
+			reply(frame)
+		case rpcStatus:
+			reply(rpcResponse{ID: call.ID, Done: true, Status: node.status()})
+		case rpcAnnounce:
+			frame := rpcResponse{ID: call.ID, Done: true}
+			if err := node.adopt(call.Announce); err != nil {
+				frame.Error = err.Error()
+			}
+			reply(frame)
+		case rpcSnapshot:
+			go node.streamSnapshot(call.ID, reply)
+		default:
+			reply(rpcResponse{ID: call.ID, Done: true, Error: "unknown method"})
+		}
+	}
+}
+
+// / Send the snapshot one deck per frame, the other state on the final
+// / frame. Like GET /snapshot, it leaves webhook secrets out.
+func (node *Node) streamSnapshot(id uint64, reply func(rpcResponse) error) {
+	snap, err := node.buildSnapshot()
+	if err != nil {
+		reply(rpcResponse{ID: id, Done: true, Error: err.Error()})
+		return
+	}
+
+	if err := reply(rpcResponse{ID: id, Part: snapshotPart{Cards: snap.Global}}); err != nil {
+		return
+	}
+	for user, cards := range snap.Users {
+		if err := reply(rpcResponse{ID: id, Part: snapshotPart{User: user, Cards: cards}}); err != nil {
+			return
+		}
+	}
+	reply(rpcResponse{
+		ID:   id,
+		Done: true,
+		Part: snapshotPart{
+			Trades:        snap.Trades,
+			NextTradeID:   snap.NextTradeID,
+			Escrows:       snap.Escrows,
+			Swaps:         snap.Swaps,
+			Webhooks:      withoutSecrets(snap.Webhooks),
+			NextWebhookID: snap.NextWebhookID,
+			DeadLetters:   snap.DeadLetters,
+			Limits:        snap.Limits,
+			Versions:      snap.Versions,
+			Term:          snap.Term,
+			Index:         snap.Index,
+		},
+	})
+}
@@ -4,6 +4,12 @@ import "github.com/gin-gonic/gin"
 
 // / Add Routes to a Node
 func (node *Node) AddRoutes(router *gin.Engine) {
+	router.Use(
+		node.requestID(),
+		node.accessLog(),
+		node.metrics.registry.instrument(node.metrics.requestLatency),
+	)
+
 	// -- Frontend pages --
 
 	router.Static("/decks/static", "./decks/frontend")
@@ -20,23 +26,53 @@ func (node *Node) AddRoutes(router *gin.Engine) {
 		c.File("./decks/frontend/trade.html")
 	})
 
+	// writes wait here while the leader hands over, see WriteGate
+	writes := router.Group("", node.holdWrites())
+
+	// requests about a user of another shard go to that shard, see routeTo
+	byUser := node.routeTo(node.userShard)
+
 	// -- User endpoints --
-	router.GET("/users/:user/claim", gin.WrapF(node.handleClaim))
-	router.GET("/users/:user/cards", gin.WrapF(node.handleGetCards))
+	writes.GET("/users/:user/claim", byUser, gin.WrapF(node.handleClaim))
+	router.GET("/users/:user/cards", byUser, gin.WrapF(node.handleGetCards))
+	router.GET("/users/:user/events", byUser, gin.WrapF(node.handleEvents))
 
-	router.POST("/trade", gin.WrapF(node.handleTrade))
-	router.POST("/trade/:id/accept", gin.WrapF(node.handleTradeAccept))
+	writes.POST("/trade", node.routeTo(node.proposalShard), gin.WrapF(node.handleTrade))
+	writes.POST("/trade/:id/accept", node.routeTo(node.tradeShard), gin.WrapF(node.handleTradeAccept))
 
 	// -- Admin endpoints --
 	router.GET("/cards", gin.WrapF(node.handleGetCards))
-	router.POST("/cards", gin.WrapF(node.handlePostCard))
-	router.DELETE("/cards/:id", gin.WrapF(node.handleDeleteCard))
+	writes.POST("/cards", gin.WrapF(node.handlePostCard))
+	writes.DELETE("/cards/:id", gin.WrapF(node.handleDeleteCard))
+
+	writes.POST("/users/:user/cards", byUser, gin.WrapF(node.handlePostCard))
+	writes.DELETE("/users/:user/cards/:id", byUser, gin.WrapF(node.handleDeleteCard))
 
-	router.POST("/users/:user/cards", gin.WrapF(node.handlePostCard))
-	router.DELETE("/users/:user/cards/:id", gin.WrapF(node.handleDeleteCard))
+	writes.POST("/admin/import", gin.WrapF(node.handleImport))
+	router.GET("/admin/export", node.routeTo(node.exportShard), gin.WrapF(node.handleExport))
+
+	router.GET("/admin/webhooks", gin.WrapF(node.handleGetWebhooks))
+	writes.POST("/admin/webhooks", gin.WrapF(node.handlePostWebhook))
+	writes.DELETE("/admin/webhooks/:id", gin.WrapF(node.handleDeleteWebhook))
+	router.GET("/admin/webhooks/dead-letters", gin.WrapF(node.handleGetDeadLetters))
 
 	// -- Peer endpoints --
 	router.GET("/status", gin.WrapF(node.handleStatus))
+	router.GET("/cluster", gin.WrapF(node.handleCluster))
 	router.GET("/snapshot", gin.WrapF(node.handleSnapshot))
 	router.POST("/replicate", gin.WrapF(node.handleReplicate))
+	router.POST("/leader", gin.WrapF(node.handleLeader))
+	router.GET("/rpc", gin.WrapF(node.handleRPC))
+
+	// -- Shard endpoints --
+	router.GET("/shards", gin.WrapF(node.handleShards))
+	writes.POST("/shards/swap", gin.WrapF(node.handleShardSwap))
+	router.GET("/shards/escrows/:id", gin.WrapF(node.handleShardEscrow))
+	writes.POST("/shards/events", gin.WrapF(node.handleShardEvent))
+
+	// -- Observability --
+	router.GET("/healthz", gin.WrapF(node.handleHealthz))
+	router.GET("/readyz", gin.WrapF(node.handleReadyz))
+	router.GET("/metrics", gin.WrapF(node.metrics.registry.handleMetrics))
+	router.GET("/openapi.json", gin.WrapF(handleOpenAPI))
 }
@@ -0,0 +1,672 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"net/http"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Points every shard owns on the ring; more points spread users more evenly.
+const ringReplicas = 64
+
+// Header set on requests routed to another shard, so they are never routed twice.
+const shardHeader = "X-Decks-Shard"
+
+// / Consistent hash ring placing users on shards.
+// /
+// / A user belongs to the shard of the first point at or after the
+// / hash of its name. Adding a shard only moves the users that fall
+// / just before its points, the others stay where they are.
+type Ring struct {
+	// sorted, so trade IDs map to the same shard on every node
+	shards []string
+	points []ringPoint
+}
+
+type ringPoint struct {
+	hash  uint64
+	shard string
+}
+
+func NewRing(shards []string) *Ring {
+	ring := &Ring{shards: slices.Sorted(slices.Values(shards))}
+	for _, shard := range ring.shards {
+		for i := range ringReplicas {
+			ring.points = append(ring.points, ringPoint{ringHash(shard + "#" + strconv.Itoa(i)), shard})
+		}
+	}
+	slices.SortFunc(ring.points, func(a, b ringPoint) int {
+		if a.hash != b.hash {
+			return compareUint64(a.hash, b.hash)
+		}
+		return strings.Compare(a.shard, b.shard)
+	})
+	return ring
+}
+
+func ringHash(key string) uint64 {
+	sum := sha256.Sum256([]byte(key))
+	return binary.BigEndian.Uint64(sum[:8])
+}
+
+func compareUint64(a, b uint64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+// / Shard holding the decks of user
+func (ring *Ring) Shard(user string) string {
+	hash := ringHash(user)
+	i := sort.Search(len(ring.points), func(i int) bool { return ring.points[i].hash >= hash })
+	if i == len(ring.points) {
+		i = 0
+	}
+	return ring.points[i].shard
+}
+
+// / Shard that allocated a trade ID: each shard only hands out the IDs
+// / equal to its position modulo the number of shards
+func (ring *Ring) TradeShard(id int) string {
+	return ring.shards[id%len(ring.shards)]
+}
+
+// / Members of the other shards, and the leader last seen for each one
+type shardRouter struct {
+	members map[string][]Address
+	// no timeout: event streams are proxied for as long as they last
+	client *http.Client
+
+	mu      sync.Mutex
+	leaders map[string]Address
+}
+
+func newShardRouter(members map[string][]Address) *shardRouter {
+	return &shardRouter{
+		members: members,
+		client:  &http.Client{},
+		leaders: make(map[string]Address),
+	}
+}
+
+// / Leader of shard, asked to its members unless known already or refresh is set
+func (node *Node) shardLeader(ctx context.Context, shard string, refresh bool) (Address, error) {
+	router := node.router
+	router.mu.Lock()
+	leader := router.leaders[shard]
+	router.mu.Unlock()
+	if leader != "" && !refresh {
+		return leader, nil
+	}
+
+	var errs []error
+	for _, member := range router.members[shard] {
+		ctx, cancel := context.WithTimeout(ctx, node.client.Timeout)
+		status, err := node.transport.Status(ctx, member)
+		cancel()
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if status.LeaderAddr == "" {
+			continue
+		}
+
+		router.mu.Lock()
+		router.leaders[shard] = status.LeaderAddr
+		router.mu.Unlock()
+		return status.LeaderAddr, nil
+	}
+	return "", fmt.Errorf("no leader found for shard %s: %w", shard, errors.Join(errs...))
+}
+
+func (node *Node) sharded() bool {
+	return node.ring != nil
+}
+
+// / Shard holding the decks of user; the global deck is in every shard
+func (node *Node) shardOf(user string) string {
+	if node.ring == nil || user == "" {
+		return node.config.Shard
+	}
+	return node.ring.Shard(user)
+}
+
+// / Shard of the user named in the path, ?user= or X-User
+func (node *Node) userShard(request *http.Request) string {
+	return node.shardOf(getUserFromRequest(request))
+}
+
+// / Shard of the deck selected by ?owner= on an export; a full export stays here
+func (node *Node) exportShard(request *http.Request) string {
+	return node.shardOf(request.URL.Query().Get("owner"))
+}
+
+// / Shard of the proposer of a trade, which keeps the proposal
+func (node *Node) proposalShard(request *http.Request) string {
+	body, _ := io.ReadAll(request.Body)
+	request.Body = io.NopCloser(bytes.NewReader(body))
+
+	// a malformed proposal is rejected by the handler
+	var trade TradeRequest
+	json.Unmarshal(body, &trade)
+	return node.shardOf(trade.UserA)
+}
+
+// / Shard that allocated the trade ID in /trade/:id/accept
+func (node *Node) tradeShard(request *http.Request) string {
+	parts := strings.Split(strings.Trim(request.URL.Path, "/"), "/")
+	if node.ring == nil || len(parts) < 2 {
+		return node.config.Shard
+	}
+	id, err := strconv.Atoi(parts[1])
+	if err != nil || id < 0 {
+		return node.config.Shard
+	}
+	return node.ring.TradeShard(id)
+}
+
+// / Send the requests that belong to another shard to its leader.
+// /
+// / shardOf names the shard of a request; requests for the shard of
+// / this node go on to the handler.
+func (node *Node) routeTo(shardOf func(*http.Request) string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !node.sharded() {
+			return
+		}
+		shard := shardOf(c.Request)
+		if shard == node.config.Shard {
+			return
+		}
+
+		// the sender places users differently: its shards do not match ours
+		if from := c.Request.Header.Get(shardHeader); from != "" {
+			http.Error(c.Writer, fmt.Sprintf("routed by shard %s to shard %s, but it belongs to shard %s", from, node.config.Shard, shard), http.StatusMisdirectedRequest)
+			c.Abort()
+			return
+		}
+
+		node.forwardToShard(c.Writer, c.Request, shard)
+		c.Abort()
+	}
+}
+
+// / Proxy a request to the leader of shard, streaming the answer back.
+// /
+// / A leader that does not answer is looked up again once.
+func (node *Node) forwardToShard(writer http.ResponseWriter, request *http.Request, shard string) {
+	ctx := request.Context()
+	body, _ := io.ReadAll(request.Body)
+
+	var response *http.Response
+	var err error
+	for attempt := range 2 {
+		var leader Address
+		if leader, err = node.shardLeader(ctx, shard, attempt > 0); err != nil {
+			break
+		}
+
+		url := strings.TrimRight(leader, "/") + request.URL.RequestURI()
+		node.log(ctx).Info("shard: routing", "shard", shard, "leader", leader, "method", request.Method, "path", request.URL.Path)
+
+		response, err = node.sendToShard(ctx, request.Method, url, request.Header, body)
+		if err == nil {
+			break
+		}
+	}
+	if err != nil {
+		node.metrics.shardForwards.Inc(shard, "failure")
+		http.Error(writer, fmt.Sprintf("shard %s unreachable: %s", shard, err), http.StatusServiceUnavailable)
+		return
+	}
+	defer response.Body.Close()
+	node.metrics.shardForwards.Inc(shard, "success")
+
+	for k, v := range response.Header {
+		writer.Header()[k] = v
+	}
+	writer.WriteHeader(response.StatusCode)
+	copyFlushing(writer, response.Body)
+}
+
+// / Send a request to another shard.
+// /
+// / The client timeout covers the whole answer, except for event
+// / streams, which last as long as the request that opened them.
+func (node *Node) sendToShard(ctx context.Context, method, url string, header http.Header, body []byte) (*http.Response, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	deadline := time.AfterFunc(node.client.Timeout, cancel)
+
+	request, err := http.NewRequestWithContext(ctx, method, url, bytes.NewReader(body))
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	if header != nil {
+		request.Header = header.Clone()
+	}
+	request.Header.Set(shardHeader, node.config.Shard)
+	propagateRequestID(ctx, request)
+
+	response, err := node.router.client.Do(request)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	if strings.HasPrefix(response.Header.Get("Content-Type"), "text/event-stream") {
+		deadline.Stop()
+	}
+	response.Body = cancelOnClose{response.Body, cancel}
+	return response, nil
+}
+
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (body cancelOnClose) Close() error {
+	defer body.cancel()
+	return body.ReadCloser.Close()
+}
+
+// / Copy body, flushing after every read so streamed events are not held back
+func copyFlushing(writer http.ResponseWriter, body io.Reader) {
+	flusher, _ := writer.(http.Flusher)
+	buffer := make([]byte, 32*1024)
+	for {
+		n, err := body.Read(buffer)
+		if n > 0 {
+			if _, err := writer.Write(buffer[:n]); err != nil {
+				return
+			}
+			if flusher != nil {
+				flusher.Flush()
+			}
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// / POST a JSON body to the leader of shard and decode its JSON answer into out
+func (node *Node) postToShard(ctx context.Context, shard, path string, body, out any) error {
+	return node.askShard(ctx, "POST", shard, path, body, out)
+}
+
+// / Send a request to the leader of shard, with a JSON body unless body
+// / is nil, and decode its JSON answer into out
+func (node *Node) askShard(ctx context.Context, method, shard, path string, body, out any) error {
+	var data []byte
+	var err error
+	header := http.Header{}
+	if body != nil {
+		if data, err = json.Marshal(body); err != nil {
+			return err
+		}
+		header.Set("Content-Type", "application/json")
+	}
+
+	for attempt := range 2 {
+		var leader Address
+		if leader, err = node.shardLeader(ctx, shard, attempt > 0); err != nil {
+			return err
+		}
+
+		var response *http.Response
+		response, err = node.sendToShard(ctx, method, strings.TrimRight(leader, "/")+path, header, data)
+		if err != nil {
+			continue
+		}
+		defer response.Body.Close()
+
+		if response.StatusCode != http.StatusOK {
+			message, _ := io.ReadAll(response.Body)
+			return fmt.Errorf("shard %s: %s %s", shard, response.Status, strings.TrimSpace(string(message)))
+		}
+		if out == nil {
+			return nil
+		}
+		return json.NewDecoder(response.Body).Decode(out)
+	}
+	return err
+}
+
+// / Shards of the cluster, and where a user lives
+type ShardView struct {
+	Shard  string               `json:"shard"`
+	Shards map[string][]Address `json:"shards"`
+	// Shard of the user given in ?user=
+	User      string `json:"user,omitempty"`
+	UserShard string `json:"user_shard,omitempty"`
+}
+
+// / Describe the shards, and the shard of a user.
+// /
+// / Example:
+// / GET /shards?user=alice
+func (node *Node) handleShards(writer http.ResponseWriter, request *http.Request) {
+	view := ShardView{Shard: node.config.Shard, Shards: node.config.Shards}
+	if view.Shards == nil {
+		view.Shards = map[string][]Address{}
+	}
+	if user := request.URL.Query().Get("user"); user != "" {
+		view.User = user
+		view.UserShard = node.shardOf(user)
+	}
+
+	writer.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(writer).Encode(view)
+}
+
+// / Answer of the shard of the counterparty of a trade: the card it
+// / gave in exchange, or why it refused
+type SwapResult struct {
+	Card   Card   `json:"card"`
+	Reason string `json:"reason,omitempty"`
+}
+
+// / Card taken from the proposer of a trade while the counterparty,
+// / on another shard, swaps it for its own
+type Escrow struct {
+	TradeID int          `json:"trade_id"`
+	Trade   TradeRequest `json:"trade"`
+	Card    Card         `json:"card"`
+}
+
+// / What the shard of a proposer asks the shard of the counterparty
+type ShardSwap struct {
+	TradeID int          `json:"trade_id"`
+	Trade   TradeRequest `json:"trade"`
+	// Card given to the counterparty
+	Card Card `json:"card"`
+}
+
+var (
+	errSwapRefused = errors.New("swap refused")
+	errSettling    = errors.New("trade is already settling")
+)
+
+// / Give the card of the counterparty for card, on its own shard.
+// /
+// / Called by the shard holding the trade. The trade and the card must
+// / be those of the escrow that shard keeps for the trade ID, so nobody
+// / can give the counterparty another card. The swap is one replicated
+// / operation, and its result is kept until the trade is settled: asking
+// / again for the same trade gives the same answer and moves nothing.
+// /
+// / Example:
+// / POST /shards/swap {"trade_id":4,"trade":{...},"card":{"id":1,"name":"ace"}}
+func (node *Node) handleShardSwap(writer http.ResponseWriter, request *http.Request) {
+	if !node.isLeader() {
+		node.forwardToLeader(writer, request)
+		return
+	}
+	if !node.sharded() {
+		http.Error(writer, "this node is not sharded", http.StatusMisdirectedRequest)
+		return
+	}
+
+	var swap ShardSwap
+	if err := json.NewDecoder(request.Body).Decode(&swap); err != nil {
+		http.Error(writer, "invalid json", http.StatusBadRequest)
+		return
+	}
+	if shard := node.shardOf(swap.Trade.UserB); shard != node.config.Shard {
+		http.Error(writer, fmt.Sprintf("user %s belongs to shard %s", swap.Trade.UserB, shard), http.StatusMisdirectedRequest)
+		return
+	}
+
+	ctx := request.Context()
+	node.mu.RLock()
+	result, swapped := node.swaps[swap.TradeID]
+	node.mu.RUnlock()
+
+	if !swapped {
+		escrow, err := node.escrowOf(ctx, swap.TradeID)
+		switch {
+		case err != nil:
+			http.Error(writer, "failed to read the escrow: "+err.Error(), http.StatusBadGateway)
+			return
+		case escrow == nil:
+			http.Error(writer, fmt.Sprintf("no card in escrow for trade %d", swap.TradeID), http.StatusConflict)
+			return
+		case escrow.Trade != swap.Trade || escrow.Card != swap.Card:
+			http.Error(writer, fmt.Sprintf("trade %d does not match its escrow", swap.TradeID), http.StatusConflict)
+			return
+		}
+
+		err = node.commit(ctx, ReplicateRequest{Op: "trade_swap", TradeID: escrow.TradeID, Trade: &escrow.Trade, Card: escrow.Card})
+		if err != nil {
+			http.Error(writer, "failed to swap: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		node.mu.RLock()
+		result = node.swaps[swap.TradeID]
+		node.mu.RUnlock()
+	}
+
+	writer.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(writer).Encode(result)
+}
+
+// / Card this shard holds in escrow for a trade, null when it holds none
+// /
+// / Example:
+// / GET /shards/escrows/4
+func (node *Node) handleShardEscrow(writer http.ResponseWriter, request *http.Request) {
+	parts := strings.Split(strings.Trim(request.URL.Path, "/"), "/")
+	id, err := strconv.Atoi(parts[len(parts)-1])
+	if err != nil {
+		http.Error(writer, "invalid trade id", http.StatusBadRequest)
+		return
+	}
+
+	if !node.isLeader() {
+		node.forwardToLeader(writer, request)
+		return
+	}
+
+	node.mu.RLock()
+	escrow, held := node.escrows[id]
+	node.mu.RUnlock()
+
+	writer.Header().Set("Content-Type", "application/json")
+	if !held {
+		json.NewEncoder(writer).Encode(nil)
+		return
+	}
+	json.NewEncoder(writer).Encode(escrow)
+}
+
+// / Escrow kept for a trade by the shard that allocated its ID, nil once
+// / the trade is settled
+func (node *Node) escrowOf(ctx context.Context, id int) (*Escrow, error) {
+	var escrow *Escrow
+	err := node.askShard(ctx, "GET", node.ring.TradeShard(id), "/shards/escrows/"+strconv.Itoa(id), nil, &escrow)
+	return escrow, err
+}
+
+// / Publish an event of a user of this shard, raised by another shard.
+// /
+// / Example:
+// / POST /shards/events {"type":"trade_proposed","user":"bob",...}
+func (node *Node) handleShardEvent(writer http.ResponseWriter, request *http.Request) {
+	if !node.isLeader() {
+		node.forwardToLeader(writer, request)
+		return
+	}
+
+	var event Event
+	if err := json.NewDecoder(request.Body).Decode(&event); err != nil {
+		http.Error(writer, "invalid json", http.StatusBadRequest)
+		return
+	}
+	if shard := node.shardOf(event.User); shard != node.config.Shard {
+		http.Error(writer, fmt.Sprintf("user %s belongs to shard %s", event.User, shard), http.StatusMisdirectedRequest)
+		return
+	}
+
+	// replicated, so subscribers of every node of the shard get it
+	if err := node.commit(request.Context(), ReplicateRequest{Op: "relay", User: event.User, Event: &event}); err != nil {
+		http.Error(writer, "failed to publish: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writer.WriteHeader(http.StatusOK)
+}
+
+// / Hand an event over to the shard of its user, in the background.
+// /
+// / Events are best effort: one that cannot be delivered is logged.
+func (node *Node) relayEvent(ctx context.Context, shard string, event Event) {
+	ctx = context.WithoutCancel(ctx)
+	go func() {
+		if err := node.postToShard(ctx, shard, "/shards/events", event, nil); err != nil {
+			node.log(ctx).Warn("shard: failed to relay event", "shard", shard, "type", event.Type, "user", event.User, "error", err)
+		}
+	}()
+}
+
+// / Accept a trade whose counterparty lives on another shard.
+// /
+// / The card of the proposer goes to escrow first, then the shard of
+// / the counterparty swaps it for the other card. Until that shard
+// / answers, the card stays in escrow and the trade is settled later by
+// / settleEscrows, so neither side loses a card whatever fails.
+func (node *Node) acceptAcrossShards(writer http.ResponseWriter, request *http.Request, id int, trade *TradeRequest) {
+	ctx := request.Context()
+
+	card, ok, err := node.store.Get(trade.UserA, trade.ACardID)
+	if err != nil {
+		node.log(ctx).Error("trade: failed to read the decks", "trade", id, "error", err)
+	}
+	if ok {
+		err = node.commit(ctx, ReplicateRequest{Op: "trade_escrow", TradeID: id, Trade: trade, User: trade.UserA, Card: card})
+	}
+
+	// the card may have left the deck since it was read
+	node.mu.RLock()
+	escrow, held := node.escrows[id]
+	node.mu.RUnlock()
+	if !held {
+		if err := node.commit(ctx, ReplicateRequest{Op: "trade_cancel", TradeID: id, Trade: trade, Reason: "one or both cards not found"}); err != nil {
+			http.Error(writer, "failed to cancel trade", http.StatusInternalServerError)
+			return
+		}
+		http.Error(writer, "one or both cards not found", http.StatusBadRequest)
+		return
+	}
+
+	received, err := node.settle(ctx, escrow)
+	writer.Header().Set("Content-Type", "application/json")
+	switch {
+	case errors.Is(err, errSwapRefused):
+		http.Error(writer, "one or both cards not found", http.StatusBadRequest)
+	case err != nil:
+		// settled later, the users are told by their events
+		node.log(ctx).Warn("trade: settling later", "trade", id, "error", err)
+		writer.WriteHeader(http.StatusAccepted)
+		json.NewEncoder(writer).Encode(map[string]any{"trade_id": id, "status": "settling"})
+	default:
+		json.NewEncoder(writer).Encode(map[string]Card{"user_a_received": received, "user_b_received": escrow.Card})
+	}
+}
+
+// / Ask the shard of the counterparty to swap, and settle the escrow
+// / when it answers: the proposer gets the other card, or its own back.
+// /
+// / Returns the card received, errSwapRefused when the trade was
+// / cancelled, or another error when it is still in escrow.
+func (node *Node) settle(ctx context.Context, escrow Escrow) (Card, error) {
+	if _, busy := node.settling.LoadOrStore(escrow.TradeID, true); busy {
+		return Card{}, errSettling
+	}
+	defer node.settling.Delete(escrow.TradeID)
+
+	var result SwapResult
+	swap := ShardSwap{TradeID: escrow.TradeID, Trade: escrow.Trade, Card: escrow.Card}
+	if err := node.postToShard(ctx, node.shardOf(escrow.Trade.UserB), "/shards/swap", swap, &result); err != nil {
+		return Card{}, err
+	}
+
+	trade := escrow.Trade
+	if result.Reason != "" {
+		node.commit(ctx, ReplicateRequest{Op: "trade_cancel", TradeID: escrow.TradeID, Trade: &trade, Reason: result.Reason})
+		return Card{}, fmt.Errorf("%w: %s", errSwapRefused, result.Reason)
+	}
+	if err := node.commit(ctx, ReplicateRequest{Op: "trade_accept", TradeID: escrow.TradeID, Trade: &trade, Card: result.Card}); err != nil {
+		return Card{}, err
+	}
+	return result.Card, nil
+}
+
+// / Retry the trades left in escrow, on the leader
+func (node *Node) settleEscrows() {
+	if !node.settlingAll.CompareAndSwap(false, true) {
+		return
+	}
+	defer node.settlingAll.Store(false)
+
+	node.mu.RLock()
+	escrows := make([]Escrow, 0, len(node.escrows))
+	for _, escrow := range node.escrows {
+		escrows = append(escrows, escrow)
+	}
+	node.mu.RUnlock()
+
+	ctx := context.Background()
+	for _, escrow := range escrows {
+		if _, err := node.settle(ctx, escrow); err != nil && !errors.Is(err, errSwapRefused) && !errors.Is(err, errSettling) {
+			node.logger.Warn("trade: escrow still pending", "trade", escrow.TradeID, "error", err)
+		}
+	}
+	node.forgetSettledSwaps(ctx)
+}
+
+// / Forget the swaps made here for trades the shard of the proposer
+// / settled since: with the escrow gone, it never asks for them again
+func (node *Node) forgetSettledSwaps(ctx context.Context) {
+	if !node.sharded() {
+		return
+	}
+
+	node.mu.RLock()
+	ids := slices.Collect(maps.Keys(node.swaps))
+	node.mu.RUnlock()
+
+	for _, id := range ids {
+		escrow, err := node.escrowOf(ctx, id)
+		if err != nil {
+			node.logger.Warn("trade: cannot tell if the swap is settled", "trade", id, "error", err)
+			continue
+		}
+		if escrow != nil {
+			continue
+		}
+		if err := node.commit(ctx, ReplicateRequest{Op: "trade_forget", TradeID: id}); err != nil {
+			node.logger.Warn("trade: failed to forget the swap", "trade", id, "error", err)
+		}
+	}
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestRingIgnoresShardOrder(t *testing.T) {
+	a := NewRing([]string{"s1", "s2", "s3"})
+	b := NewRing([]string{"s3", "s1", "s2"})
+	for i := range 1000 {
+		user := fmt.Sprintf("user%d", i)
+		if a.Shard(user) != b.Shard(user) {
+			t.Fatalf("%s is on %s and %s", user, a.Shard(user), b.Shard(user))
+		}
+	}
+	for id := range 10 {
+		if a.TradeShard(id) != b.TradeShard(id) {
+			t.Fatalf("trade %d is on %s and %s", id, a.TradeShard(id), b.TradeShard(id))
+		}
+	}
+}
+
+func TestRingSpreadsUsers(t *testing.T) {
+	shards := []string{"s1", "s2", "s3", "s4"}
+	ring := NewRing(shards)
+
+	const users = 10000
+	counts := map[string]int{}
+	for i := range users {
+		counts[ring.Shard(fmt.Sprintf("user%d", i))]++
+	}
+	for _, shard := range shards {
+		// an even share is 2500
+		if counts[shard] < users/len(shards)/2 {
+			t.Errorf("shard %s has %d of %d users", shard, counts[shard], users)
+		}
+	}
+}
+
+func TestAddingShardOnlyMovesUsersToIt(t *testing.T) {
+	before := NewRing([]string{"s1", "s2", "s3"})
+	after := NewRing([]string{"s1", "s2", "s3", "s4"})
+
+	const users = 10000
+	moved := 0
+	for i := range users {
+		user := fmt.Sprintf("user%d", i)
+		from, to := before.Shard(user), after.Shard(user)
+		if from == to {
+			continue
+		}
+		if to != "s4" {
+			t.Fatalf("%s moved from %s to %s", user, from, to)
+		}
+		moved++
+	}
+	// about a quarter of the users go to the new shard
+	if moved == 0 || moved > users/2 {
+		t.Fatalf("%d of %d users moved", moved, users)
+	}
+}
+
+func TestTradeShardOwnsItsIDs(t *testing.T) {
+	ring := NewRing([]string{"b", "c", "a"})
+	for id, want := range []string{"a", "b", "c", "a", "b", "c"} {
+		if got := ring.TradeShard(id); got != want {
+			t.Fatalf("trade %d is on %s, want %s", id, got, want)
+		}
+	}
+}
+
+// / Leaders of shards a and b, each serving its routes
+func shardPair(t *testing.T) (a, b *Node) {
+	t.Helper()
+	gin.SetMode(gin.TestMode)
+
+	servers := map[string]*httptest.Server{"a": httptest.NewUnstartedServer(nil), "b": httptest.NewUnstartedServer(nil)}
+	shards := map[string][]Address{}
+	for shard, server := range servers {
+		shards[shard] = []Address{"http://" + server.Listener.Addr().String()}
+	}
+
+	nodes := map[string]*Node{}
+	for shard, server := range servers {
+		config := DefaultConfig()
+		config.Address = shards[shard][0]
+		config.Peers = map[PeerID]Address{config.ID: config.Address}
+		config.Shard, config.Shards = shard, shards
+		node, err := NewNode(config, NewMemoryStorage())
+		if err != nil {
+			t.Fatal(err)
+		}
+		router := gin.New()
+		node.AddRoutes(router)
+		server.Config.Handler = router
+		server.Start()
+		t.Cleanup(server.Close)
+		nodes[shard] = node
+	}
+	return nodes["a"], nodes["b"]
+}
+
+// / First user placed on shard
+func userOn(ring *Ring, shard string) string {
+	for i := 0; ; i++ {
+		if user := fmt.Sprintf("user%d", i); ring.Shard(user) == shard {
+			return user
+		}
+	}
+}
+
+func TestShardSwapFollowsTheEscrow(t *testing.T) {
+	a, b := shardPair(t)
+	ctx := context.Background()
+	alice, bob := userOn(a.ring, "a"), userOn(a.ring, "b")
+	const id = 4 // allocated by shard a
+	trade := TradeRequest{UserA: alice, UserB: bob, ACardID: 1, BCardID: 2}
+
+	swapOnB := func(card Card) int {
+		body, _ := json.Marshal(ShardSwap{TradeID: id, Trade: trade, Card: card})
+		response, err := http.Post(b.addr+"/shards/swap", "application/json", bytes.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		response.Body.Close()
+		return response.StatusCode
+	}
+	if status := swapOnB(Card{ID: 1, Name: "ace"}); status != http.StatusConflict {
+		t.Fatalf("swap without an escrow: status %d, want 409", status)
+	}
+
+	a.commit(ctx, ReplicateRequest{Op: "add", User: alice, Card: Card{ID: 1, Name: "ace"}})
+	b.commit(ctx, ReplicateRequest{Op: "add", User: bob, Card: Card{ID: 2, Name: "king"}})
+	if err := a.commit(ctx, ReplicateRequest{Op: "trade_escrow", TradeID: id, Trade: &trade, User: alice, Card: Card{ID: 1, Name: "ace"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	if status := swapOnB(Card{ID: 99, Name: "forged"}); status != http.StatusConflict {
+		t.Fatalf("swap of another card than the escrowed one: status %d, want 409", status)
+	}
+	if cards, _ := b.store.List(bob); len(cards) != 1 || cards[0].ID != 2 {
+		t.Fatalf("bob has %v after a refused swap", cards)
+	}
+
+	received, err := a.settle(ctx, a.escrows[id])
+	if err != nil || received.ID != 2 {
+		t.Fatalf("settled with %v: %v", received, err)
+	}
+	if cards, _ := b.store.List(bob); len(cards) != 1 || cards[0].ID != 1 {
+		t.Fatalf("bob has %v after the swap", cards)
+	}
+
+	b.forgetSettledSwaps(ctx)
+	if len(b.swaps) != 0 {
+		t.Fatalf("swaps %v kept after the trade was settled", b.swaps)
+	}
+}
@@ -0,0 +1,290 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// / Leader chosen for a term, announced by the node handing leadership over
+type Leadership struct {
+	Term       uint64  `json:"term"`
+	LeaderID   PeerID  `json:"leader_id"`
+	LeaderAddr Address `json:"leader_addr"`
+}
+
+// / Gate in front of the write endpoints.
+// /
+// / While the leader hands over, new writes wait at the gate and the
+// / ones already inside are drained. Once released, the waiting writes
+// / go on, and are forwarded to the new leader.
+type WriteGate struct {
+	mu       sync.Mutex
+	held     chan struct{}
+	inflight sync.WaitGroup
+}
+
+// / Wait for the gate to be open and enter it
+func (gate *WriteGate) enter(ctx context.Context) error {
+	for {
+		gate.mu.Lock()
+		held := gate.held
+		if held == nil {
+			gate.inflight.Add(1)
+			gate.mu.Unlock()
+			return nil
+		}
+		gate.mu.Unlock()
+
+		select {
+		case <-held:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+func (gate *WriteGate) exit() {
+	gate.inflight.Done()
+}
+
+func (gate *WriteGate) hold() {
+	gate.mu.Lock()
+	defer gate.mu.Unlock()
+
+	if gate.held == nil {
+		gate.held = make(chan struct{})
+	}
+}
+
+func (gate *WriteGate) release() {
+	gate.mu.Lock()
+	defer gate.mu.Unlock()
+
+	if gate.held != nil {
+		close(gate.held)
+		gate.held = nil
+	}
+}
+
+// / Wait for the writes inside the gate to finish
+func (gate *WriteGate) drain(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		gate.inflight.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// / Middleware of the write endpoints, see WriteGate
+func (node *Node) holdWrites() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if err := node.writes.enter(c.Request.Context()); err != nil {
+			c.AbortWithStatus(http.StatusServiceUnavailable)
+			return
+		}
+		defer node.writes.exit()
+
+		c.Next()
+	}
+}
+
+// / Follow the leader of a term at least as recent as the current one
+func (node *Node) adopt(leadership Leadership) error {
+	node.mu.Lock()
+	if leadership.Term < node.term {
+		term := node.term
+		node.mu.Unlock()
+		return fmt.Errorf("stale leadership: term %d, this node is at term %d", leadership.Term, term)
+	}
+	previousID := node.leaderID
+	node.term = leadership.Term
+	node.leaderID = leadership.LeaderID
+	node.leaderAddr = leadership.LeaderAddr
+	node.mu.Unlock()
+
+	if previousID != leadership.LeaderID {
+		node.metrics.leaderChanges.Inc()
+		node.logger.Info("election: leadership handed over", "from", previousID, "to", leadership.LeaderID, "term", leadership.Term)
+	}
+	return nil
+}
+
+// / Accept the leadership announced by a leader that steps down
+// /
+// / Example:
+// / POST /leader {"term":4,"leader_id":2,"leader_addr":"http://localhost:8002"}
+func (node *Node) handleLeader(writer http.ResponseWriter, request *http.Request) {
+	var leadership Leadership
+	if err := json.NewDecoder(request.Body).Decode(&leadership); err != nil {
+		http.Error(writer, "invalid json", http.StatusBadRequest)
+		return
+	}
+
+	if err := node.adopt(leadership); err != nil {
+		http.Error(writer, err.Error(), http.StatusConflict)
+		return
+	}
+	writer.WriteHeader(http.StatusOK)
+}
+
+// / Leave the cluster without losing writes.
+// /
+// / A leader holds new writes, drains the ones in flight, waits for the
+// / followers to catch up and hands leadership to the most up-to-date
+// / one. The held writes are then forwarded to it.
+func (node *Node) Shutdown(ctx context.Context) {
+	node.leaving.Store(true)
+
+	if node.isLeader() {
+		node.handOff(ctx)
+	}
+
+	// ends the event streams, so the HTTP server can drain
+	node.events.Close()
+}
+
+func (node *Node) handOff(ctx context.Context) {
+	logger := node.logger
+
+	node.writes.hold()
+	defer node.writes.release()
+
+	logger.Info("handoff: holding writes, draining in-flight requests")
+	if err := node.writes.drain(ctx); err != nil {
+		logger.Warn("handoff: writes still in flight", "error", err)
+	}
+
+	// followers that missed an operation see the hole on this one and resync
+	node.commit(ctx, ReplicateRequest{Op: "noop"})
+
+	candidates := node.awaitFollowers(ctx)
+	if len(candidates) == 0 {
+		logger.Warn("handoff: no follower reachable, leaving without a leader")
+		return
+	}
+
+	node.mu.RLock()
+	term := node.term + 1
+	node.mu.RUnlock()
+
+	// announcing must happen even if the drain used up the deadline
+	announceCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), node.client.Timeout)
+	defer cancel()
+
+	for _, candidate := range candidates {
+		leadership := Leadership{Term: term, LeaderID: candidate.NodeID, LeaderAddr: candidate.NodeAddr}
+		if err := node.transport.Announce(announceCtx, candidate.NodeAddr, leadership); err != nil {
+			logger.Warn("handoff: candidate refused leadership", "peer", candidate.NodeID, "error", err)
+			continue
+		}
+
+		// the other followers would find out at their next election
+		var wait sync.WaitGroup
+		for id, address := range node.peers {
+			if id == node.id || id == candidate.NodeID {
+				continue
+			}
+			wait.Add(1)
+			go func() {
+				defer wait.Done()
+				if err := node.transport.Announce(announceCtx, address, leadership); err != nil {
+					logger.Warn("handoff: failed to announce leader", "peer", id, "error", err)
+				}
+			}()
+		}
+		wait.Wait()
+
+		node.adopt(leadership)
+		logger.Info("handoff: leadership handed over", "leader", candidate.NodeID, "term", term, "applied_index", candidate.AppliedIndex)
+		return
+	}
+	logger.Warn("handoff: no follower accepted leadership")
+}
+
+// / Wait until the reachable followers applied every committed operation.
+// /
+// / Gives up after half of the time left, and returns the reachable
+// / followers, most up-to-date first.
+func (node *Node) awaitFollowers(ctx context.Context) []NodeStatus {
+	target := node.applied.Load()
+
+	wait := time.Duration(node.config.ClientTimeout)
+	if deadline, ok := ctx.Deadline(); ok {
+		wait = time.Until(deadline) / 2
+	}
+	ctx, cancel := context.WithTimeout(ctx, wait)
+	defer cancel()
+
+	ticker := time.NewTicker(50 * time.Millisecond)
+	defer ticker.Stop()
+
+	for {
+		candidates := node.followerStatuses(ctx)
+		caughtUp := true
+		for _, status := range candidates {
+			if status.AppliedIndex < target {
+				caughtUp = false
+			}
+		}
+
+		if caughtUp {
+			return candidates
+		}
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			node.logger.Warn("handoff: followers did not catch up in time", "index", target)
+			return candidates
+		}
+	}
+}
+
+// / Status of the reachable followers that are not leaving, most up-to-date first
+func (node *Node) followerStatuses(ctx context.Context) []NodeStatus {
+	var mu sync.Mutex
+	var statuses []NodeStatus
+	var wait sync.WaitGroup
+
+	for id, address := range node.peers {
+		if id == node.id {
+			continue
+		}
+		wait.Add(1)
+		go func() {
+			defer wait.Done()
+			status, err := node.transport.Status(ctx, address)
+			if err != nil || status.Leaving {
+				return
+			}
+			mu.Lock()
+			statuses = append(statuses, status)
+			mu.Unlock()
+		}()
+	}
+	wait.Wait()
+
+	slices.SortFunc(statuses, func(a, b NodeStatus) int {
+		if a.AppliedIndex != b.AppliedIndex {
+			if a.AppliedIndex > b.AppliedIndex {
+				return -1
+			}
+			return 1
+		}
+		return b.NodeID - a.NodeID
+	})
+	return statuses
+}
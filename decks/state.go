@@ -0,0 +1,180 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// Sets of the state kept next to the decks, see StateSnapshot. The node
+// set holds single values: the log position, the next IDs and the dead
+// letters. The others hold one value per trade, webhook or bucket.
+const (
+	stateNode     = "node"
+	stateTrades   = "trades"
+	stateEscrows  = "escrows"
+	stateSwaps    = "swaps"
+	stateWebhooks = "webhooks"
+	stateLimits   = "limits"
+)
+
+// / Last operation applied, stored with its writes
+type LogPosition struct {
+	Term  uint64 `json:"term"`
+	Index uint64 `json:"index"`
+}
+
+// / Write value as JSON in the state; a nil value deletes the key
+func putState(tx Tx, set, key string, value any) error {
+	if value == nil {
+		return tx.PutState(set, key, nil)
+	}
+	data, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	return tx.PutState(set, key, data)
+}
+
+// / The state besides the decks of a snapshot, as stored
+func encodeState(snap Snapshot) (StateSnapshot, error) {
+	state := make(StateSnapshot)
+	var err error
+	put := func(set, key string, value any) {
+		if err != nil {
+			return
+		}
+		var data []byte
+		if data, err = json.Marshal(value); err != nil {
+			return
+		}
+		if state[set] == nil {
+			state[set] = make(map[string][]byte)
+		}
+		state[set][key] = data
+	}
+
+	put(stateNode, "position", LogPosition{Term: snap.Term, Index: snap.Index})
+	put(stateNode, "next_trade_id", snap.NextTradeID)
+	put(stateNode, "next_webhook_id", snap.NextWebhookID)
+	put(stateNode, "dead_letters", snap.DeadLetters)
+	for id, trade := range snap.Trades {
+		put(stateTrades, strconv.Itoa(id), trade)
+	}
+	for id, escrow := range snap.Escrows {
+		put(stateEscrows, strconv.Itoa(id), escrow)
+	}
+	for id, swap := range snap.Swaps {
+		put(stateSwaps, strconv.Itoa(id), swap)
+	}
+	for _, hook := range snap.Webhooks {
+		put(stateWebhooks, strconv.Itoa(hook.ID), hook)
+	}
+	for key, until := range snap.Limits {
+		put(stateLimits, key, until)
+	}
+	return state, err
+}
+
+// / A snapshot without decks from the stored state
+func decodeState(state StateSnapshot) (Snapshot, error) {
+	snap := Snapshot{
+		Trades:  make(map[int]TradeRequest),
+		Escrows: make(map[int]Escrow),
+		Swaps:   make(map[int]SwapResult),
+		Limits:  make(map[string]time.Time),
+	}
+
+	var position LogPosition
+	for key, into := range map[string]any{
+		"position":        &position,
+		"next_trade_id":   &snap.NextTradeID,
+		"next_webhook_id": &snap.NextWebhookID,
+		"dead_letters":    &snap.DeadLetters,
+	} {
+		if data, ok := state[stateNode][key]; ok {
+			if err := json.Unmarshal(data, into); err != nil {
+				return snap, fmt.Errorf("state %s/%s: %w", stateNode, key, err)
+			}
+		}
+	}
+	snap.Term, snap.Index = position.Term, position.Index
+
+	if err := decodeByID(state, stateTrades, snap.Trades); err != nil {
+		return snap, err
+	}
+	if err := decodeByID(state, stateEscrows, snap.Escrows); err != nil {
+		return snap, err
+	}
+	if err := decodeByID(state, stateSwaps, snap.Swaps); err != nil {
+		return snap, err
+	}
+	hooks := make(map[int]Webhook)
+	if err := decodeByID(state, stateWebhooks, hooks); err != nil {
+		return snap, err
+	}
+	for _, hook := range hooks {
+		snap.Webhooks = append(snap.Webhooks, hook)
+	}
+	for key, data := range state[stateLimits] {
+		var until time.Time
+		if err := json.Unmarshal(data, &until); err != nil {
+			return snap, fmt.Errorf("state %s/%s: %w", stateLimits, key, err)
+		}
+		snap.Limits[key] = until
+	}
+	return snap, nil
+}
+
+func decodeByID[V any](state StateSnapshot, set string, into map[int]V) error {
+	for key, data := range state[set] {
+		id, err := strconv.Atoi(key)
+		if err != nil {
+			return fmt.Errorf("state %s/%s: bad id", set, key)
+		}
+		var value V
+		if err := json.Unmarshal(data, &value); err != nil {
+			return fmt.Errorf("state %s/%s: %w", set, key, err)
+		}
+		into[id] = value
+	}
+	return nil
+}
+
+// / Read back the state the storage kept, on startup, see NewNode
+func (node *Node) loadState() error {
+	state, err := node.store.State()
+	if err != nil {
+		return err
+	}
+	snap, err := decodeState(state)
+	if err != nil {
+		return err
+	}
+
+	node.applyMu.Lock()
+	defer node.applyMu.Unlock()
+
+	node.restoreState(snap)
+	if snap.Index > 0 {
+		node.logger.Info("state: loaded from storage", "term", snap.Term, "index", snap.Index, "trades", len(snap.Trades), "webhooks", len(snap.Webhooks))
+	}
+	return nil
+}
+
+// / Delete the buckets the limiter pruned, which no operation writes
+// / again
+func (node *Node) forgetLimits(keys []string) {
+	err := node.store.Update(func(tx Tx) error {
+		for _, key := range keys {
+			if err := tx.PutState(stateLimits, key, nil); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		node.logger.Warn("state: failed to forget refilled buckets", "buckets", len(keys), "error", err)
+	}
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func boltNode(t *testing.T, dir string) *Node {
+	t.Helper()
+	store, err := OpenBoltStorage(filepath.Join(dir, boltFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	node, err := NewNode(DefaultConfig(), store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return node
+}
+
+func TestRestartKeepsLogPositionAndTerm(t *testing.T) {
+	dir := t.TempDir()
+
+	node := boltNode(t, dir)
+	for id := range 3 {
+		if err := node.commit(context.Background(), ReplicateRequest{Op: "add", User: "alice", Card: Card{ID: id + 1}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	term, index := node.appliedTerm, node.applied.Load()
+	node.store.Close()
+
+	node = boltNode(t, dir)
+	defer node.store.Close()
+	if node.applied.Load() != index || node.appliedTerm != term {
+		t.Fatalf("restarted at term %d index %d, want term %d index %d", node.appliedTerm, node.applied.Load(), term, index)
+	}
+	// the election after the restart starts a later term
+	if status := node.status(); status.Term <= term {
+		t.Fatalf("term %d after the restart, want more than %d", status.Term, term)
+	}
+
+	if err := node.commit(context.Background(), ReplicateRequest{Op: "add", User: "alice", Card: Card{ID: 4}}); err != nil {
+		t.Fatal(err)
+	}
+	if node.appliedTerm <= term || node.applied.Load() != index+1 {
+		t.Fatalf("commit after the restart at term %d index %d", node.appliedTerm, node.applied.Load())
+	}
+	if cards, _ := node.store.List("alice"); len(cards) != 4 {
+		t.Fatalf("alice has %d cards, want 4", len(cards))
+	}
+}
+
+func TestReplicateFromOlderTerm(t *testing.T) {
+	node, err := NewNode(DefaultConfig(), NewMemoryStorage())
+	if err != nil {
+		t.Fatal(err)
+	}
+	node.appliedTerm = 5
+	node.applied.Store(10)
+
+	// a leader of a term this node moved past is refused
+	node.term = 5
+	err = node.applyReplicate(context.Background(), ReplicateRequest{Op: "noop", Term: 3, Index: 11})
+	if err == nil || !strings.Contains(err.Error(), "stale leader") {
+		t.Fatalf("operation of term 3 at term 5: %v", err)
+	}
+
+	// the leader this node follows is behind what was applied here
+	node.term = 3
+	node.synced.Store(true)
+	err = node.applyReplicate(context.Background(), ReplicateRequest{Op: "noop", Term: 3, Index: 11})
+	if err == nil || !strings.Contains(err.Error(), "resyncing") {
+		t.Fatalf("operation of the current leader behind the log: %v", err)
+	}
+	if node.applied.Load() != 10 {
+		t.Fatalf("applied index %d, want 10", node.applied.Load())
+	}
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+)
+
+// / Reads and writes on the decks, inside or outside a transaction.
+// /
+// / The owner is a user name, or empty for the global deck.
+type Tx interface {
+	Get(owner string, id int) (Card, bool, error)
+	Put(owner string, card Card) error
+	// Returns the removed card, and false when it was not in the deck
+	Delete(owner string, id int) (Card, bool, error)
+	List(owner string) ([]Card, error)
+	// Number of changes made to the deck of owner, 0 before the first one
+	Version(owner string) (uint64, error)
+	// Write a value of the state kept next to the decks; nil deletes it
+	PutState(set, key string, value []byte) error
+}
+
+// / Every deck by owner, the global deck under the empty owner
+type DeckSnapshot struct {
+	Cards    map[string][]Card
+	Versions map[string]uint64
+}
+
+// / Replicated state besides the decks: the log position, trades,
+// / webhooks, rate limits... as JSON values by key, in named sets.
+// /
+// / It is written in the transaction of the operation that changed it,
+// / so it always matches the decks. See state.go for its content.
+type StateSnapshot map[string]map[string][]byte
+
+// / Where a node keeps its decks.
+// /
+// / Replicated operations only write through Update, so each one is
+// / applied completely or not at all. Reads outside a transaction see
+// / the last committed state.
+// /
+// / Every write to a deck increases its version. Nodes apply the same
+// / writes in the same order, so they agree on the versions.
+type Storage interface {
+	Tx
+
+	// Run fn in a transaction: its writes are kept if it returns nil
+	Update(fn func(tx Tx) error) error
+	// Run fn in a read-only transaction, on a state no write changes meanwhile
+	View(fn func(tx Tx) error) error
+
+	// Users holding a deck, without the global deck
+	Owners() ([]string, error)
+	Counts() (DeckCounts, error)
+
+	// Every deck, and the replacement of every deck and the state at once
+	Snapshot() (DeckSnapshot, error)
+	Restore(decks DeckSnapshot, state StateSnapshot) error
+	// The state kept next to the decks, empty when none is kept
+	State() (StateSnapshot, error)
+
+	Close() error
+}
+
+// Storage backends.
+const (
+	StorageMemory = "memory"
+	StorageBolt   = "bolt"
+)
+
+// File of the bolt storage, in the data directory.
+const boltFile = "decks.db"
+
+func openStorage(config Config) (Storage, error) {
+	if config.Storage == StorageBolt {
+		path := filepath.Join(config.DataDir, boltFile)
+		storage, err := OpenBoltStorage(path)
+		if err != nil {
+			return nil, fmt.Errorf("storage: %s: %w", path, err)
+		}
+		return storage, nil
+	}
+	return NewMemoryStorage(), nil
+}
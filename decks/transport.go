@@ -0,0 +1,139 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// / Status of a node as seen by its peers
+type NodeStatus struct {
+	NodeID     PeerID  `json:"node_id"`
+	NodeAddr   Address `json:"node_addr"`
+	LeaderID   PeerID  `json:"leader_id"`
+	LeaderAddr Address `json:"leader_addr"`
+	// Replica group of the node, empty when there is one group
+	Shard string `json:"shard,omitempty"`
+
+	Term         uint64 `json:"term"`
+	AppliedIndex uint64 `json:"applied_index"`
+	// Set while the node shuts down; it is never elected then
+	Leaving bool `json:"leaving,omitempty"`
+
+	// Replication health, see notReady
+	Ready    bool     `json:"ready"`
+	NotReady []string `json:"not_ready,omitempty"`
+	// Has the state of a leader; only synced nodes are elected
+	Synced bool `json:"synced"`
+	// Last index known of the leader, and how far behind it this node is
+	LeaderIndex   uint64    `json:"leader_index"`
+	Lag           uint64    `json:"lag"`
+	LastHeartbeat time.Time `json:"last_heartbeat,omitzero"`
+	// Seconds since the state was last restored from a snapshot
+	SnapshotAge float64 `json:"snapshot_age_seconds,omitempty"`
+	// Filled by the leader only
+	Followers []FollowerStatus `json:"followers,omitempty"`
+
+	Decks DeckCounts `json:"decks"`
+}
+
+// / How a node talks to its peers.
+// /
+// / Status doubles as the heartbeat used by the election loop, and
+// / Announce tells a peer who leads after a handoff.
+// / Client traffic (forwards to the leader) always stays on HTTP.
+type Transport interface {
+	Replicate(ctx context.Context, peer Address, request ReplicateRequest) error
+	Status(ctx context.Context, peer Address) (NodeStatus, error)
+	Snapshot(ctx context.Context, peer Address) (Snapshot, error)
+	Announce(ctx context.Context, peer Address, leadership Leadership) error
+}
+
+const (
+	TransportREST = "rest"
+	TransportGob  = "gob"
+)
+
+func newTransport(kind string, client *http.Client) Transport {
+	if kind == TransportGob {
+		return NewGobTransport(client.Timeout)
+	}
+	return &RESTTransport{client: client}
+}
+
+// / JSON over one HTTP request per operation.
+// /
+// / Slower than the gob transport, but every call can be
+// / reproduced with curl, which makes it the debugging choice.
+type RESTTransport struct {
+	client *http.Client
+}
+
+func (transport *RESTTransport) Replicate(ctx context.Context, peer Address, request ReplicateRequest) error {
+	return transport.postJSON(ctx, strings.TrimRight(peer, "/")+"/replicate", request)
+}
+
+func (transport *RESTTransport) Announce(ctx context.Context, peer Address, leadership Leadership) error {
+	return transport.postJSON(ctx, strings.TrimRight(peer, "/")+"/leader", leadership)
+}
+
+func (transport *RESTTransport) postJSON(ctx context.Context, url string, body any) error {
+	data, _ := json.Marshal(body)
+
+	httpRequest, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+
+	httpRequest.Header.Set("Content-Type", "application/json")
+	propagateRequestID(ctx, httpRequest)
+
+	response, err := transport.client.Do(httpRequest)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	message, _ := io.ReadAll(response.Body)
+
+	if response.StatusCode >= 300 {
+		return fmt.Errorf("non-2xx from %s: %s %s", url, response.Status, strings.TrimSpace(string(message)))
+	}
+	return nil
+}
+
+func (transport *RESTTransport) Status(ctx context.Context, peer Address) (NodeStatus, error) {
+	var status NodeStatus
+	err := transport.getJSON(ctx, strings.TrimRight(peer, "/")+"/status", &status)
+	return status, err
+}
+
+func (transport *RESTTransport) Snapshot(ctx context.Context, peer Address) (Snapshot, error) {
+	var snap Snapshot
+	err := transport.getJSON(ctx, strings.TrimRight(peer, "/")+"/snapshot", &snap)
+	return snap, err
+}
+
+func (transport *RESTTransport) getJSON(ctx context.Context, url string, out any) error {
+	request, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return err
+	}
+	propagateRequestID(ctx, request)
+
+	response, err := transport.client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(response.Body)
+		return fmt.Errorf("non-200 from %s: %d %s", url, response.StatusCode, strings.TrimSpace(string(body)))
+	}
+	return json.NewDecoder(response.Body).Decode(out)
+}
@@ -0,0 +1,433 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// / Outbound subscription to deck and trade events.
+// /
+// / Subscriptions are replicated, so they survive a leader change.
+// / Only the leader delivers, signing every payload with Secret.
+type Webhook struct {
+	ID  int    `json:"id"`
+	URL string `json:"url"`
+	// Event types to deliver; empty means every event
+	Events []string `json:"events,omitempty"`
+	Secret string   `json:"secret,omitempty"`
+}
+
+// / An event that could not be delivered after every attempt
+type DeadLetter struct {
+	DeliveryID string    `json:"delivery_id"`
+	WebhookID  int       `json:"webhook_id"`
+	URL        string    `json:"url"`
+	Event      Event     `json:"event"`
+	Attempts   int       `json:"attempts"`
+	Error      string    `json:"error"`
+	Time       time.Time `json:"time"`
+}
+
+// Headers sent with every delivery.
+const (
+	WebhookEventHeader     = "X-Decks-Event"
+	WebhookDeliveryHeader  = "X-Decks-Delivery"
+	WebhookTimestampHeader = "X-Decks-Timestamp"
+	WebhookSignatureHeader = "X-Decks-Signature"
+)
+
+// Dead letters kept by the cluster; the oldest are dropped first.
+const maxDeadLetters = 1000
+
+// Upper bound of the delay between two attempts.
+const maxWebhookBackoff = 5 * time.Minute
+
+var eventTypes = []string{
+	EventCardAdded,
+	EventCardRemoved,
+	EventTradeProposed,
+	EventTradeAccepted,
+	EventTradeCancelled,
+	EventClaimSucceeded,
+	EventClaimFailed,
+}
+
+// / Replicated webhook state: subscriptions and dead letters
+type WebhookStore struct {
+	mu     sync.RWMutex
+	hooks  map[int]Webhook
+	nextID int
+	dead   []DeadLetter
+}
+
+func NewWebhookStore() *WebhookStore {
+	return &WebhookStore{
+		hooks: make(map[int]Webhook),
+	}
+}
+
+// / Reserve the ID of a new subscription
+func (store *WebhookStore) reserveID() int {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	store.nextID++
+	return store.nextID
+}
+
+func (store *WebhookStore) add(hook Webhook) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	store.hooks[hook.ID] = hook
+	store.nextID = max(store.nextID, hook.ID)
+}
+
+func (store *WebhookStore) remove(id int) (Webhook, bool) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	hook, ok := store.hooks[id]
+	delete(store.hooks, id)
+	return hook, ok
+}
+
+func (store *WebhookStore) get(id int) (Webhook, bool) {
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+
+	hook, ok := store.hooks[id]
+	return hook, ok
+}
+
+// / ID of the last subscription, reserved or added
+func (store *WebhookStore) next() int {
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+
+	return store.nextID
+}
+
+func (store *WebhookStore) bury(letter DeadLetter) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	store.dead = lastDeadLetters(append(store.dead, letter))
+}
+
+// / The dead letters kept of letters, the most recent ones
+func lastDeadLetters(letters []DeadLetter) []DeadLetter {
+	if len(letters) > maxDeadLetters {
+		return slices.Clone(letters[len(letters)-maxDeadLetters:])
+	}
+	return letters
+}
+
+// / Subscriptions sorted by ID
+func (store *WebhookStore) list() []Webhook {
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+
+	hooks := make([]Webhook, 0, len(store.hooks))
+	for _, hook := range store.hooks {
+		hooks = append(hooks, hook)
+	}
+	slices.SortFunc(hooks, func(a, b Webhook) int { return a.ID - b.ID })
+	return hooks
+}
+
+func (store *WebhookStore) deadLetters() []DeadLetter {
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+
+	return slices.Clone(store.dead)
+}
+
+// / Subscriptions that want an event of the given type
+func (store *WebhookStore) matching(eventType string) []Webhook {
+	var hooks []Webhook
+	for _, hook := range store.list() {
+		if len(hook.Events) == 0 || slices.Contains(hook.Events, eventType) {
+			hooks = append(hooks, hook)
+		}
+	}
+	return hooks
+}
+
+// / Copy the state into a snapshot
+func (store *WebhookStore) snapshot(snap *Snapshot) {
+	snap.Webhooks = store.list()
+	snap.DeadLetters = store.deadLetters()
+
+	store.mu.RLock()
+	snap.NextWebhookID = store.nextID
+	store.mu.RUnlock()
+}
+
+// / Replace the state by the content of a snapshot.
+// /
+// / Snapshots carry no secrets: those known from webhook_add are kept.
+func (store *WebhookStore) restore(snap Snapshot) {
+	hooks := store.withKnownSecrets(snap.Webhooks)
+
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	store.hooks = make(map[int]Webhook)
+	for _, hook := range hooks {
+		store.hooks[hook.ID] = hook
+	}
+	store.nextID = snap.NextWebhookID
+	store.dead = slices.Clone(snap.DeadLetters)
+}
+
+// / Copy of hooks, with the secret this store knows for those without one
+func (store *WebhookStore) withKnownSecrets(hooks []Webhook) []Webhook {
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+
+	hooks = slices.Clone(hooks)
+	for i, hook := range hooks {
+		if hook.Secret == "" {
+			hooks[i].Secret = store.hooks[hook.ID].Secret
+		}
+	}
+	return hooks
+}
+
+// / Copy of hooks without their secrets, for anything a peer or a client
+// / can read
+func withoutSecrets(hooks []Webhook) []Webhook {
+	hooks = slices.Clone(hooks)
+	for i := range hooks {
+		hooks[i].Secret = ""
+	}
+	return hooks
+}
+
+// / Sign a payload: hex HMAC-SHA256 of "timestamp.body" keyed by secret
+func signWebhook(secret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func newWebhookSecret() string {
+	buffer := make([]byte, 24)
+	rand.Read(buffer)
+	return hex.EncodeToString(buffer)
+}
+
+// / Queue the deliveries of an event the leader applied
+func (node *Node) dispatchWebhooks(ctx context.Context, event Event) {
+	if event.Time.IsZero() {
+		event.Time = time.Now().UTC()
+	}
+
+	for _, hook := range node.webhooks.matching(event.Type) {
+		go node.deliverWebhook(context.WithoutCancel(ctx), hook, event, newRequestID())
+	}
+}
+
+// / Deliver an event to a subscription, retrying with exponential backoff.
+// /
+// / After the last attempt the event is committed as a dead letter. So is
+// / an event for a subscription whose secret this node does not know: it
+// / would not be signed.
+func (node *Node) deliverWebhook(ctx context.Context, hook Webhook, event Event, deliveryID string) {
+	logger := node.log(ctx).With("webhook", hook.ID, "delivery", deliveryID, "event", event.Type)
+
+	if hook.Secret == "" {
+		node.metrics.webhookDeliveries.Inc("dead")
+		logger.Warn("webhook: secret unknown to this node, not delivering")
+		node.buryWebhook(ctx, DeadLetter{
+			DeliveryID: deliveryID,
+			WebhookID:  hook.ID,
+			URL:        hook.URL,
+			Event:      event,
+			Error:      "secret unknown to this node, create the subscription again",
+			Time:       time.Now().UTC(),
+		})
+		return
+	}
+
+	body, err := json.Marshal(event)
+	if err != nil {
+		logger.Error("webhook: failed to encode event", "error", err)
+		return
+	}
+
+	attempts := node.config.WebhookAttempts
+	backoff := time.Duration(node.config.WebhookBackoff)
+
+	for attempt := 1; ; attempt++ {
+		err = node.postWebhook(ctx, hook, event.Type, deliveryID, body)
+		if err == nil {
+			node.metrics.webhookDeliveries.Inc("success")
+			logger.Info("webhook: delivered", "attempt", attempt)
+			return
+		}
+
+		if attempt >= attempts {
+			node.metrics.webhookDeliveries.Inc("dead")
+			logger.Warn("webhook: giving up", "attempt", attempt, "error", err)
+			node.buryWebhook(ctx, DeadLetter{
+				DeliveryID: deliveryID,
+				WebhookID:  hook.ID,
+				URL:        hook.URL,
+				Event:      event,
+				Attempts:   attempt,
+				Error:      err.Error(),
+				Time:       time.Now().UTC(),
+			})
+			return
+		}
+
+		node.metrics.webhookDeliveries.Inc("retry")
+		logger.Warn("webhook: attempt failed", "attempt", attempt, "retry_in", backoff, "error", err)
+		time.Sleep(backoff)
+		backoff = min(2*backoff, maxWebhookBackoff)
+
+		// the subscription may have been removed while waiting
+		if _, ok := node.webhooks.get(hook.ID); !ok {
+			logger.Info("webhook: subscription removed, dropping delivery")
+			return
+		}
+	}
+}
+
+func (node *Node) postWebhook(ctx context.Context, hook Webhook, eventType, deliveryID string, body []byte) error {
+	request, err := http.NewRequestWithContext(ctx, "POST", hook.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set(WebhookEventHeader, eventType)
+	request.Header.Set(WebhookDeliveryHeader, deliveryID)
+	request.Header.Set(WebhookTimestampHeader, timestamp)
+	request.Header.Set(WebhookSignatureHeader, signWebhook(hook.Secret, timestamp, body))
+	propagateRequestID(ctx, request)
+
+	response, err := node.client.Do(request)
+	if err != nil {
+		return err
+	}
+	io.Copy(io.Discard, response.Body)
+	response.Body.Close()
+
+	if response.StatusCode < 200 || response.StatusCode >= 300 {
+		return fmt.Errorf("%s answered %s", hook.URL, response.Status)
+	}
+	return nil
+}
+
+// / Record a dead letter on every node, if this node still leads
+func (node *Node) buryWebhook(ctx context.Context, letter DeadLetter) {
+	if !node.isLeader() {
+		node.log(ctx).Warn("webhook: lost leadership, dead letter not recorded", "delivery", letter.DeliveryID)
+		return
+	}
+	node.commit(ctx, ReplicateRequest{Op: "webhook_dead", DeadLetter: &letter})
+}
+
+// / Subscribe a URL to events
+// /
+// / Example:
+// / POST /admin/webhooks {"url":"http://localhost:9000/hook","events":["card_added"]}
+func (node *Node) handlePostWebhook(writer http.ResponseWriter, request *http.Request) {
+	if !node.isLeader() {
+		node.forwardToLeader(writer, request)
+		return
+	}
+
+	var hook Webhook
+	if err := json.NewDecoder(request.Body).Decode(&hook); err != nil {
+		http.Error(writer, "invalid json", http.StatusBadRequest)
+		return
+	}
+
+	target, err := url.Parse(hook.URL)
+	if err != nil || (target.Scheme != "http" && target.Scheme != "https") || target.Host == "" {
+		http.Error(writer, "url must be an absolute http(s) URL", http.StatusBadRequest)
+		return
+	}
+	for _, eventType := range hook.Events {
+		if !slices.Contains(eventTypes, eventType) {
+			http.Error(writer, "unknown event type: "+eventType, http.StatusBadRequest)
+			return
+		}
+	}
+	if hook.Secret == "" {
+		hook.Secret = newWebhookSecret()
+	}
+
+	hook.ID = node.webhooks.reserveID()
+	if err := node.commit(request.Context(), ReplicateRequest{Op: "webhook_add", Webhook: &hook}); err != nil {
+		http.Error(writer, "failed to add webhook", http.StatusInternalServerError)
+		return
+	}
+
+	// the secret is only shown once, on creation
+	writer.Header().Set("Content-Type", "application/json")
+	writer.WriteHeader(http.StatusCreated)
+	json.NewEncoder(writer).Encode(hook)
+}
+
+// / List subscriptions, without their secrets
+func (node *Node) handleGetWebhooks(writer http.ResponseWriter, request *http.Request) {
+	writer.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(writer).Encode(withoutSecrets(node.webhooks.list()))
+}
+
+// / Remove a subscription
+// /
+// / Example:
+// / DELETE /admin/webhooks/:id
+func (node *Node) handleDeleteWebhook(writer http.ResponseWriter, request *http.Request) {
+	parts := strings.Split(strings.Trim(request.URL.Path, "/"), "/")
+	id, err := strconv.Atoi(parts[len(parts)-1])
+	if err != nil {
+		http.Error(writer, "invalid webhook id", http.StatusBadRequest)
+		return
+	}
+
+	if !node.isLeader() {
+		node.forwardToLeader(writer, request)
+		return
+	}
+
+	if _, ok := node.webhooks.get(id); !ok {
+		http.Error(writer, "webhook not found", http.StatusNotFound)
+		return
+	}
+
+	if err := node.commit(request.Context(), ReplicateRequest{Op: "webhook_remove", Webhook: &Webhook{ID: id}}); err != nil {
+		http.Error(writer, "failed to remove webhook", http.StatusInternalServerError)
+		return
+	}
+	writer.WriteHeader(http.StatusNoContent)
+}
+
+// / List the deliveries that failed every attempt, oldest first
+func (node *Node) handleGetDeadLetters(writer http.ResponseWriter, request *http.Request) {
+	writer.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(writer).Encode(node.webhooks.deadLetters())
+}
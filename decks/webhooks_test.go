@@ -0,0 +1,30 @@
+package main
+
+import "testing"
+
+func TestRestoreKeepsKnownSecrets(t *testing.T) {
+	store := NewWebhookStore()
+	store.add(Webhook{ID: 1, URL: "http://a", Secret: "s1"})
+
+	store.restore(Snapshot{
+		Webhooks:      withoutSecrets([]Webhook{{ID: 1, URL: "http://a", Secret: "s1"}, {ID: 2, URL: "http://b", Secret: "s2"}}),
+		NextWebhookID: 2,
+	})
+
+	if hook, _ := store.get(1); hook.Secret != "s1" {
+		t.Fatalf("secret of webhook 1 = %q, want the one known before", hook.Secret)
+	}
+	if hook, ok := store.get(2); !ok || hook.Secret != "" {
+		t.Fatalf("webhook 2 = %+v, want it without a secret", hook)
+	}
+}
+
+func TestWithoutSecretsLeavesHooksAlone(t *testing.T) {
+	hooks := []Webhook{{ID: 1, Secret: "s1"}}
+	if stripped := withoutSecrets(hooks); stripped[0].Secret != "" {
+		t.Fatal("secret kept")
+	}
+	if hooks[0].Secret != "s1" {
+		t.Fatal("secret removed from the original")
+	}
+}
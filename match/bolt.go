@@ -0,0 +1,312 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"strconv"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+/// Buckets of the bolt store: records by match ID, and one nested
+/// bucket per player under players, holding the IDs of their matches
+var (
+	matchesBucket = []byte("matches")
+	playersBucket = []byte("players")
+)
+
+/// Match records kept in a bolt file, so they survive restarts
+type BoltStore struct {
+	db *bolt.DB
+}
+
+func OpenBoltStore(path string) (*BoltStore, error) {
+	// another server on the same file would block forever otherwise
+	db, err := bolt.Open(path, 0o600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, err
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{matchesBucket, playersBucket} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &BoltStore{db: db}, nil
+}
+
+func (store *BoltStore) Save(record MatchRecord) error {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+
+	return store.db.Update(func(tx *bolt.Tx) error {
+		players := tx.Bucket(playersBucket)
+		for _, player := range []Username{record.Host.ID, record.Guest.ID} {
+			index, err := players.CreateBucketIfNotExists([]byte(player))
+			if err != nil {
+				return err
+			}
+			if err := index.Put([]byte(record.ID), nil); err != nil {
+				return err
+			}
+		}
+		return tx.Bucket(matchesBucket).Put([]byte(record.ID), data)
+	})
+}
+
+func (store *BoltStore) Get(id MatchID) (record MatchRecord, ok bool, err error) {
+	err = store.db.View(func(tx *bolt.Tx) error {
+		data := tx.Bucket(matchesBucket).Get([]byte(id))
+		if data == nil {
+			return nil
+		}
+		ok = true
+		return json.Unmarshal(data, &record)
+	})
+	return record, ok, err
+}
+
+func (store *BoltStore) OfPlayer(player Username) ([]Match, error) {
+	matches := []Match{}
+	err := store.db.View(func(tx *bolt.Tx) error {
+		index := tx.Bucket(playersBucket).Bucket([]byte(player))
+		if index == nil {
+			return nil
+		}
+		records := tx.Bucket(matchesBucket)
+		return index.ForEach(func(id, _ []byte) error {
+			var record MatchRecord
+			if err := json.Unmarshal(records.Get(id), &record); err != nil {
+				return err
+			}
+			matches = append(matches, record.Match)
+			return nil
+		})
+	})
+	sortMatches(matches)
+	return matches, err
+}
+
+func (store *BoltStore) Playing() ([]MatchRecord, error) {
+	var playing []MatchRecord
+	err := store.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(matchesBucket).ForEach(func(_, data []byte) error {
+			var record MatchRecord
+			if err := json.Unmarshal(data, &record); err != nil {
+				return err
+			}
+			if record.Status == StatusPlaying {
+				playing = append(playing, record)
+			}
+			return nil
+		})
+	})
+	return playing, err
+}
+
+func (store *BoltStore) Close() error {
+	return store.db.Close()
+}
+
+/// Buckets of the bolt ratings: IDs of the rated matches, one nested
+/// bucket of ratings per season, the log of the changes made here keyed
+/// by their big-endian seq, the cursors in the logs of peers, and the
+/// epoch of the log under meta
+var (
+	ratedBucket   = []byte("rated")
+	seasonsBucket = []byte("seasons")
+	logBucket     = []byte("log")
+	cursorsBucket = []byte("cursors")
+	metaBucket    = []byte("meta")
+	epochKey      = []byte("epoch")
+)
+
+/// Ratings kept in a bolt file, so they survive restarts
+type BoltRatings struct {
+	db *bolt.DB
+	/// Set when the file is created, kept with the log
+	epoch string
+}
+
+func OpenBoltRatings(path string) (*BoltRatings, error) {
+	db, err := bolt.Open(path, 0o600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, err
+	}
+
+	var epoch string
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{ratedBucket, seasonsBucket, logBucket, cursorsBucket, metaBucket} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		meta := tx.Bucket(metaBucket)
+		if data := meta.Get(epochKey); data != nil {
+			epoch = string(data)
+			return nil
+		}
+		epoch = newSessionToken()
+		return meta.Put(epochKey, []byte(epoch))
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &BoltRatings{db: db, epoch: epoch}, nil
+}
+
+func seqKey(seq uint64) []byte {
+	return binary.BigEndian.AppendUint64(nil, seq)
+}
+
+func seasonKey(season int) []byte {
+	return []byte(strconv.Itoa(season))
+}
+
+func (store *BoltRatings) Apply(change RatingChange, origin bool) (applied bool, err error) {
+	err = store.db.Update(func(tx *bolt.Tx) error {
+		rated := tx.Bucket(ratedBucket)
+		if rated.Get([]byte(change.MatchID)) != nil {
+			return nil
+		}
+		if err := rated.Put([]byte(change.MatchID), []byte{1}); err != nil {
+			return err
+		}
+
+		season, err := tx.Bucket(seasonsBucket).CreateBucketIfNotExists(seasonKey(change.Season))
+		if err != nil {
+			return err
+		}
+		for _, delta := range change.Deltas {
+			rating := newRating(delta.PlayerID)
+			if data := season.Get([]byte(delta.PlayerID)); data != nil {
+				if err := json.Unmarshal(data, &rating); err != nil {
+					return err
+				}
+			}
+			change.applyTo(&rating)
+			data, err := json.Marshal(rating)
+			if err != nil {
+				return err
+			}
+			if err := season.Put([]byte(delta.PlayerID), data); err != nil {
+				return err
+			}
+		}
+
+		if origin {
+			log := tx.Bucket(logBucket)
+			if change.Seq, err = log.NextSequence(); err != nil {
+				return err
+			}
+			data, err := json.Marshal(change)
+			if err != nil {
+				return err
+			}
+			if err := log.Put(seqKey(change.Seq), data); err != nil {
+				return err
+			}
+		}
+		applied = true
+		return nil
+	})
+	return applied, err
+}
+
+func (store *BoltRatings) Rating(season int, player Username) (Rating, error) {
+	rating := newRating(player)
+	err := store.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(seasonsBucket).Bucket(seasonKey(season))
+		if bucket == nil {
+			return nil
+		}
+		if data := bucket.Get([]byte(player)); data != nil {
+			return json.Unmarshal(data, &rating)
+		}
+		return nil
+	})
+	return rating, err
+}
+
+func (store *BoltRatings) Season(season int) ([]Rating, error) {
+	ratings := []Rating{}
+	err := store.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(seasonsBucket).Bucket(seasonKey(season))
+		if bucket == nil {
+			return nil
+		}
+		return bucket.ForEach(func(_, data []byte) error {
+			var rating Rating
+			if err := json.Unmarshal(data, &rating); err != nil {
+				return err
+			}
+			ratings = append(ratings, rating)
+			return nil
+		})
+	})
+	return ratings, err
+}
+
+func (store *BoltRatings) Changes(after uint64) (changes []RatingChange, last uint64, err error) {
+	changes = []RatingChange{}
+	err = store.db.View(func(tx *bolt.Tx) error {
+		log := tx.Bucket(logBucket)
+		last = log.Sequence()
+
+		cursor := log.Cursor()
+		for key, data := cursor.Seek(seqKey(after + 1)); key != nil; key, data = cursor.Next() {
+			var change RatingChange
+			if err := json.Unmarshal(data, &change); err != nil {
+				return err
+			}
+			changes = append(changes, change)
+		}
+		return nil
+	})
+	return changes, last, err
+}
+
+func (store *BoltRatings) Epoch() string {
+	return store.epoch
+}
+
+func (store *BoltRatings) Cursor(peer Address) (cursor LogCursor, err error) {
+	err = store.db.View(func(tx *bolt.Tx) error {
+		data := tx.Bucket(cursorsBucket).Get([]byte(peer))
+		switch {
+		case data == nil:
+			return nil
+		case len(data) == 8:
+			// a bare seq, written before logs had epochs: read again
+			cursor.Seq = binary.BigEndian.Uint64(data)
+			return nil
+		}
+		return json.Unmarshal(data, &cursor)
+	})
+	return cursor, err
+}
+
+func (store *BoltRatings) SetCursor(peer Address, cursor LogCursor) error {
+	data, err := json.Marshal(cursor)
+	if err != nil {
+		return err
+	}
+	return store.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(cursorsBucket).Put([]byte(peer), data)
+	})
+}
+
+func (store *BoltRatings) Close() error {
+	return store.db.Close()
+}
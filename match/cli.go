@@ -1,30 +1,21 @@
 package main
 
 import (
+	"errors"
 	"flag"
-	"fmt"
+	"log"
+	"os"
 )
 
-type CliArguments struct {
-	address Address
-	peers   []Address
-}
-
-func parseCli() CliArguments {
-	var port string
-	var rawPeers string
-
-	flag.StringVar(&port, "port", "8081", "server listen port")
-	flag.StringVar(&rawPeers, "peers", "", "comma-separated peer host:port list")
-	flag.Parse()
-
-	address := fmt.Sprintf("0.0.0.0:%s", port)
-	peers := []Address{}
-
-	if rawPeers != "" {
-		peers = append(peers, listPeers(rawPeers)...)
+func parseCli() Config {
+	config, err := loadConfig(os.Args[1:])
+	if errors.Is(err, flag.ErrHelp) {
+		os.Exit(0)
+	}
+	if err != nil {
+		log.Fatal(err)
 	}
-	return CliArguments{address, peers}
+	return config
 }
 
 
@@ -0,0 +1,513 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/goccy/go-yaml"
+	"github.com/pelletier/go-toml/v2"
+)
+
+/// Match server configuration
+///
+/// Resolution order, each layer overriding the previous one:
+/// defaults, config file, MATCH_* environment variables and explicit flags.
+type Config struct {
+	Port  string    `yaml:"port" toml:"port"`
+	Peers []Address `yaml:"peers" toml:"peers"`
+	/// Where match records are kept, in memory when empty
+	DataDir string `yaml:"data_dir" toml:"data_dir"`
+
+	/// Timeout for requests sent to peer servers
+	PeerTimeout Duration `yaml:"peer_timeout" toml:"peer_timeout"`
+	/// Deadline for a single websocket write
+	WriteTimeout Duration `yaml:"write_timeout" toml:"write_timeout"`
+
+	/// Number of cards a player must send to play
+	HandSize int `yaml:"hand_size" toml:"hand_size"`
+	/// Rounds of a match; each round plays two cards of the hand
+	Rounds int `yaml:"rounds" toml:"rounds"`
+	/// Time the players of a round have to move; those who did not
+	/// forfeit. Never when 0
+	MoveTimeout Duration `yaml:"move_timeout" toml:"move_timeout"`
+
+	/// Start of the first rating season; ratings reset every season
+	SeasonStart  time.Time `yaml:"season_start" toml:"season_start"`
+	SeasonLength Duration  `yaml:"season_length" toml:"season_length"`
+
+	/// Pairing policy: "skill" or "fifo"
+	Matchmaking string `yaml:"matchmaking" toml:"matchmaking"`
+	/// Rating difference skill matchmaking accepts right away, and the
+	/// points it adds per second of waiting
+	RatingWindow int `yaml:"rating_window" toml:"rating_window"`
+	WindowGrowth int `yaml:"window_growth" toml:"window_growth"`
+	/// Time a player waits in the queue before giving up
+	QueueTimeout Duration `yaml:"queue_timeout" toml:"queue_timeout"`
+	/// Time a waiter stays reserved for a peer before going back to the queue
+	ReserveTimeout Duration `yaml:"reserve_timeout" toml:"reserve_timeout"`
+	/// Deadline for the peers to answer a search for an opponent
+	SearchTimeout Duration `yaml:"search_timeout" toml:"search_timeout"`
+	/// Which peer pairs a challenger when several can: "rotate" or "queue"
+	PeerChoice string `yaml:"peer_choice" toml:"peer_choice"`
+	/// How often peers are probed, and the probes missed in a row before
+	/// a peer is suspect, then dead
+	ProbeInterval Duration `yaml:"probe_interval" toml:"probe_interval"`
+	SuspectAfter  int      `yaml:"suspect_after" toml:"suspect_after"`
+	DeadAfter     int      `yaml:"dead_after" toml:"dead_after"`
+	/// Time a dead peer is kept before it is removed, forever when 0
+	ForgetAfter Duration `yaml:"forget_after" toml:"forget_after"`
+	/// Address peers reach this server at, localhost:<port> when empty
+	Advertise string `yaml:"advertise" toml:"advertise"`
+	/// How often this server gossips with a random peer
+	GossipInterval Duration `yaml:"gossip_interval" toml:"gossip_interval"`
+	/// Peers asked to probe a peer that missed a direct probe
+	IndirectProbes int `yaml:"indirect_probes" toml:"indirect_probes"`
+	/// Time a websocket session outlives its connection, and the messages
+	/// it keeps for a reconnection
+	SessionGrace Duration `yaml:"session_grace" toml:"session_grace"`
+	OutboxSize   int      `yaml:"outbox_size" toml:"outbox_size"`
+}
+
+/// time.Duration readable as "5s" from files and environment
+type Duration time.Duration
+
+func (d *Duration) UnmarshalText(text []byte) error {
+	parsed, err := time.ParseDuration(string(text))
+	if err != nil {
+		return err
+	}
+	*d = Duration(parsed)
+	return nil
+}
+
+func (d Duration) MarshalText() ([]byte, error) {
+	return []byte(time.Duration(d).String()), nil
+}
+
+func (d Duration) String() string {
+	return time.Duration(d).String()
+}
+
+func DefaultConfig() Config {
+	return Config{
+		Port:           "8081",
+		Peers:          []Address{},
+		PeerTimeout:    Duration(5 * time.Second),
+		WriteTimeout:   Duration(5 * time.Second),
+		HandSize:       5,
+		Rounds:         2,
+		MoveTimeout:    Duration(2 * time.Minute),
+		SeasonStart:    time.Date(2025, time.January, 1, 0, 0, 0, 0, time.UTC),
+		SeasonLength:   Duration(30 * 24 * time.Hour),
+		Matchmaking:    MatchmakingSkill,
+		RatingWindow:   100,
+		WindowGrowth:   10,
+		QueueTimeout:   Duration(2 * time.Minute),
+		ReserveTimeout: Duration(5 * time.Second),
+		SearchTimeout:  Duration(2 * time.Second),
+		PeerChoice:     PeerChoiceRotate,
+		ProbeInterval:  Duration(2 * time.Second),
+		SuspectAfter:   2,
+		DeadAfter:      5,
+		ForgetAfter:    Duration(10 * time.Minute),
+		GossipInterval: Duration(time.Second),
+		IndirectProbes: 2,
+		SessionGrace:   Duration(30 * time.Second),
+		OutboxSize:     100,
+	}
+}
+
+/// Address the server listens on
+func (config Config) Address() Address {
+	return fmt.Sprintf("0.0.0.0:%s", config.Port)
+}
+
+/// Address peers reach the server at
+func (config Config) AdvertiseAddress() Address {
+	if config.Advertise != "" {
+		return config.Advertise
+	}
+	return fmt.Sprintf("localhost:%s", config.Port)
+}
+
+func loadConfig(args []string) (Config, error) {
+	config := DefaultConfig()
+
+	var path string
+	var port string
+	var rawPeers string
+	var dataDir string
+	var peerTimeout time.Duration
+	var writeTimeout time.Duration
+	var handSize int
+	var rounds int
+	var moveTimeout time.Duration
+	var seasonStart string
+	var seasonLength time.Duration
+	var matchmaking string
+	var ratingWindow int
+	var windowGrowth int
+	var queueTimeout time.Duration
+	var reserveTimeout time.Duration
+	var searchTimeout time.Duration
+	var peerChoice string
+	var probeInterval time.Duration
+	var suspectAfter int
+	var deadAfter int
+	var forgetAfter time.Duration
+	var advertise string
+	var gossipInterval time.Duration
+	var indirectProbes int
+	var sessionGrace time.Duration
+	var outboxSize int
+
+	flags := flag.NewFlagSet("match", flag.ContinueOnError)
+	flags.StringVar(&path, "config", "", "path to a YAML or TOML config file")
+	flags.StringVar(&port, "port", config.Port, "server listen port")
+	flags.StringVar(&rawPeers, "peers", "", "comma-separated peer host:port list")
+	flags.StringVar(&dataDir, "data-dir", "", "directory for persistent server data")
+	flags.DurationVar(&peerTimeout, "peer-timeout", time.Duration(config.PeerTimeout), "timeout for requests sent to peers")
+	flags.DurationVar(&writeTimeout, "write-timeout", time.Duration(config.WriteTimeout), "deadline for websocket writes")
+	flags.IntVar(&handSize, "hand-size", config.HandSize, "number of cards required to play")
+	flags.IntVar(&rounds, "rounds", config.Rounds, "number of rounds of a match")
+	flags.DurationVar(&moveTimeout, "move-timeout", time.Duration(config.MoveTimeout), "time players have to move in a round before they forfeit, never when 0")
+	flags.StringVar(&seasonStart, "season-start", config.SeasonStart.Format(time.RFC3339), "start of the first rating season (RFC 3339)")
+	flags.DurationVar(&seasonLength, "season-length", time.Duration(config.SeasonLength), "length of a rating season")
+	flags.StringVar(&matchmaking, "matchmaking", config.Matchmaking, "pairing policy: skill or fifo")
+	flags.IntVar(&ratingWindow, "rating-window", config.RatingWindow, "rating difference accepted right away by skill matchmaking")
+	flags.IntVar(&windowGrowth, "window-growth", config.WindowGrowth, "rating window points added per second of waiting")
+	flags.DurationVar(&queueTimeout, "queue-timeout", time.Duration(config.QueueTimeout), "time a player waits in the queue before giving up")
+	flags.DurationVar(&reserveTimeout, "reserve-timeout", time.Duration(config.ReserveTimeout), "time a waiter stays reserved for a peer")
+	flags.DurationVar(&searchTimeout, "search-timeout", time.Duration(config.SearchTimeout), "deadline for peers to answer a search for an opponent")
+	flags.StringVar(&peerChoice, "peer-choice", config.PeerChoice, "peer pairing a challenger when several can: rotate or queue")
+	flags.DurationVar(&probeInterval, "probe-interval", time.Duration(config.ProbeInterval), "how often peers are probed")
+	flags.IntVar(&suspectAfter, "suspect-after", config.SuspectAfter, "probes missed in a row before a peer is suspect")
+	flags.IntVar(&deadAfter, "dead-after", config.DeadAfter, "probes missed in a row before a peer is dead")
+	flags.DurationVar(&forgetAfter, "forget-after", time.Duration(config.ForgetAfter), "time a dead peer is kept, forever when 0")
+	flags.StringVar(&advertise, "advertise", "", "host:port peers reach this server at (default localhost:<port>)")
+	flags.DurationVar(&gossipInterval, "gossip-interval", time.Duration(config.GossipInterval), "how often membership is gossiped to a random peer")
+	flags.IntVar(&indirectProbes, "indirect-probes", config.IndirectProbes, "peers asked to probe a peer that missed a probe")
+	flags.DurationVar(&sessionGrace, "session-grace", time.Duration(config.SessionGrace), "time a websocket session outlives its connection")
+	flags.IntVar(&outboxSize, "outbox-size", config.OutboxSize, "messages a websocket session keeps for a reconnection")
+
+	if err := flags.Parse(args); err != nil {
+		return config, err
+	}
+
+	if path == "" {
+		path = os.Getenv("MATCH_CONFIG")
+	}
+	if path != "" {
+		if err := config.loadFile(path); err != nil {
+			return config, err
+		}
+	}
+
+	if err := config.loadEnv(); err != nil {
+		return config, err
+	}
+
+	var errs []error
+	flags.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "port":
+			config.Port = port
+		case "peers":
+			config.Peers = listPeers(rawPeers)
+		case "data-dir":
+			config.DataDir = dataDir
+		case "peer-timeout":
+			config.PeerTimeout = Duration(peerTimeout)
+		case "write-timeout":
+			config.WriteTimeout = Duration(writeTimeout)
+		case "hand-size":
+			config.HandSize = handSize
+		case "rounds":
+			config.Rounds = rounds
+		case "move-timeout":
+			config.MoveTimeout = Duration(moveTimeout)
+		case "season-start":
+			start, err := time.Parse(time.RFC3339, seasonStart)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("flag -season-start: %w", err))
+			}
+			config.SeasonStart = start
+		case "season-length":
+			config.SeasonLength = Duration(seasonLength)
+		case "matchmaking":
+			config.Matchmaking = matchmaking
+		case "rating-window":
+			config.RatingWindow = ratingWindow
+		case "window-growth":
+			config.WindowGrowth = windowGrowth
+		case "queue-timeout":
+			config.QueueTimeout = Duration(queueTimeout)
+		case "reserve-timeout":
+			config.ReserveTimeout = Duration(reserveTimeout)
+		case "search-timeout":
+			config.SearchTimeout = Duration(searchTimeout)
+		case "peer-choice":
+			config.PeerChoice = peerChoice
+		case "probe-interval":
+			config.ProbeInterval = Duration(probeInterval)
+		case "suspect-after":
+			config.SuspectAfter = suspectAfter
+		case "dead-after":
+			config.DeadAfter = deadAfter
+		case "forget-after":
+			config.ForgetAfter = Duration(forgetAfter)
+		case "advertise":
+			config.Advertise = advertise
+		case "gossip-interval":
+			config.GossipInterval = Duration(gossipInterval)
+		case "indirect-probes":
+			config.IndirectProbes = indirectProbes
+		case "session-grace":
+			config.SessionGrace = Duration(sessionGrace)
+		case "outbox-size":
+			config.OutboxSize = outboxSize
+		}
+	})
+	if err := errors.Join(errs...); err != nil {
+		return config, err
+	}
+
+	if err := config.Validate(); err != nil {
+		return config, err
+	}
+
+	if config.DataDir != "" {
+		if err := os.MkdirAll(config.DataDir, 0o755); err != nil {
+			return config, fmt.Errorf("config: data_dir: %w", err)
+		}
+	}
+	return config, nil
+}
+
+func (config *Config) loadFile(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("config: %w", err)
+	}
+
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		err = yaml.UnmarshalWithOptions(data, config, yaml.Strict())
+	case ".toml":
+		decoder := toml.NewDecoder(bytes.NewReader(data))
+		decoder.DisallowUnknownFields()
+		err = decoder.Decode(config)
+	default:
+		return fmt.Errorf("config: %s: unsupported format, use .yaml, .yml or .toml", path)
+	}
+
+	if err != nil {
+		return fmt.Errorf("config: %s: %w", path, err)
+	}
+	return nil
+}
+
+func (config *Config) loadEnv() error {
+	var errs []error
+
+	if value, ok := os.LookupEnv("MATCH_PORT"); ok {
+		config.Port = value
+	}
+	if value, ok := os.LookupEnv("MATCH_PEERS"); ok {
+		config.Peers = listPeers(value)
+	}
+	if value, ok := os.LookupEnv("MATCH_DATA_DIR"); ok {
+		config.DataDir = value
+	}
+	if value, ok := os.LookupEnv("MATCH_PEER_TIMEOUT"); ok {
+		if err := config.PeerTimeout.UnmarshalText([]byte(value)); err != nil {
+			errs = append(errs, fmt.Errorf("MATCH_PEER_TIMEOUT: %w", err))
+		}
+	}
+	if value, ok := os.LookupEnv("MATCH_WRITE_TIMEOUT"); ok {
+		if err := config.WriteTimeout.UnmarshalText([]byte(value)); err != nil {
+			errs = append(errs, fmt.Errorf("MATCH_WRITE_TIMEOUT: %w", err))
+		}
+	}
+	if value, ok := os.LookupEnv("MATCH_HAND_SIZE"); ok {
+		size, err := strconv.Atoi(value)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("MATCH_HAND_SIZE: not a number: %q", value))
+		}
+		config.HandSize = size
+	}
+	if value, ok := os.LookupEnv("MATCH_ROUNDS"); ok {
+		rounds, err := strconv.Atoi(value)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("MATCH_ROUNDS: not a number: %q", value))
+		}
+		config.Rounds = rounds
+	}
+	if value, ok := os.LookupEnv("MATCH_MOVE_TIMEOUT"); ok {
+		if err := config.MoveTimeout.UnmarshalText([]byte(value)); err != nil {
+			errs = append(errs, fmt.Errorf("MATCH_MOVE_TIMEOUT: %w", err))
+		}
+	}
+	if value, ok := os.LookupEnv("MATCH_SEASON_START"); ok {
+		start, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("MATCH_SEASON_START: %w", err))
+		}
+		config.SeasonStart = start
+	}
+	if value, ok := os.LookupEnv("MATCH_SEASON_LENGTH"); ok {
+		if err := config.SeasonLength.UnmarshalText([]byte(value)); err != nil {
+			errs = append(errs, fmt.Errorf("MATCH_SEASON_LENGTH: %w", err))
+		}
+	}
+	if value, ok := os.LookupEnv("MATCH_MATCHMAKING"); ok {
+		config.Matchmaking = value
+	}
+	if value, ok := os.LookupEnv("MATCH_RATING_WINDOW"); ok {
+		window, err := strconv.Atoi(value)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("MATCH_RATING_WINDOW: not a number: %q", value))
+		}
+		config.RatingWindow = window
+	}
+	if value, ok := os.LookupEnv("MATCH_WINDOW_GROWTH"); ok {
+		growth, err := strconv.Atoi(value)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("MATCH_WINDOW_GROWTH: not a number: %q", value))
+		}
+		config.WindowGrowth = growth
+	}
+	if value, ok := os.LookupEnv("MATCH_QUEUE_TIMEOUT"); ok {
+		if err := config.QueueTimeout.UnmarshalText([]byte(value)); err != nil {
+			errs = append(errs, fmt.Errorf("MATCH_QUEUE_TIMEOUT: %w", err))
+		}
+	}
+	if value, ok := os.LookupEnv("MATCH_RESERVE_TIMEOUT"); ok {
+		if err := config.ReserveTimeout.UnmarshalText([]byte(value)); err != nil {
+			errs = append(errs, fmt.Errorf("MATCH_RESERVE_TIMEOUT: %w", err))
+		}
+	}
+	if value, ok := os.LookupEnv("MATCH_SEARCH_TIMEOUT"); ok {
+		if err := config.SearchTimeout.UnmarshalText([]byte(value)); err != nil {
+			errs = append(errs, fmt.Errorf("MATCH_SEARCH_TIMEOUT: %w", err))
+		}
+	}
+	if value, ok := os.LookupEnv("MATCH_PEER_CHOICE"); ok {
+		config.PeerChoice = value
+	}
+	if value, ok := os.LookupEnv("MATCH_PROBE_INTERVAL"); ok {
+		if err := config.ProbeInterval.UnmarshalText([]byte(value)); err != nil {
+			errs = append(errs, fmt.Errorf("MATCH_PROBE_INTERVAL: %w", err))
+		}
+	}
+	if value, ok := os.LookupEnv("MATCH_SUSPECT_AFTER"); ok {
+		failures, err := strconv.Atoi(value)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("MATCH_SUSPECT_AFTER: not a number: %q", value))
+		}
+		config.SuspectAfter = failures
+	}
+	if value, ok := os.LookupEnv("MATCH_DEAD_AFTER"); ok {
+		failures, err := strconv.Atoi(value)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("MATCH_DEAD_AFTER: not a number: %q", value))
+		}
+		config.DeadAfter = failures
+	}
+	if value, ok := os.LookupEnv("MATCH_FORGET_AFTER"); ok {
+		if err := config.ForgetAfter.UnmarshalText([]byte(value)); err != nil {
+			errs = append(errs, fmt.Errorf("MATCH_FORGET_AFTER: %w", err))
+		}
+	}
+	if value, ok := os.LookupEnv("MATCH_ADVERTISE"); ok {
+		config.Advertise = value
+	}
+	if value, ok := os.LookupEnv("MATCH_GOSSIP_INTERVAL"); ok {
+		if err := config.GossipInterval.UnmarshalText([]byte(value)); err != nil {
+			errs = append(errs, fmt.Errorf("MATCH_GOSSIP_INTERVAL: %w", err))
+		}
+	}
+	if value, ok := os.LookupEnv("MATCH_INDIRECT_PROBES"); ok {
+		probes, err := strconv.Atoi(value)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("MATCH_INDIRECT_PROBES: not a number: %q", value))
+		}
+		config.IndirectProbes = probes
+	}
+	if value, ok := os.LookupEnv("MATCH_SESSION_GRACE"); ok {
+		if err := config.SessionGrace.UnmarshalText([]byte(value)); err != nil {
+			errs = append(errs, fmt.Errorf("MATCH_SESSION_GRACE: %w", err))
+		}
+	}
+	if value, ok := os.LookupEnv("MATCH_OUTBOX_SIZE"); ok {
+		size, err := strconv.Atoi(value)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("MATCH_OUTBOX_SIZE: not a number: %q", value))
+		}
+		config.OutboxSize = size
+	}
+
+	return errors.Join(errs...)
+}
+
+/// Check the configuration, reporting every problem at once
+func (config *Config) Validate() error {
+	var errs []error
+
+	port, err := strconv.Atoi(config.Port)
+	if err != nil || port <= 0 || port > 65535 {
+		errs = append(errs, fmt.Errorf("port must be a number between 1 and 65535, got %q", config.Port))
+	}
+	for _, peer := range config.Peers {
+		if strings.Contains(peer, "://") {
+			errs = append(errs, fmt.Errorf("peer %q must be host:port, without scheme", peer))
+		}
+	}
+	if config.PeerTimeout <= 0 {
+		errs = append(errs, fmt.Errorf("peer_timeout must be positive, got %s", config.PeerTimeout))
+	}
+	if config.WriteTimeout <= 0 {
+		errs = append(errs, fmt.Errorf("write_timeout must be positive, got %s", config.WriteTimeout))
+	}
+	if config.HandSize <= 0 {
+		errs = append(errs, fmt.Errorf("hand_size must be positive, got %d", config.HandSize))
+	}
+	if config.Rounds <= 0 {
+		errs = append(errs, fmt.Errorf("rounds must be positive, got %d", config.Rounds))
+	} else if 2*config.Rounds > config.HandSize {
+		errs = append(errs, fmt.Errorf("rounds: %d rounds play %d cards, more than hand_size %d", config.Rounds, 2*config.Rounds, config.HandSize))
+	}
+	if config.MoveTimeout < 0 {
+		errs = append(errs, fmt.Errorf("move_timeout must not be negative, got %s", config.MoveTimeout))
+	}
+
+	if config.SeasonStart.IsZero() {
+		errs = append(errs, errors.New("season_start is required"))
+	}
+	if config.SeasonLength <= 0 {
+		errs = append(errs, fmt.Errorf("season_length must be positive, got %s", config.SeasonLength))
+	}
+	errs = append(errs, validateMatchmaking(*config)...)
+	if config.QueueTimeout <= 0 {
+		errs = append(errs, fmt.Errorf("queue_timeout must be positive, got %s", config.QueueTimeout))
+	}
+	if config.ReserveTimeout <= 0 {
+		errs = append(errs, fmt.Errorf("reserve_timeout must be positive, got %s", config.ReserveTimeout))
+	}
+	errs = append(errs, validatePeerChoice(*config)...)
+	errs = append(errs, validateProbes(*config)...)
+	errs = append(errs, validateGossip(*config)...)
+	errs = append(errs, validateSessions(*config)...)
+
+	if len(errs) > 0 {
+		return fmt.Errorf("invalid config: %w", errors.Join(errs...))
+	}
+	return nil
+}
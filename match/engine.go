@@ -0,0 +1,343 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"time"
+)
+
+/// Match engine
+///
+/// A match is played in rounds. In every round both players pick, in
+/// secret, a card to attack, a card to defend and a tactic. When both
+/// picks are in, the round is resolved: each attacker faces the defender
+/// of the other player, and scores a goal when its attack is stronger
+/// than the defense. A card plays once per match, so the hand runs out
+/// after the last round; the player with more goals wins.
+///
+/// Resolution only depends on the picks, so the same picks always give
+/// the same match.
+
+type Tactic = string
+
+/// Tactics shift power between the attacker and the defender of a player
+const (
+	TacticBalanced  Tactic = "balanced"
+	TacticAttacking Tactic = "attacking"
+	TacticDefensive Tactic = "defensive"
+)
+
+/// Power moved from one line to the other by a tactic
+const tacticShift = 2
+
+/// Match states
+const (
+	StatusPlaying  = "playing"
+	StatusFinished = "finished"
+)
+
+/// Winner of a match that ends even
+const Draw = "draw"
+
+var (
+	errNotInMatch   = errors.New("player is not in this match")
+	errFinished     = errors.New("match is finished")
+	errAlreadyMoved = errors.New("player already moved this round")
+)
+
+/// Picks of a player for one round
+type Move struct {
+	Attacker CardID `json:"attacker"`
+	Defender CardID `json:"defender"`
+	Tactic   Tactic `json:"tactic"`
+}
+
+/// Goals of each side
+type Score struct {
+	Host  int `json:"p1"`
+	Guest int `json:"p2"`
+}
+
+/// One attacker against one defender
+type Duel struct {
+	Attacker    Username `json:"attacker"`
+	AttackCard  Card     `json:"attack_card"`
+	DefenseCard Card     `json:"defense_card"`
+	Attack      int      `json:"attack"`
+	Defense     int      `json:"defense"`
+	Goal        bool     `json:"goal"`
+}
+
+/// A resolved round, with the picks of both players revealed
+type Round struct {
+	Number    int    `json:"number"`
+	HostMove  Move   `json:"p1_move"`
+	GuestMove Move   `json:"p2_move"`
+	Duels     []Duel `json:"duels"`
+}
+
+func newMatch(host Host, guest Guest, home Address, rounds int) *Match {
+	now := time.Now().UTC()
+	return &Match{
+		ID:      newCardID(),
+		Host:    host,
+		Guest:   guest,
+		Home:    home,
+		Status:  StatusPlaying,
+		Rounds:  rounds,
+		Round:   1,
+		Played:  []Round{},
+		Started: now,
+		Updated: now,
+		moves:   [2]*Move{},
+	}
+}
+
+/// Side of player: 0 for the host, 1 for the guest
+func (match *Match) side(player Username) (int, error) {
+	switch player {
+	case match.Host.ID:
+		return 0, nil
+	case match.Guest.ID:
+		return 1, nil
+	}
+	return 0, errNotInMatch
+}
+
+/// Record the move of player, and resolve the round once both moved.
+///
+/// Returns true when the move resolved a round.
+func (match *Match) Play(player Username, move Move) (bool, error) {
+	if match.Status == StatusFinished {
+		return false, errFinished
+	}
+	side, err := match.side(player)
+	if err != nil {
+		return false, err
+	}
+	if match.moves[side] != nil {
+		return false, errAlreadyMoved
+	}
+	if err := match.validate(side, move); err != nil {
+		return false, err
+	}
+
+	match.moves[side] = &move
+	match.Updated = time.Now().UTC()
+	if match.moves[0] == nil || match.moves[1] == nil {
+		return false, nil
+	}
+
+	match.resolve()
+	return true, nil
+}
+
+/// Give the match up: the opponent wins whatever the score
+func (match *Match) Forfeit(player Username) error {
+	if match.Status == StatusFinished {
+		return errFinished
+	}
+	side, err := match.side(player)
+	if err != nil {
+		return err
+	}
+
+	match.Forfeited = player
+	match.Winner = match.player(1 - side).ID
+	match.Status = StatusFinished
+	match.Updated = time.Now().UTC()
+	match.Finished = match.Updated
+	match.moves = [2]*Move{}
+	match.Pending = nil
+	match.Deadline = time.Time{}
+	return nil
+}
+
+/// Give the players of the current round timeout from now to move;
+/// no deadline when timeout is 0
+func (match *Match) startTurn(timeout time.Duration) {
+	match.Deadline = time.Time{}
+	if timeout > 0 && match.Status == StatusPlaying {
+		match.Deadline = time.Now().UTC().Add(timeout)
+	}
+}
+
+/// End the match when its deadline passed: a player who did not move
+/// forfeits, and the match is a draw when neither did.
+///
+/// Returns the players who did not move, none while the match goes on.
+func (match *Match) Expire(now time.Time) []Username {
+	if match.Status != StatusPlaying || match.Deadline.IsZero() || now.Before(match.Deadline) {
+		return nil
+	}
+
+	var late []Username
+	for side, move := range match.moves {
+		if move == nil {
+			late = append(late, match.player(side).ID)
+		}
+	}
+	if len(late) == 1 {
+		match.Forfeit(late[0])
+		return late
+	}
+
+	match.Winner = Draw
+	match.Status = StatusFinished
+	match.Updated = now.UTC()
+	match.Finished = match.Updated
+	match.moves = [2]*Move{}
+	match.Pending = nil
+	match.Deadline = time.Time{}
+	return late
+}
+
+func (match *Match) player(side int) PlayerInfo {
+	if side == 0 {
+		return match.Host
+	}
+	return match.Guest
+}
+
+func (match *Match) validate(side int, move Move) error {
+	switch move.Tactic {
+	case TacticBalanced, TacticAttacking, TacticDefensive:
+	case "":
+		return errors.New("tactic required: balanced, attacking or defensive")
+	default:
+		return fmt.Errorf("unknown tactic %q, use balanced, attacking or defensive", move.Tactic)
+	}
+	if move.Attacker == move.Defender {
+		return errors.New("attacker and defender must be different cards")
+	}
+
+	hand := match.Hand(match.player(side).ID)
+	for _, id := range []CardID{move.Attacker, move.Defender} {
+		if !slices.ContainsFunc(hand, func(card Card) bool { return card.ID == id }) {
+			return fmt.Errorf("card %q is not in the hand, or was already played", id)
+		}
+	}
+	return nil
+}
+
+/// Cards player can still play
+func (match *Match) Hand(player Username) []Card {
+	side, err := match.side(player)
+	if err != nil {
+		return nil
+	}
+
+	played := map[CardID]bool{}
+	for _, round := range match.Played {
+		move := round.HostMove
+		if side == 1 {
+			move = round.GuestMove
+		}
+		played[move.Attacker] = true
+		played[move.Defender] = true
+	}
+
+	var hand []Card
+	for _, card := range match.player(side).Cards {
+		if !played[card.ID] {
+			hand = append(hand, card)
+		}
+	}
+	return hand
+}
+
+func (match *Match) resolve() {
+	host, guest := *match.moves[0], *match.moves[1]
+	round := Round{
+		Number:    match.Round,
+		HostMove:  host,
+		GuestMove: guest,
+		Duels: []Duel{
+			match.duel(0, host, guest),
+			match.duel(1, guest, host),
+		},
+	}
+	if round.Duels[0].Goal {
+		match.Score.Host++
+	}
+	if round.Duels[1].Goal {
+		match.Score.Guest++
+	}
+
+	match.Played = append(match.Played, round)
+	match.moves = [2]*Move{}
+
+	if match.Round < match.Rounds {
+		match.Round++
+		return
+	}
+
+	match.Status = StatusFinished
+	match.Finished = match.Updated
+	match.Pending = nil
+	match.Deadline = time.Time{}
+	switch {
+	case match.Score.Host > match.Score.Guest:
+		match.Winner = match.Host.ID
+	case match.Score.Guest > match.Score.Host:
+		match.Winner = match.Guest.ID
+	default:
+		match.Winner = Draw
+	}
+}
+
+/// The attacker of side against the defender of the other side
+func (match *Match) duel(side int, attack, defense Move) Duel {
+	attacker, defender := match.player(side), match.player(1-side)
+	attackCard := cardOf(attacker.Cards, attack.Attacker)
+	defenseCard := cardOf(defender.Cards, defense.Defender)
+
+	duel := Duel{
+		Attacker:    attacker.ID,
+		AttackCard:  attackCard,
+		DefenseCard: defenseCard,
+		Attack:      attackCard.Power + attackShift(attack.Tactic),
+		Defense:     defenseCard.Power - attackShift(defense.Tactic),
+	}
+	// a tie is a save
+	duel.Goal = duel.Attack > duel.Defense
+	return duel
+}
+
+/// Power added to the attacker by a tactic, and taken from the defender
+func attackShift(tactic Tactic) int {
+	switch tactic {
+	case TacticAttacking:
+		return tacticShift
+	case TacticDefensive:
+		return -tacticShift
+	}
+	return 0
+}
+
+func cardOf(cards []Card, id CardID) Card {
+	for _, card := range cards {
+		if card.ID == id {
+			return card
+		}
+	}
+	return Card{ID: id}
+}
+
+/// Copy of the match to send to players: moves of the current round
+/// stay secret, only who still has to move is told
+func (match *Match) View() Match {
+	view := *match
+	view.Played = slices.Clone(match.Played)
+	view.moves = [2]*Move{}
+	view.Pending = nil
+	if match.Status == StatusPlaying {
+		for side, move := range match.moves {
+			if move == nil {
+				view.Pending = append(view.Pending, match.player(side).ID)
+			}
+		}
+	}
+	return view
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func testMatch(rounds int) *Match {
+	host := Host{ID: "alice", Cards: []Card{
+		{ID: "a1", Power: 5}, {ID: "a2", Power: 3}, {ID: "a3", Power: 7}, {ID: "a4", Power: 1},
+	}}
+	guest := Guest{ID: "bob", Cards: []Card{
+		{ID: "b1", Power: 4}, {ID: "b2", Power: 6}, {ID: "b3", Power: 2}, {ID: "b4", Power: 8},
+	}}
+	return newMatch(host, guest, "localhost:8080", rounds)
+}
+
+func mustPlay(t *testing.T, match *Match, player Username, move Move) bool {
+	t.Helper()
+	resolved, err := match.Play(player, move)
+	if err != nil {
+		t.Fatalf("%s plays %+v: %v", player, move, err)
+	}
+	return resolved
+}
+
+func TestRoundResolvesOnceBothMoved(t *testing.T) {
+	match := testMatch(2)
+
+	if mustPlay(t, match, "alice", Move{Attacker: "a1", Defender: "a2", Tactic: TacticBalanced}) {
+		t.Fatal("round resolved after one move")
+	}
+	if view := match.View(); len(view.Pending) != 1 || view.Pending[0] != "bob" {
+		t.Fatalf("pending = %v, want [bob]", view.Pending)
+	}
+	if !mustPlay(t, match, "bob", Move{Attacker: "b1", Defender: "b3", Tactic: TacticBalanced}) {
+		t.Fatal("round not resolved after both moves")
+	}
+
+	// a1 (5) against b3 (2) scores, b1 (4) against a2 (3) scores
+	if match.Score != (Score{Host: 1, Guest: 1}) {
+		t.Fatalf("score = %+v, want 1-1", match.Score)
+	}
+	if match.Round != 2 || match.Status != StatusPlaying {
+		t.Fatalf("round %d status %s, want round 2 playing", match.Round, match.Status)
+	}
+	if hand := match.Hand("alice"); len(hand) != 2 {
+		t.Fatalf("hand of alice has %d cards, want 2", len(hand))
+	}
+}
+
+func TestTactics(t *testing.T) {
+	tests := []struct {
+		name           string
+		attack, defend CardPower
+		host, guest    Tactic
+		goal           bool
+	}{
+		{"balanced", 5, 4, TacticBalanced, TacticBalanced, true},
+		// 5 against 4+2
+		{"defensive", 5, 4, TacticBalanced, TacticDefensive, false},
+		// 5+2 against 4+2
+		{"attacking against defensive", 5, 4, TacticAttacking, TacticDefensive, true},
+		// 5-2 against 4-2
+		{"defensive against attacking", 5, 4, TacticDefensive, TacticAttacking, true},
+		// 6-2 against 4: a tie is a save
+		{"tie", 6, 4, TacticDefensive, TacticBalanced, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			match := testMatch(1)
+			match.Host.Cards[0].Power = test.attack
+			match.Guest.Cards[0].Power = test.defend
+			mustPlay(t, match, "alice", Move{Attacker: "a1", Defender: "a3", Tactic: test.host})
+			mustPlay(t, match, "bob", Move{Attacker: "b3", Defender: "b1", Tactic: test.guest})
+
+			duel := match.Played[0].Duels[0]
+			if duel.Goal != test.goal {
+				t.Fatalf("attack %d against defense %d: goal %v, want %v", duel.Attack, duel.Defense, duel.Goal, test.goal)
+			}
+		})
+	}
+}
+
+func TestMatchEndsAfterLastRound(t *testing.T) {
+	match := testMatch(2)
+	mustPlay(t, match, "alice", Move{Attacker: "a3", Defender: "a1", Tactic: TacticAttacking})
+	mustPlay(t, match, "bob", Move{Attacker: "b3", Defender: "b1", Tactic: TacticBalanced})
+	mustPlay(t, match, "alice", Move{Attacker: "a2", Defender: "a4", Tactic: TacticBalanced})
+	mustPlay(t, match, "bob", Move{Attacker: "b4", Defender: "b2", Tactic: TacticBalanced})
+
+	if match.Status != StatusFinished {
+		t.Fatalf("status = %s, want finished", match.Status)
+	}
+	// round 1: 7+2 against 4 scores, 2 against 5-2 saved; round 2: 3
+	// against 6 saved, 8 against 1 scores
+	if match.Score != (Score{Host: 1, Guest: 1}) || match.Winner != Draw {
+		t.Fatalf("score %+v winner %q, want 1-1 draw", match.Score, match.Winner)
+	}
+	if match.Finished.IsZero() {
+		t.Fatal("finished time not set")
+	}
+	if _, err := match.Play("alice", Move{Attacker: "a1", Defender: "a2", Tactic: TacticBalanced}); !errors.Is(err, errFinished) {
+		t.Fatalf("move after the end: %v, want %v", err, errFinished)
+	}
+}
+
+func TestInvalidMoves(t *testing.T) {
+	match := testMatch(3)
+	mustPlay(t, match, "alice", Move{Attacker: "a1", Defender: "a2", Tactic: TacticBalanced})
+	mustPlay(t, match, "bob", Move{Attacker: "b1", Defender: "b2", Tactic: TacticBalanced})
+
+	tests := []struct {
+		name   string
+		player Username
+		move   Move
+	}{
+		{"stranger", "carol", Move{Attacker: "a3", Defender: "a4", Tactic: TacticBalanced}},
+		{"no tactic", "alice", Move{Attacker: "a3", Defender: "a4"}},
+		{"unknown tactic", "alice", Move{Attacker: "a3", Defender: "a4", Tactic: "reckless"}},
+		{"same card", "alice", Move{Attacker: "a3", Defender: "a3", Tactic: TacticBalanced}},
+		{"card of the opponent", "alice", Move{Attacker: "a3", Defender: "b3", Tactic: TacticBalanced}},
+		{"card already played", "alice", Move{Attacker: "a3", Defender: "a1", Tactic: TacticBalanced}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if _, err := match.Play(test.player, test.move); err == nil {
+				t.Fatalf("move %+v accepted", test.move)
+			}
+		})
+	}
+
+	mustPlay(t, match, "alice", Move{Attacker: "a3", Defender: "a4", Tactic: TacticBalanced})
+	if _, err := match.Play("alice", Move{Attacker: "a3", Defender: "a4", Tactic: TacticBalanced}); !errors.Is(err, errAlreadyMoved) {
+		t.Fatalf("second move in a round: %v, want %v", err, errAlreadyMoved)
+	}
+}
+
+func TestForfeit(t *testing.T) {
+	match := testMatch(3)
+	mustPlay(t, match, "alice", Move{Attacker: "a1", Defender: "a2", Tactic: TacticBalanced})
+
+	if err := match.Forfeit("alice"); err != nil {
+		t.Fatal(err)
+	}
+	if match.Winner != "bob" || match.Forfeited != "alice" || match.Status != StatusFinished {
+		t.Fatalf("winner %q forfeited %q status %s, want bob, alice, finished", match.Winner, match.Forfeited, match.Status)
+	}
+	if match.moves != [2]*Move{} {
+		t.Fatal("secret moves kept after the forfeit")
+	}
+	if err := match.Forfeit("bob"); !errors.Is(err, errFinished) {
+		t.Fatalf("second forfeit: %v, want %v", err, errFinished)
+	}
+}
+
+func TestViewHidesMoves(t *testing.T) {
+	match := testMatch(2)
+	mustPlay(t, match, "alice", Move{Attacker: "a1", Defender: "a2", Tactic: TacticAttacking})
+
+	view := match.View()
+	if view.moves != [2]*Move{} {
+		t.Fatal("view carries the moves of the round")
+	}
+	if match.moves[0] == nil {
+		t.Fatal("view cleared the moves of the match")
+	}
+}
+
+func TestExpireAfterDeadline(t *testing.T) {
+	tests := []struct {
+		name      string
+		moved     []Username
+		winner    Username
+		forfeited Username
+	}{
+		{"one player did not move", []Username{"alice"}, "alice", "bob"},
+		{"neither player moved", nil, Draw, ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			match := testMatch(2)
+			match.startTurn(time.Minute)
+			if test.moved != nil {
+				mustPlay(t, match, "alice", Move{Attacker: "a1", Defender: "a2", Tactic: TacticBalanced})
+			}
+
+			if late := match.Expire(time.Now()); late != nil {
+				t.Fatalf("%v late before the deadline", late)
+			}
+			late := match.Expire(match.Deadline)
+			if len(late) != 2-len(test.moved) {
+				t.Fatalf("late = %v, moved %v", late, test.moved)
+			}
+			if match.Status != StatusFinished || match.Winner != test.winner || match.Forfeited != test.forfeited {
+				t.Fatalf("status %s winner %q forfeited %q, want finished, %q, %q", match.Status, match.Winner, match.Forfeited, test.winner, test.forfeited)
+			}
+			if !match.Deadline.IsZero() {
+				t.Fatal("finished match kept its deadline")
+			}
+		})
+	}
+}
+
+func TestNoDeadlineWithoutTimeout(t *testing.T) {
+	match := testMatch(2)
+	match.startTurn(0)
+	if late := match.Expire(time.Now().Add(24 * time.Hour)); late != nil || match.Status != StatusPlaying {
+		t.Fatalf("match without a deadline ended, late %v", late)
+	}
+}
+
+func TestExpiredMatchIsRated(t *testing.T) {
+	server := NewServer("localhost:8081", DefaultConfig(), NewMemoryStore(), NewMemoryRatings())
+	match := testMatch(2)
+	match.Host.Server, match.Guest.Server = server.address, server.address
+	server.startMatch(match)
+
+	server.matches[match.ID].Deadline = time.Now().Add(-time.Second)
+	server.expireMatches()
+	if _, playing := server.matches[match.ID]; playing {
+		t.Fatal("expired match still played")
+	}
+	if alice, _ := server.ratings.Rating(server.config.seasonAt(time.Now()), "alice"); alice.Matches != 1 {
+		t.Fatalf("alice has %d rated matches, want 1", alice.Matches)
+	}
+}
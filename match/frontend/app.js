@@ -6,8 +6,17 @@
   const cardsTbody = document.getElementById('cardsTbody')
   const randomizeBtn = document.getElementById('randomize')
   const playBtn = document.getElementById('playBtn')
+  const cancelBtn = document.getElementById('cancelBtn')
+  const queueStatusEl = document.getElementById('queueStatus')
+  const matchStatusEl = document.getElementById('matchStatus')
+  const attackerEl = document.getElementById('attacker')
+  const defenderEl = document.getElementById('defender')
+  const tacticEl = document.getElementById('tactic')
+  const moveBtn = document.getElementById('moveBtn')
+  const forfeitBtn = document.getElementById('forfeitBtn')
 
   let ws = null
+  let match = null
 
   // start with Play disabled until websocket is connected
   playBtn.disabled = true
@@ -56,20 +65,113 @@
     loadRows(cards)
   }
 
-  connectBtn.addEventListener('click', ()=>{
+  // cards of the player not played yet in the match
+  function hand(m, pid){
+    const me = m.p1.player_id === pid ? 'p1' : 'p2'
+    const played = new Set()
+    m.played.forEach(r=>{ played.add(r[me+'_move'].attacker); played.add(r[me+'_move'].defender) })
+    return m[me].cards.filter(c=>!played.has(c.id))
+  }
+
+  function showMatch(m){
+    match = m
     const pid = playerIdEl.value.trim()
-    if (!pid) { alert('Player ID is required to connect'); return }
-    const url = (location.protocol==='https:'? 'wss://' : 'ws://') + location.host + '/ws?player_id=' + encodeURIComponent(pid)
+    let status = `${m.p1.player_id} ${m.score.p1} - ${m.score.p2} ${m.p2.player_id}`
+    if(m.status === 'finished'){
+      status += m.winner === 'draw' ? ' | draw' : ` | winner: ${m.winner}`
+      if(m.forfeited) status += ` (${m.forfeited} forfeited)`
+    } else {
+      status += ` | round ${m.round}/${m.rounds}`
+      if((m.pending||[]).length) status += ` | waiting for ${m.pending.join(', ')}`
+    }
+    matchStatusEl.textContent = status
+
+    const options = hand(m, pid).map(c=>`<option value="${escapeHtml(c.id)}">${escapeHtml(c.name)} (${c.power})</option>`).join('')
+    attackerEl.innerHTML = options
+    defenderEl.innerHTML = options
+    if(defenderEl.options.length > 1) defenderEl.selectedIndex = 1
+
+    const playing = m.status === 'playing'
+    moveBtn.disabled = !playing || !(m.pending||[]).includes(pid)
+    forfeitBtn.disabled = !playing
+  }
+
+  async function sendMove(body){
+    if(!match) return
+    body.player_id = playerIdEl.value.trim()
+    log('POST /matches/'+match.id+'/moves', body)
+    try{
+      const res = await fetch('/matches/'+encodeURIComponent(match.id)+'/moves', { method:'POST', headers:{'content-type':'application/json'}, body: JSON.stringify(body) })
+      if(!res.ok){ log('Move refused:', await res.text()); return }
+      showMatch(await res.json())
+    }catch(err){ log('move error', err) }
+  }
+
+  moveBtn.addEventListener('click', ()=>{
+    sendMove({ attacker: attackerEl.value, defender: defenderEl.value, tactic: tacticEl.value })
+  })
+
+  forfeitBtn.addEventListener('click', ()=>{
+    if(confirm('Give the match up?')) sendMove({ forfeit: true })
+  })
+
+  function showQueue(msg){
+    if(msg.type === 'queue_status'){
+      let status = `queued ${msg.position}/${msg.size}, waited ${msg.waited}s, expires in ${msg.expires}s`
+      if(msg.eta !== undefined) status += `, match in ~${msg.eta}s`
+      queueStatusEl.textContent = status
+      cancelBtn.disabled = false
+    } else {
+      queueStatusEl.textContent = msg.type === 'queue_left' ? `left the queue (${msg.reason})` : ''
+      cancelBtn.disabled = true
+    }
+  }
+
+  cancelBtn.addEventListener('click', async ()=>{
+    const pid = playerIdEl.value.trim()
+    const res = await fetch('/play?player_id='+encodeURIComponent(pid), { method:'DELETE' })
+    if(!res.ok) log('Cancel refused:', await res.text())
+  })
+
+  // session to resume after a dropped connection, see the welcome message
+  let session = null
+  let closing = false
+
+  function connect(pid){
+    let url = (location.protocol==='https:'? 'wss://' : 'ws://') + location.host + '/ws?player_id=' + encodeURIComponent(pid)
+    if(session && session.player === pid) url += '&token=' + session.token + '&last=' + session.last
     log('Connecting WS to', url)
     ws = new WebSocket(url)
     // enable Play when the websocket connection is open
     ws.onopen = ()=>{ log('WS open'); connectBtn.disabled = true; disconnectBtn.disabled = false; playBtn.disabled = false }
-    ws.onmessage = (ev)=>{ log('WS msg:', JSON.parse(ev.data)) }
-    ws.onclose = ()=>{ log('WS closed'); connectBtn.disabled = false; disconnectBtn.disabled = true; playBtn.disabled = true }
+    ws.onmessage = (ev)=>{
+      const msg = JSON.parse(ev.data)
+      log('WS msg:', msg)
+      if(msg.type === 'welcome'){
+        const last = msg.resumed ? session.last : 0
+        session = { player: pid, token: msg.token, last }
+        if(msg.gap) log('Some messages sent while disconnected were lost')
+      } else if(msg.seq) session.last = msg.seq
+      if(msg.match) showMatch(msg.match)
+      if(msg.type === 'queue_status' || msg.type === 'queue_left' || msg.type === 'match_start') showQueue(msg)
+    }
+    ws.onclose = ()=>{
+      log('WS closed'); connectBtn.disabled = false; disconnectBtn.disabled = true; playBtn.disabled = true
+      // resume the session unless the player disconnected
+      if(!closing) setTimeout(()=>{ if(!closing && ws && ws.readyState === WebSocket.CLOSED) connect(pid) }, 1000)
+    }
     ws.onerror = (e)=>{ log('WS error', e) }
+  }
+
+  connectBtn.addEventListener('click', ()=>{
+    const pid = playerIdEl.value.trim()
+    if (!pid) { alert('Player ID is required to connect'); return }
+    closing = false
+    connect(pid)
   })
 
   disconnectBtn.addEventListener('click', ()=>{
+    closing = true
     if(ws){ ws.close(); ws = null; playBtn.disabled = true }
   })
 
@@ -89,6 +191,7 @@
       if(res.status === 202){ const txt = await res.text(); log('Queued:', txt); return }
       const j = await res.json()
       log('Play response:', j)
+      showMatch(j)
     }catch(err){ log('play error', err) }
   })
 
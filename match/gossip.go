@@ -0,0 +1,285 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math/rand/v2"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+/// Membership
+///
+/// Servers learn about each other by gossip, in the manner of SWIM: every
+/// gossip_interval a server sends what it knows of every member, itself
+/// included, to one random live peer, which merges it and answers with
+/// what it knows. A new server needs a single seed in -peers; the seed
+/// learns of it from its first gossip, and the rest of the cluster from
+/// the seed.
+///
+/// A rumor about a member is newer when it has a higher incarnation. For
+/// the same incarnation, suspect beats healthy and dead beats both, and
+/// a higher heartbeat brings a newer load. Yet a server that reached the
+/// member itself more recently than it could have come to suspect it,
+/// suspect_after probe intervals, keeps it healthy: its own probe is
+/// fresher than the rumor. Only the member itself raises
+/// its incarnation: when it hears it is suspect or dead, it refutes the
+/// rumor with a higher one. A member missing its direct probe is probed
+/// through other peers before it is counted as failed.
+
+/// Body of a gossip exchange
+type Gossip struct {
+	/// Sender of the gossip, alive since it sent it
+	From    Member   `json:"from"`
+	Members []Member `json:"members"`
+}
+
+/// Incarnation of a server starting now; higher than those of its
+/// previous runs, so its peers forget that it died
+func startIncarnation() uint64 {
+	return uint64(time.Now().Unix())
+}
+
+/// Gossip with a random peer every gossip_interval
+func (server *Server) gossipLoop() {
+	for range time.Tick(time.Duration(server.config.GossipInterval)) {
+		peer, ok := server.gossipTarget()
+		if !ok {
+			continue
+		}
+		if err := server.gossipWith(peer); err != nil {
+			log.Printf("failed to gossip with %s: %v", peer, err)
+		}
+	}
+}
+
+/// A random live peer, or a random seed when none is live
+func (server *Server) gossipTarget() (Address, bool) {
+	if live := server.ListPeers(); len(live) > 0 {
+		return live[rand.IntN(len(live))], true
+	}
+
+	var seeds []Address
+	for _, seed := range server.config.Peers {
+		if seed != "" && seed != server.self.Address {
+			seeds = append(seeds, seed)
+		}
+	}
+	if len(seeds) == 0 {
+		return "", false
+	}
+	return seeds[rand.IntN(len(seeds))], true
+}
+
+func (server *Server) gossipWith(peer Address) error {
+	gossip := server.rumors(true)
+
+	var reply Gossip
+	status, err := server.callPeer(context.Background(), http.MethodPost, fmt.Sprintf("http://%s/gossip", peer), gossip, &reply)
+	if err != nil {
+		return err
+	}
+	if status != http.StatusOK {
+		return fmt.Errorf("status %d", status)
+	}
+	server.hear(reply)
+	return nil
+}
+
+/// What this server knows of every member; beat raises the heartbeat of
+/// this server and refreshes its load first
+func (server *Server) rumors(beat bool) Gossip {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+
+	if beat {
+		server.self.Heartbeat++
+		server.self.Load = server.load()
+	}
+	gossip := Gossip{From: server.self, Members: make([]Member, 0, len(server.peers))}
+	for _, peer := range server.peers {
+		gossip.Members = append(gossip.Members, peer.Member)
+	}
+	return gossip
+}
+
+/// Called with the mutex held
+func (server *Server) load() Load {
+	load := Load{Waiting: len(server.waiting)}
+	for _, match := range server.matches {
+		if match.Status == StatusPlaying {
+			load.Matches++
+		}
+	}
+	return load
+}
+
+/// Merge the rumors of a gossip
+func (server *Server) hear(gossip Gossip) {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+
+	if gossip.From.Address != "" {
+		// the sender is alive, whatever others said, like after a probe
+		if peer := server.merge(gossip.From); peer != nil && peer.Incarnation == gossip.From.Incarnation {
+			peer.Failures = 0
+			peer.LastSeen = time.Now()
+			server.setState(peer, PeerHealthy)
+		}
+	}
+	for _, member := range gossip.Members {
+		server.merge(member)
+	}
+}
+
+/// Merge a rumor about member, returning its peer when known.
+/// Called with the mutex held.
+func (server *Server) merge(member Member) *Peer {
+	if member.Address == server.self.Address {
+		if member.State != PeerHealthy && member.Incarnation >= server.self.Incarnation {
+			server.self.Incarnation = member.Incarnation + 1
+			log.Printf("refuting rumor that this server is %s, incarnation %d", member.State, server.self.Incarnation)
+		}
+		return nil
+	}
+	if removed, ok := server.removed[member.Address]; ok {
+		if member.Incarnation <= removed {
+			return nil
+		}
+		delete(server.removed, member.Address)
+	}
+
+	peer := server.findPeer(member.Address)
+	if peer == nil {
+		if member.State == PeerDead {
+			return nil
+		}
+		log.Printf("discovered peer %s", member.Address)
+		peer = &Peer{Member: member, Since: time.Now()}
+		server.peers = append(server.peers, peer)
+		return peer
+	}
+
+	switch {
+	case member.Incarnation > peer.Incarnation:
+		peer.Incarnation = member.Incarnation
+		peer.Heartbeat, peer.Load = member.Heartbeat, member.Load
+		if member.State == PeerHealthy {
+			peer.Failures = 0
+		}
+		server.setState(peer, member.State)
+	case member.Incarnation == peer.Incarnation:
+		if member.State.rank() > peer.State.rank() && !server.reachedLately(peer) {
+			server.setState(peer, member.State)
+		}
+		if member.Heartbeat > peer.Heartbeat {
+			peer.Heartbeat, peer.Load = member.Heartbeat, member.Load
+		}
+	}
+	return peer
+}
+
+/// Whether this server reached peer within the time its own probes take
+/// to suspect it. Called with the mutex held.
+func (server *Server) reachedLately(peer *Peer) bool {
+	window := time.Duration(server.config.SuspectAfter) * time.Duration(server.config.ProbeInterval)
+	return !peer.LastSeen.IsZero() && time.Since(peer.LastSeen) < window
+}
+
+/// Ask up to indirect_probes other live peers to probe peer; true when
+/// one of them reached it
+func (server *Server) probeThroughPeers(peer Address) bool {
+	var helpers []Address
+	for _, helper := range server.ListPeers() {
+		if helper != peer {
+			helpers = append(helpers, helper)
+		}
+	}
+	rand.Shuffle(len(helpers), func(i, j int) {
+		helpers[i], helpers[j] = helpers[j], helpers[i]
+	})
+	helpers = helpers[:min(len(helpers), server.config.IndirectProbes)]
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(server.config.ProbeInterval))
+	defer cancel()
+
+	var reached atomic.Bool
+	done := make(chan struct{}, len(helpers))
+	for _, helper := range helpers {
+		go func() {
+			defer func() { done <- struct{}{} }()
+			target := fmt.Sprintf("http://%s/peers/probe?addr=%s", helper, url.QueryEscape(peer))
+			status, err := server.callPeer(ctx, http.MethodGet, target, nil, nil)
+			if err == nil && status == http.StatusOK {
+				reached.Store(true)
+				cancel()
+			}
+		}()
+	}
+	for range helpers {
+		<-done
+	}
+	return reached.Load()
+}
+
+/// Exchange rumors with a peer: POST /gossip
+///
+/// Merges the gossip of the sender and answers with what this server
+/// knows, see Gossip.
+func (server *Server) gossip() http.HandlerFunc {
+	return func(writer http.ResponseWriter, request *http.Request) {
+		var gossip Gossip
+		if err := json.NewDecoder(request.Body).Decode(&gossip); err != nil {
+			http.Error(writer, "bad json", http.StatusBadRequest)
+			return
+		}
+		server.hear(gossip)
+
+		writer.Header().Set("content-type", "application/json")
+		json.NewEncoder(writer).Encode(server.rumors(false))
+	}
+}
+
+/// Probe a peer for another one: GET /peers/probe?addr=<host:port>
+///
+/// Answers 200 when the peer answered, 502 when it did not, and 404 for
+/// an unknown peer.
+func (server *Server) probeFor() http.HandlerFunc {
+	return func(writer http.ResponseWriter, request *http.Request) {
+		peer := request.URL.Query().Get("addr")
+
+		server.mutex.Lock()
+		known := server.findPeer(peer) != nil
+		server.mutex.Unlock()
+		if !known {
+			http.Error(writer, "unknown peer", http.StatusNotFound)
+			return
+		}
+
+		if err := server.probe(peer); err != nil {
+			http.Error(writer, err.Error(), http.StatusBadGateway)
+			return
+		}
+		writer.Header().Set("content-type", "text/plain")
+		writer.Write([]byte("ok\n"))
+	}
+}
+
+func validateGossip(config Config) []error {
+	var errs []error
+	if config.GossipInterval <= 0 {
+		errs = append(errs, fmt.Errorf("gossip_interval must be positive, got %s", config.GossipInterval))
+	}
+	if config.IndirectProbes < 0 {
+		errs = append(errs, fmt.Errorf("indirect_probes must not be negative, got %d", config.IndirectProbes))
+	}
+	if strings.Contains(config.Advertise, "://") {
+		errs = append(errs, fmt.Errorf("advertise %q must be host:port, without scheme", config.Advertise))
+	}
+	return errs
+}
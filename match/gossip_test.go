@@ -0,0 +1,159 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+const testPeer = "peer:8082"
+
+func gossipServer(known ...Member) *Server {
+	server := NewServer("self:8081", DefaultConfig(), nil, NewMemoryRatings())
+	for _, member := range known {
+		server.peers = append(server.peers, &Peer{Member: member})
+	}
+	return server
+}
+
+func TestMergeRumors(t *testing.T) {
+	known := Member{Address: testPeer, State: PeerSuspect, Incarnation: 5, Heartbeat: 10, Load: Load{Waiting: 1}}
+	tests := []struct {
+		name  string
+		rumor Member
+		want  Member
+	}{
+		{
+			"higher incarnation wins whatever its state",
+			Member{Address: testPeer, State: PeerHealthy, Incarnation: 6, Heartbeat: 1, Load: Load{Waiting: 3}},
+			Member{Address: testPeer, State: PeerHealthy, Incarnation: 6, Heartbeat: 1, Load: Load{Waiting: 3}},
+		},
+		{
+			"lower incarnation is ignored",
+			Member{Address: testPeer, State: PeerDead, Incarnation: 4, Heartbeat: 99},
+			known,
+		},
+		{
+			"same incarnation, healthy does not beat suspect",
+			Member{Address: testPeer, State: PeerHealthy, Incarnation: 5, Heartbeat: 10},
+			known,
+		},
+		{
+			"same incarnation, dead beats suspect",
+			Member{Address: testPeer, State: PeerDead, Incarnation: 5, Heartbeat: 10},
+			Member{Address: testPeer, State: PeerDead, Incarnation: 5, Heartbeat: 10, Load: Load{Waiting: 1}},
+		},
+		{
+			"same incarnation, higher heartbeat brings its load",
+			Member{Address: testPeer, State: PeerHealthy, Incarnation: 5, Heartbeat: 11, Load: Load{Matches: 2}},
+			Member{Address: testPeer, State: PeerSuspect, Incarnation: 5, Heartbeat: 11, Load: Load{Matches: 2}},
+		},
+		{
+			"same incarnation, lower heartbeat keeps the load",
+			Member{Address: testPeer, State: PeerSuspect, Incarnation: 5, Heartbeat: 9, Load: Load{Matches: 2}},
+			known,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			server := gossipServer(known)
+			server.merge(test.rumor)
+			if got := server.peers[0].Member; got != test.want {
+				t.Fatalf("peer = %+v, want %+v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestMergeNewMember(t *testing.T) {
+	server := gossipServer()
+	server.merge(Member{Address: testPeer, State: PeerDead, Incarnation: 1})
+	if len(server.peers) != 0 {
+		t.Fatal("learned of a member from a rumor that it is dead")
+	}
+
+	server.merge(Member{Address: testPeer, State: PeerSuspect, Incarnation: 1})
+	if len(server.peers) != 1 || server.peers[0].State != PeerSuspect {
+		t.Fatalf("peers = %+v, want the suspect member", server.PeerStatus())
+	}
+}
+
+func TestRefuteRumorAboutSelf(t *testing.T) {
+	server := gossipServer()
+	incarnation := server.self.Incarnation
+
+	server.merge(Member{Address: server.self.Address, State: PeerHealthy, Incarnation: incarnation + 3})
+	if server.self.Incarnation != incarnation {
+		t.Fatal("raised the incarnation for a rumor that this server is healthy")
+	}
+
+	server.merge(Member{Address: server.self.Address, State: PeerSuspect, Incarnation: incarnation})
+	if server.self.Incarnation != incarnation+1 {
+		t.Fatalf("incarnation %d, want %d to refute", server.self.Incarnation, incarnation+1)
+	}
+	if len(server.peers) != 0 {
+		t.Fatal("this server is among its peers")
+	}
+}
+
+func TestRemovedPeerComesBackOnRestart(t *testing.T) {
+	server := gossipServer(Member{Address: testPeer, State: PeerHealthy, Incarnation: 5})
+	server.RemovePeer(testPeer)
+
+	server.merge(Member{Address: testPeer, State: PeerHealthy, Incarnation: 5, Heartbeat: 20})
+	if len(server.peers) != 0 {
+		t.Fatal("removed peer came back with the same incarnation")
+	}
+
+	server.merge(Member{Address: testPeer, State: PeerHealthy, Incarnation: 6})
+	if len(server.peers) != 1 {
+		t.Fatal("restarted peer not learned again")
+	}
+}
+
+func TestHearMarksSenderHealthy(t *testing.T) {
+	server := gossipServer(Member{Address: testPeer, State: PeerDead, Incarnation: 5})
+	server.peers[0].Failures = 7
+
+	server.hear(Gossip{From: Member{Address: testPeer, State: PeerHealthy, Incarnation: 5}})
+	if peer := server.peers[0]; peer.State != PeerHealthy || peer.Failures != 0 {
+		t.Fatalf("sender is %s with %d failures, want healthy", peer.State, peer.Failures)
+	}
+}
+
+func TestGossipAboutSelfUsesAdvertiseAddress(t *testing.T) {
+	config := DefaultConfig()
+	config.Advertise = "match-1.internal:8081"
+	server := NewServer(config.AdvertiseAddress(), config, nil, NewMemoryRatings())
+
+	if gossip := server.rumors(true); gossip.From.Address != config.Advertise {
+		t.Fatalf("gossips as %q, want %q", gossip.From.Address, config.Advertise)
+	}
+	if match := server.draftMatch(WaitingPlayer{PlayerID: "alice"}, WaitingPlayer{PlayerID: "bob"}); match.Home != config.Advertise {
+		t.Fatalf("match home %q, want %q", match.Home, config.Advertise)
+	}
+}
+
+func TestRecentProbeOutweighsRumor(t *testing.T) {
+	config := DefaultConfig()
+	window := time.Duration(config.SuspectAfter) * time.Duration(config.ProbeInterval)
+	tests := []struct {
+		name     string
+		lastSeen time.Time
+		want     PeerState
+	}{
+		{"reached just now", time.Now(), PeerHealthy},
+		{"reached before it could be suspected", time.Now().Add(-2 * window), PeerDead},
+		{"never reached", time.Time{}, PeerDead},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			server := gossipServer(Member{Address: testPeer, State: PeerHealthy, Incarnation: 5})
+			server.peers[0].LastSeen = test.lastSeen
+
+			server.merge(Member{Address: testPeer, State: PeerDead, Incarnation: 5})
+			if state := server.peers[0].State; state != test.want {
+				t.Fatalf("peer is %s, want %s", state, test.want)
+			}
+		})
+	}
+}
@@ -1,12 +1,14 @@
 package main
 
 import (
-	"bytes"
 	"encoding/json"
 	"fmt"
 	"io"
 	"log"
 	"net/http"
+	"net/url"
+	"strconv"
+	"time"
 
 	"github.com/gorilla/websocket"
 )
@@ -34,22 +36,24 @@ func (server *Server) upgradeWebsocket() http.HandlerFunc {
 			return
 		}
 
-		connection := newPlayerConnection(websocket)
-		server.LinkPlayer(player, connection)
+		connection := newPlayerConnection(websocket, time.Duration(server.config.WriteTimeout))
+		session, resumed := server.LinkPlayer(player, request.URL.Query().Get("token"))
 
 		defer func() {
-			server.UnlinkPlayer(player)
+			server.UnlinkPlayer(player, connection)
 			websocket.Close()
 		}()
 
-		connection.sendJSON(map[string]any{
+		// a bad last replays the whole outbox
+		last, _ := strconv.ParseUint(request.URL.Query().Get("last"), 10, 64)
+		session.open(connection, map[string]any{
 			"type":      "welcome",
 			"player_id": player,
 			"server":    server.address,
-		})
+		}, last, resumed)
 
 		for {
-			_, _, err := websocket.NextReader()
+			_, data, err := websocket.ReadMessage()
 			if err != nil {
 				if err == io.EOF {
 					return
@@ -57,6 +61,23 @@ func (server *Server) upgradeWebsocket() http.HandlerFunc {
 				log.Println("ws read err:", err)
 				return
 			}
+
+			var message struct {
+				Type string `json:"type"`
+			}
+			if err := json.Unmarshal(data, &message); err != nil {
+				connection.sendJSON(map[string]any{"type": "error", "error": "bad json"})
+				continue
+			}
+
+			switch message.Type {
+			case "cancel":
+				if !server.leaveQueue(player, LeftCancelled) {
+					connection.sendJSON(map[string]any{"type": "error", "error": "player is not queued"})
+				}
+			default:
+				connection.sendJSON(map[string]any{"type": "error", "error": fmt.Sprintf("unknown message type %q", message.Type)})
+			}
 		}
 	}
 }
@@ -86,14 +107,26 @@ func (server *Server) playMatch() http.HandlerFunc {
 			http.Error(writer, "player_id required in request body", http.StatusBadRequest)
 			return
 		}
-		if len(data.Cards) != 5 {
-			http.Error(writer, "must send exactly 5 cards", http.StatusBadRequest)
+		if len(data.Cards) != server.config.HandSize {
+			http.Error(writer, fmt.Sprintf("must send exactly %d cards", server.config.HandSize), http.StatusBadRequest)
 			return
 		}
+		// the engine tells cards apart by ID
+		seen := make(map[CardID]bool, len(data.Cards))
+		for _, card := range data.Cards {
+			if seen[card.ID] {
+				http.Error(writer, fmt.Sprintf("card %q is in the hand twice", card.ID), http.StatusBadRequest)
+				return
+			}
+			seen[card.ID] = true
+		}
 
 		challenger := Challenger{
 			PlayerID: data.PlayerID,
 			Cards:    data.Cards,
+			Server:   server.address,
+			Rating:   server.ratingOf(data.PlayerID),
+			Since:    time.Now(),
 		}
 
 		// Disallow a player already in the waiting queue from playing again.
@@ -104,44 +137,25 @@ func (server *Server) playMatch() http.HandlerFunc {
 
 		// try local match
 		if match, ok := server.tryLocalMatch(challenger); ok {
-			server.notifyLocal(match.Host.ID, map[string]interface{}{"type": "match_start", "match": match})
-			server.notifyLocal(match.Guest.ID, map[string]interface{}{"type": "match_start", "match": match})
+			server.broadcast(*match, "match_start")
 			writer.Header().Set("content-type", "application/json")
 			json.NewEncoder(writer).Encode(match)
 			return
 		}
 
-		// try peers: ask each peer if they have a waiter
-		callbackURL := fmt.Sprintf("http://%s/start-remote-match", server.address)
-		tried := false
-		for _, p := range server.ListPeers() {
-			tried = true
-			body := map[string]interface{}{"player_id": data.PlayerID, "cards": data.Cards, "callback": callbackURL, "server": server.address}
-			b, _ := json.Marshal(body)
-			resp, err := http.Post(fmt.Sprintf("http://%s/find-waiter", p), "application/json", bytes.NewReader(b))
-			if err != nil {
-				log.Printf("error contacting peer %s: %v", p, err)
-				continue
-			}
-			if resp.StatusCode == http.StatusNoContent {
-				continue
-			}
-			var match Match
-			if err := json.NewDecoder(resp.Body).Decode(&match); err == nil {
-				server.notifyLocal(data.PlayerID, map[string]interface{}{
-					"type":  "match_start",
-					"match": match,
-				})
-				writer.Header().Set("content-type", "application/json")
-				json.NewEncoder(writer).Encode(match)
-				return
-			}
+		// try peers: reserve a waiter on one, and start the match there
+		if match := server.matchOnPeers(challenger); match != nil {
+			server.trackAway(*match)
+			writer.Header().Set("content-type", "application/json")
+			json.NewEncoder(writer).Encode(match)
+			return
 		}
 
 		server.enqueueWaiter(challenger)
+		server.reportQueue()
 		writer.WriteHeader(http.StatusAccepted)
 
-		if !tried {
+		if len(server.ListPeers()) == 0 {
 			writer.Write([]byte("queued local; no peers configured"))
 		} else {
 			writer.Write([]byte("queued local; no peer match found"))
@@ -150,34 +164,6 @@ func (server *Server) playMatch() http.HandlerFunc {
 
 }
 
-// / Notify the challenger
-func (server *Server) startRemoteMatch() http.HandlerFunc {
-	return func(writer http.ResponseWriter, request *http.Request) {
-		var match Match
-
-		if err := json.NewDecoder(request.Body).Decode(&match); err != nil {
-			http.Error(writer, "bad json", http.StatusBadRequest)
-			return
-		}
-
-		if match.Host.Server == server.address {
-			server.notifyLocal(match.Host.ID, map[string]any{
-				"type":  "match_start",
-				"match": match,
-			})
-		}
-
-		if match.Guest.Server == server.address {
-			server.notifyLocal(match.Guest.ID, map[string]any{
-				"type":  "match_start",
-				"match": match,
-			})
-		}
-
-		writer.WriteHeader(http.StatusOK)
-	}
-}
-
 // / Endpoint for add or list Peers
 func (server *Server) managePeers() http.HandlerFunc {
 	return func(response http.ResponseWriter, request *http.Request) {
@@ -207,3 +193,119 @@ func (server *Server) managePeers() http.HandlerFunc {
 		}
 	}
 }
+
+// / Get a match, as recorded by this server or by a peer
+// /
+// / Peers are only asked when the match is unknown here, and not asked
+// / again by them (local=true).
+func (server *Server) getMatch() http.HandlerFunc {
+	return func(writer http.ResponseWriter, request *http.Request) {
+		id := request.PathValue("id")
+
+		match, ok, err := server.lookupMatch(id)
+		if err != nil {
+			http.Error(writer, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		if !ok && request.URL.Query().Get("local") != "true" {
+			server.askPeers("/matches/"+url.PathEscape(id), func(body io.Reader) bool {
+				ok = json.NewDecoder(body).Decode(&match) == nil
+				return ok
+			})
+		}
+		if !ok {
+			http.Error(writer, "match not found", http.StatusNotFound)
+			return
+		}
+
+		writer.Header().Set("content-type", "application/json")
+		json.NewEncoder(writer).Encode(match)
+	}
+}
+
+// / Match running here, or its record
+func (server *Server) lookupMatch(id MatchID) (Match, bool, error) {
+	server.mutex.Lock()
+	if match := server.matches[id]; match != nil {
+		view := match.View()
+		server.mutex.Unlock()
+		return view, true, nil
+	}
+	server.mutex.Unlock()
+
+	record, ok, err := server.records.Get(id)
+	return record.Match, ok, err
+}
+
+// / Matches of a player, the most recent first
+// /
+// / Merges the records of this server with those of its peers, since a
+// / player may have played from several servers.
+func (server *Server) playerMatches() http.HandlerFunc {
+	return func(writer http.ResponseWriter, request *http.Request) {
+		player := request.PathValue("id")
+
+		matches, err := server.records.OfPlayer(player)
+		if err != nil {
+			http.Error(writer, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		// records of running matches lack who still has to move
+		server.mutex.Lock()
+		for i, match := range matches {
+			if live := server.matches[match.ID]; live != nil {
+				matches[i] = live.View()
+			}
+		}
+		server.mutex.Unlock()
+
+		if request.URL.Query().Get("local") != "true" {
+			byID := make(map[MatchID]int, len(matches))
+			for i, match := range matches {
+				byID[match.ID] = i
+			}
+
+			path := "/players/" + url.PathEscape(player) + "/matches"
+			server.askPeers(path, func(body io.Reader) bool {
+				var theirs []Match
+				if err := json.NewDecoder(body).Decode(&theirs); err != nil {
+					return false
+				}
+				for _, match := range theirs {
+					i, known := byID[match.ID]
+					switch {
+					case !known:
+						byID[match.ID] = len(matches)
+						matches = append(matches, match)
+					case match.Updated.After(matches[i].Updated):
+						matches[i] = match
+					}
+				}
+				return false
+			})
+			sortMatches(matches)
+		}
+
+		writer.Header().Set("content-type", "application/json")
+		json.NewEncoder(writer).Encode(matches)
+	}
+}
+
+// / GET path with local=true on each peer, until use returns true.
+// /
+// / Unreachable peers and error answers are skipped.
+func (server *Server) askPeers(path string, use func(body io.Reader) bool) {
+	for _, peer := range server.ListPeers() {
+		response, err := server.client.Get(fmt.Sprintf("http://%s%s?local=true", peer, path))
+		if err != nil {
+			log.Printf("error contacting peer %s: %v", peer, err)
+			continue
+		}
+		done := response.StatusCode == http.StatusOK && use(response.Body)
+		response.Body.Close()
+		if done {
+			return
+		}
+	}
+}
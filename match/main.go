@@ -6,13 +6,28 @@ import (
 )
 
 func main() {
-	cli := parseCli()
-	StartServer(cli.address, cli.peers)
+	config := parseCli()
+	StartServer(config)
 }
 
-func StartServer(address Address, peers []Address) {
-	server := NewServer(address)
-	for _, p := range peers {
+func StartServer(config Config) {
+	records, err := openMatchStore(config)
+	if err != nil {
+		log.Fatal(err)
+	}
+	ratings, err := openRatingStore(config)
+	if err != nil {
+		log.Fatal(err)
+	}
+	server := NewServer(config.AdvertiseAddress(), config, records, ratings)
+	if err := server.restoreMatches(); err != nil {
+		log.Fatal(err)
+	}
+	go server.syncRatings()
+	go server.runQueue()
+	go server.checkPeers()
+	go server.gossipLoop()
+	for _, p := range config.Peers {
 		if p != "" {
 			server.AddPeer(p)
 		}
@@ -21,9 +36,25 @@ func StartServer(address Address, peers []Address) {
 	// -- API --
 	http.HandleFunc("/ws", server.upgradeWebsocket())
 	http.HandleFunc("/play", server.playMatch())
-	http.HandleFunc("/find-waiter", server.FindWaiter)
-	http.HandleFunc("/start-remote-match", server.startRemoteMatch())
+	http.HandleFunc("DELETE /play", server.cancelPlay())
+	http.HandleFunc("POST /reservations", server.reserve())
+	http.HandleFunc("POST /reservations/{id}/confirm", server.confirmReservation())
+	http.HandleFunc("POST /reservations/{id}/commit", server.commitReservation())
+	http.HandleFunc("DELETE /reservations/{id}", server.releaseReservation())
+	http.HandleFunc("POST /matches/{id}/moves", server.playMove())
+	http.HandleFunc("POST /notify", server.notifyPlayer())
+	http.HandleFunc("GET /matches/{id}", server.getMatch())
+	http.HandleFunc("GET /players/{id}/matches", server.playerMatches())
+	http.HandleFunc("GET /players/{id}/rating", server.playerRating())
+	http.HandleFunc("GET /leaderboard", server.leaderboard())
+	http.HandleFunc("GET /ratings/changes", server.ratingChanges())
 	http.HandleFunc("/peers", server.managePeers())
+	http.HandleFunc("GET /peers/status", server.peerStatus())
+	http.HandleFunc("DELETE /peers/{addr}", server.removePeer())
+	http.HandleFunc("GET /peers/probe", server.probeFor())
+	http.HandleFunc("POST /gossip", server.gossip())
+	http.HandleFunc("GET /healthz", server.healthz)
+	http.HandleFunc("/openapi.json", serveOpenAPI)
 
 	// -- Frontend --
 	fs := http.FileServer(http.Dir("./match/frontend"))
@@ -32,6 +63,6 @@ func StartServer(address Address, peers []Address) {
 		fs.ServeHTTP(w, r)
 	})
 
-	log.Printf("match server listening on %s\n", address)
-	log.Fatal(http.ListenAndServe(address, nil))
+	log.Printf("match server listening on %s, reached at %s\n", config.Address(), server.address)
+	log.Fatal(http.ListenAndServe(config.Address(), nil))
 }
\ No newline at end of file
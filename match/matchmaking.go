@@ -0,0 +1,158 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"time"
+)
+
+/// Matchmaking policies
+const (
+	MatchmakingFIFO  = "fifo"
+	MatchmakingSkill = "skill"
+)
+
+/// How often waiting players are paired with each other
+const queueTick = time.Second
+
+/// Picks the waiting player a challenger plays against
+type Matchmaker interface {
+	/// Index in waiting of the opponent of challenger, -1 for none.
+	/// waiting is ordered by arrival.
+	Pick(challenger WaitingPlayer, waiting []WaitingPlayer, now time.Time) int
+}
+
+func newMatchmaker(config Config) Matchmaker {
+	if config.Matchmaking == MatchmakingFIFO {
+		return FIFOMatchmaker{}
+	}
+	return SkillMatchmaker{Window: config.RatingWindow, Growth: config.WindowGrowth}
+}
+
+/// Pairs with whoever waits the longest, whatever their rating
+type FIFOMatchmaker struct{}
+
+func (FIFOMatchmaker) Pick(challenger WaitingPlayer, waiting []WaitingPlayer, now time.Time) int {
+	for i, waiter := range waiting {
+		if waiter.PlayerID != challenger.PlayerID {
+			return i
+		}
+	}
+	return -1
+}
+
+/// Pairs with the closest rating, within a window around the rating of
+/// the waiter that widens the longer they wait
+type SkillMatchmaker struct {
+	/// Rating difference accepted right away
+	Window int
+	/// Points added to the window per second of waiting
+	Growth int
+}
+
+/// Rating difference a waiter accepts after waiting since
+func (skill SkillMatchmaker) window(since time.Time, now time.Time) int {
+	return skill.Window + int(now.Sub(since).Seconds()*float64(skill.Growth))
+}
+
+func (skill SkillMatchmaker) Pick(challenger WaitingPlayer, waiting []WaitingPlayer, now time.Time) int {
+	best, bestGap := -1, 0
+	for i, waiter := range waiting {
+		if waiter.PlayerID == challenger.PlayerID {
+			continue
+		}
+		gap := max(waiter.Rating-challenger.Rating, challenger.Rating-waiter.Rating)
+		// the longest wait of both widens the window
+		window := max(skill.window(waiter.Since, now), skill.window(challenger.Since, now))
+		// on a tie the earlier waiter wins
+		if gap <= window && (best < 0 || gap < bestGap) {
+			best, bestGap = i, gap
+		}
+	}
+	return best
+}
+
+/// Rating of a player in the current season
+func (server *Server) ratingOf(player Username) int {
+	rating, err := server.ratings.Rating(server.config.seasonAt(time.Now()), player)
+	if err != nil {
+		log.Printf("failed to read rating of %q: %v", player, err)
+		return initialRating
+	}
+	return rating.Rating
+}
+
+/// Remove and return the waiter the matchmaker pairs with challenger
+func (server *Server) takeWaiter(challenger WaitingPlayer) *WaitingPlayer {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+
+	i := server.matchmaker.Pick(challenger, server.waiting, time.Now())
+	if i < 0 {
+		return nil
+	}
+
+	waiter := server.waiting[i]
+	server.waiting = append(server.waiting[:i:i], server.waiting[i+1:]...)
+	server.recordWait(waiter)
+	return &waiter
+}
+
+/// Expire waiting players and late moves, pair the waiters as their windows
+/// widen, and tell the others where they stand
+func (server *Server) runQueue() {
+	for range time.Tick(queueTick) {
+		server.expireWaiters()
+		server.expireReservations()
+		server.expireSessions()
+		server.expireMatches()
+		for {
+			host, guest, ok := server.pairWaiters()
+			if !ok {
+				break
+			}
+			match := server.createMatch(host, guest)
+			server.broadcast(*match, "match_start")
+		}
+		server.reportQueue()
+	}
+}
+
+/// Take two waiting players the matchmaker pairs, the oldest first
+func (server *Server) pairWaiters() (WaitingPlayer, WaitingPlayer, bool) {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+
+	now := time.Now()
+	for i, waiter := range server.waiting {
+		rest := server.waiting[i+1:]
+		j := server.matchmaker.Pick(waiter, rest, now)
+		if j < 0 {
+			continue
+		}
+
+		guest := rest[j]
+		j += i + 1
+		server.waiting = append(server.waiting[:j:j], server.waiting[j+1:]...)
+		server.waiting = append(server.waiting[:i:i], server.waiting[i+1:]...)
+		server.recordWait(waiter)
+		return waiter, guest, true
+	}
+	return WaitingPlayer{}, WaitingPlayer{}, false
+}
+
+func validateMatchmaking(config Config) []error {
+	var errs []error
+	switch config.Matchmaking {
+	case MatchmakingFIFO, MatchmakingSkill:
+	default:
+		errs = append(errs, fmt.Errorf("matchmaking must be %q or %q, got %q", MatchmakingFIFO, MatchmakingSkill, config.Matchmaking))
+	}
+	if config.RatingWindow < 0 {
+		errs = append(errs, fmt.Errorf("rating_window must not be negative, got %d", config.RatingWindow))
+	}
+	if config.WindowGrowth < 0 {
+		errs = append(errs, fmt.Errorf("window_growth must not be negative, got %d", config.WindowGrowth))
+	}
+	return errs
+}
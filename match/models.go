@@ -1,5 +1,7 @@
 package main
 
+import "time"
+
 type Address = string
 type CardID = string
 type MatchID = string
@@ -21,16 +23,51 @@ type PlayerInfo struct {
 	Cards  []Card   `json:"cards"`
 }
 
+/// A match and its progress, see engine.go
 type Match struct {
-	ID     MatchID  `json:"id"`
-	Host   Host     `json:"p1"`
-	Guest  Guest    `json:"p2"`
-	Winner Username `json:"winner"`
+	ID    MatchID `json:"id"`
+	Host  Host    `json:"p1"`
+	Guest Guest   `json:"p2"`
+	/// Server running the match; moves are sent there
+	Home Address `json:"home"`
+
+	Status string `json:"status"`
+	Rounds int    `json:"rounds"`
+	/// Round being played, from 1
+	Round  int     `json:"round"`
+	Played []Round `json:"played"`
+	Score  Score   `json:"score"`
+	/// Players who did not move yet in the current round
+	Pending []Username `json:"pending,omitempty"`
+	/// Time by which the players of the current round must move, or
+	/// forfeit; zero without move_timeout
+	Deadline time.Time `json:"deadline,omitzero"`
+
+	/// Set once finished: a player ID or "draw"
+	Winner    Username `json:"winner,omitempty"`
+	Forfeited Username `json:"forfeited,omitempty"`
+
+	Started time.Time `json:"started_at"`
+	/// Last move, or start
+	Updated  time.Time `json:"updated_at"`
+	Finished time.Time `json:"finished_at,omitzero"`
+
+	/// Secret moves of the current round, host then guest
+	moves [2]*Move
 }
 
 type WaitingPlayer struct {
 	PlayerID Username `json:"player_id"`
 	Cards    []Card   `json:"cards"`
+	/// Server the player is connected to
+	Server Address `json:"server,omitempty"`
+	/// Rating in the current season, and start of the wait
+	Rating int       `json:"rating"`
+	Since  time.Time `json:"since"`
+
+	/// Position last reported to the player, and when
+	position int
+	reported time.Time
 }
 
 type Challenger = WaitingPlayer
@@ -0,0 +1,16 @@
+package main
+
+import (
+	_ "embed"
+	"net/http"
+)
+
+/// OpenAPI document of this service, kept next to the handlers it describes
+//
+//go:embed openapi.json
+var openAPISpec []byte
+
+func serveOpenAPI(writer http.ResponseWriter, request *http.Request) {
+	writer.Header().Set("Content-Type", "application/json")
+	writer.Write(openAPISpec)
+}
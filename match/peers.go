@@ -0,0 +1,274 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+/// Health of a peer, from its last probes
+type PeerState string
+
+const (
+	/// Answered its last probe
+	PeerHealthy PeerState = "healthy"
+	/// Missed suspect_after probes in a row; still used for matchmaking
+	PeerSuspect PeerState = "suspect"
+	/// Missed dead_after probes in a row; left out until it answers again
+	PeerDead PeerState = "dead"
+)
+
+/// Order of the states, for rumors of the same incarnation
+func (state PeerState) rank() int {
+	switch state {
+	case PeerSuspect:
+		return 1
+	case PeerDead:
+		return 2
+	}
+	return 0
+}
+
+/// What servers gossip about a server, see gossip.go
+type Member struct {
+	Address Address   `json:"address"`
+	State   PeerState `json:"state"`
+	/// Raised by the server itself at every start, and to refute rumors
+	/// that it is suspect or dead
+	Incarnation uint64 `json:"incarnation"`
+	/// Raised by the server itself at every gossip round, to date its load
+	Heartbeat uint64 `json:"heartbeat"`
+	Load      Load   `json:"load"`
+}
+
+/// How busy a server is
+type Load struct {
+	Waiting int `json:"waiting"`
+	Matches int `json:"matches"`
+}
+
+/// Peer server, as seen by this one
+type Peer struct {
+	Member
+	/// Probes missed in a row
+	Failures  int       `json:"failures"`
+	LastSeen  time.Time `json:"last_seen,omitzero"`
+	LastError string    `json:"last_error,omitempty"`
+	/// In this state since
+	Since time.Time `json:"since"`
+}
+
+func (server *Server) AddPeer(peer Address) {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+
+	if peer == server.self.Address || server.findPeer(peer) != nil {
+		return
+	}
+	delete(server.removed, peer)
+	server.peers = append(server.peers, &Peer{
+		Member: Member{Address: peer, State: PeerHealthy},
+		Since:  time.Now(),
+	})
+}
+
+/// Forget a peer; false when it was not known. Gossip brings it back
+/// only once it restarts.
+func (server *Server) RemovePeer(peer Address) bool {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+
+	for i, known := range server.peers {
+		if known.Address == peer {
+			server.peers = append(server.peers[:i:i], server.peers[i+1:]...)
+			server.removed[peer] = known.Incarnation
+			return true
+		}
+	}
+	return false
+}
+
+/// Peers not dead, for matchmaking and lookups
+func (server *Server) ListPeers() []Address {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+
+	out := make([]Address, 0, len(server.peers))
+	for _, peer := range server.peers {
+		if peer.State != PeerDead {
+			out = append(out, peer.Address)
+		}
+	}
+	return out
+}
+
+/// Every known peer with its health
+func (server *Server) PeerStatus() []Peer {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+
+	out := make([]Peer, len(server.peers))
+	for i, peer := range server.peers {
+		out[i] = *peer
+	}
+	return out
+}
+
+/// Called with the mutex held
+func (server *Server) findPeer(address Address) *Peer {
+	for _, peer := range server.peers {
+		if peer.Address == address {
+			return peer
+		}
+	}
+	return nil
+}
+
+/// Probe every peer each probe_interval, dead ones included so they
+/// come back when they answer again
+func (server *Server) checkPeers() {
+	for range time.Tick(time.Duration(server.config.ProbeInterval)) {
+		peers := server.PeerStatus()
+
+		var wait sync.WaitGroup
+		for _, peer := range peers {
+			wait.Go(func() {
+				err := server.probe(peer.Address)
+				if err != nil && server.probeThroughPeers(peer.Address) {
+					err = nil
+				}
+				server.probed(peer.Address, err)
+			})
+		}
+		wait.Wait()
+		server.forgetPeers()
+	}
+}
+
+/// Ask a peer whether it is up, within probe_interval
+func (server *Server) probe(peer Address) error {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(server.config.ProbeInterval))
+	defer cancel()
+
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, fmt.Sprintf("http://%s/healthz", peer), nil)
+	if err != nil {
+		return err
+	}
+	response, err := server.client.Do(request)
+	if err != nil {
+		return err
+	}
+	response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return fmt.Errorf("status %d", response.StatusCode)
+	}
+	return nil
+}
+
+/// Move a peer between states with the outcome of its probe
+func (server *Server) probed(address Address, err error) {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+
+	peer := server.findPeer(address)
+	if peer == nil {
+		// removed meanwhile
+		return
+	}
+
+	state := peer.State
+	if err == nil {
+		peer.Failures = 0
+		peer.LastSeen = time.Now()
+		peer.LastError = ""
+		state = PeerHealthy
+	} else {
+		peer.Failures++
+		peer.LastError = err.Error()
+		switch {
+		case peer.Failures >= server.config.DeadAfter:
+			state = PeerDead
+		case peer.Failures >= server.config.SuspectAfter:
+			state = PeerSuspect
+		}
+	}
+
+	server.setState(peer, state)
+}
+
+/// Called with the mutex held
+func (server *Server) setState(peer *Peer, state PeerState) {
+	if state != peer.State {
+		log.Printf("peer %s is %s (was %s)", peer.Address, state, peer.State)
+		peer.State = state
+		peer.Since = time.Now()
+	}
+}
+
+/// Remove the peers dead for longer than forget_after
+func (server *Server) forgetPeers() {
+	if server.config.ForgetAfter == 0 {
+		return
+	}
+
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+
+	kept := server.peers[:0]
+	for _, peer := range server.peers {
+		if peer.State == PeerDead && time.Since(peer.Since) >= time.Duration(server.config.ForgetAfter) {
+			log.Printf("forgetting peer %s, dead since %s", peer.Address, peer.Since.Format(time.RFC3339))
+			continue
+		}
+		kept = append(kept, peer)
+	}
+	server.peers = kept
+}
+
+/// Answers 200 while the process is up; peers probe it
+func (server *Server) healthz(writer http.ResponseWriter, request *http.Request) {
+	writer.Header().Set("content-type", "text/plain")
+	writer.Write([]byte("ok\n"))
+}
+
+/// Every known peer with its health: GET /peers/status
+func (server *Server) peerStatus() http.HandlerFunc {
+	return func(writer http.ResponseWriter, request *http.Request) {
+		writer.Header().Set("content-type", "application/json")
+		json.NewEncoder(writer).Encode(server.PeerStatus())
+	}
+}
+
+/// Forget a peer: DELETE /peers/{addr}
+///
+/// Answers 204, or 404 when the peer is not known.
+func (server *Server) removePeer() http.HandlerFunc {
+	return func(writer http.ResponseWriter, request *http.Request) {
+		if !server.RemovePeer(request.PathValue("addr")) {
+			http.Error(writer, "unknown peer", http.StatusNotFound)
+			return
+		}
+		writer.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func validateProbes(config Config) []error {
+	var errs []error
+	if config.ProbeInterval <= 0 {
+		errs = append(errs, fmt.Errorf("probe_interval must be positive, got %s", config.ProbeInterval))
+	}
+	if config.SuspectAfter <= 0 {
+		errs = append(errs, fmt.Errorf("suspect_after must be positive, got %d", config.SuspectAfter))
+	}
+	if config.DeadAfter < config.SuspectAfter {
+		errs = append(errs, fmt.Errorf("dead_after must be at least suspect_after %d, got %d", config.SuspectAfter, config.DeadAfter))
+	}
+	if config.ForgetAfter < 0 {
+		errs = append(errs, fmt.Errorf("forget_after must not be negative, got %s", config.ForgetAfter))
+	}
+	return errs
+}
@@ -0,0 +1,279 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"time"
+)
+
+/// Message pushed to the players of a match
+///
+/// Types: match_start, opponent_moved, round_result and match_end.
+type MatchMessage struct {
+	Type  string `json:"type"`
+	Match Match  `json:"match"`
+}
+
+/// Message for a player connected to another server, see /notify
+type Notification struct {
+	PlayerID Username `json:"player_id"`
+	MatchMessage
+}
+
+/// Notifications queued for a server before new ones are dropped
+const notifyQueueSize = 1024
+
+/// Queue match messages for a player, on this server or on its own.
+/// Called with the mutex held.
+///
+/// Each server has one queue and one sender, so the messages reach it
+/// in the order they were queued.
+func (server *Server) notify(player PlayerInfo, messages ...MatchMessage) {
+	queue, ok := server.notifiers[player.Server]
+	if !ok {
+		queue = make(chan Notification, notifyQueueSize)
+		server.notifiers[player.Server] = queue
+		go server.sendNotifications(player.Server, queue)
+	}
+
+	for _, message := range messages {
+		select {
+		case queue <- Notification{PlayerID: player.ID, MatchMessage: message}:
+		default:
+			log.Printf("notifications for %s are backed up, dropping %s for %q", player.Server, message.Type, player.ID)
+		}
+	}
+}
+
+/// Deliver the notifications queued for a server, one at a time
+func (server *Server) sendNotifications(peer Address, queue <-chan Notification) {
+	url := fmt.Sprintf("http://%s/notify", peer)
+	for notification := range queue {
+		if peer == server.address {
+			server.notifyLocal(notification.PlayerID, notification.MatchMessage)
+			continue
+		}
+
+		body, _ := json.Marshal(notification)
+		response, err := server.client.Post(url, "application/json", bytes.NewReader(body))
+		if err != nil {
+			log.Printf("failed to notify %q on %s: %v", notification.PlayerID, peer, err)
+			continue
+		}
+		response.Body.Close()
+	}
+}
+
+/// Queue match messages for both players
+func (server *Server) broadcast(match Match, types ...string) {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+
+	server.broadcastLocked(match, types...)
+}
+
+/// Called with the mutex held, so messages about a match are queued in
+/// the order it changed
+func (server *Server) broadcastLocked(match Match, types ...string) {
+	messages := make([]MatchMessage, len(types))
+	for i, kind := range types {
+		messages[i] = MatchMessage{Type: kind, Match: match}
+	}
+	server.notify(match.Host, messages...)
+	server.notify(match.Guest, messages...)
+}
+
+/// Record a match running on a peer, and remember where it runs until
+/// it ends
+func (server *Server) trackAway(match Match) {
+	if match.Home == server.address {
+		return
+	}
+
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+
+	// messages for both players may arrive out of order
+	known, ok, err := server.records.Get(match.ID)
+	if err != nil {
+		log.Printf("failed to read match %s: %v", match.ID, err)
+	}
+	if !ok || !known.Updated.After(match.Updated) {
+		if err := server.records.Save(MatchRecord{Match: match}); err != nil {
+			log.Printf("failed to record match %s: %v", match.ID, err)
+		}
+	}
+
+	if match.Status == StatusFinished {
+		delete(server.away, match.ID)
+	} else {
+		server.away[match.ID] = match.Home
+	}
+}
+
+/// Play a round of a match, or give it up
+///
+/// Moves stay secret until both players moved; the round is then
+/// resolved and both players get a round_result, and a match_end after
+/// the last round. A move for a match running on a peer is forwarded
+/// there.
+///
+/// Request Body Format:
+/// 	{
+///			"player_id": string,
+///			"attacker": card id,
+///			"defender": card id,
+///			"tactic": "balanced" | "attacking" | "defensive"
+/// 	}
+/// or, to give up: { "player_id": string, "forfeit": true }
+func (server *Server) playMove() http.HandlerFunc {
+	return func(writer http.ResponseWriter, request *http.Request) {
+		id := request.PathValue("id")
+
+		server.mutex.Lock()
+		match := server.matches[id]
+		home := server.away[id]
+		server.mutex.Unlock()
+
+		if match == nil && home != "" {
+			server.forward(writer, request, home)
+			return
+		}
+		if match == nil {
+			if _, ok, _ := server.records.Get(id); ok {
+				http.Error(writer, errFinished.Error(), http.StatusConflict)
+				return
+			}
+			http.Error(writer, "match not found", http.StatusNotFound)
+			return
+		}
+
+		var data struct {
+			PlayerID Username `json:"player_id"`
+			Forfeit  bool     `json:"forfeit"`
+			Move
+		}
+		if err := json.NewDecoder(request.Body).Decode(&data); err != nil {
+			http.Error(writer, "bad json", http.StatusBadRequest)
+			return
+		}
+
+		server.mutex.Lock()
+		var resolved bool
+		var err error
+		if data.Forfeit {
+			err = match.Forfeit(data.PlayerID)
+		} else {
+			resolved, err = match.Play(data.PlayerID, data.Move)
+		}
+		if resolved {
+			match.startTurn(time.Duration(server.config.MoveTimeout))
+		}
+		view := match.View()
+		if err == nil {
+			server.save(match)
+			switch {
+			case data.Forfeit:
+				server.broadcastLocked(view, "match_end")
+			case resolved && view.Status == StatusFinished:
+				server.broadcastLocked(view, "round_result", "match_end")
+			case resolved:
+				server.broadcastLocked(view, "round_result")
+			default:
+				server.broadcastLocked(view, "opponent_moved")
+			}
+		}
+		if view.Status == StatusFinished {
+			delete(server.matches, id)
+		}
+		server.mutex.Unlock()
+
+		switch {
+		case errors.Is(err, errNotInMatch):
+			http.Error(writer, err.Error(), http.StatusForbidden)
+			return
+		case errors.Is(err, errFinished), errors.Is(err, errAlreadyMoved):
+			http.Error(writer, err.Error(), http.StatusConflict)
+			return
+		case err != nil:
+			http.Error(writer, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		if view.Status == StatusFinished {
+			server.rate(view)
+		}
+
+		writer.Header().Set("content-type", "application/json")
+		json.NewEncoder(writer).Encode(view)
+	}
+}
+
+/// End the matches whose players did not move by the deadline of the
+/// round, and tell both players as a forfeit does
+func (server *Server) expireMatches() {
+	var ended []Match
+
+	server.mutex.Lock()
+	now := time.Now()
+	for id, match := range server.matches {
+		late := match.Expire(now)
+		if len(late) == 0 {
+			continue
+		}
+		log.Printf("match %s: %v did not move in time, winner %q", id, late, match.Winner)
+		view := match.View()
+		server.save(match)
+		server.broadcastLocked(view, "match_end")
+		delete(server.matches, id)
+		ended = append(ended, view)
+	}
+	server.mutex.Unlock()
+
+	for _, view := range ended {
+		server.rate(view)
+	}
+}
+
+/// Proxy a request to the server running the match
+func (server *Server) forward(writer http.ResponseWriter, request *http.Request, home Address) {
+	body, _ := io.ReadAll(request.Body)
+	url := fmt.Sprintf("http://%s%s", home, request.URL.RequestURI())
+
+	response, err := server.client.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		http.Error(writer, "match server unreachable: "+err.Error(), http.StatusBadGateway)
+		return
+	}
+	defer response.Body.Close()
+
+	writer.Header().Set("content-type", response.Header.Get("content-type"))
+	writer.WriteHeader(response.StatusCode)
+	io.Copy(writer, response.Body)
+}
+
+/// Deliver a match message sent by the server running the match
+func (server *Server) notifyPlayer() http.HandlerFunc {
+	return func(writer http.ResponseWriter, request *http.Request) {
+		var notification Notification
+		if err := json.NewDecoder(request.Body).Decode(&notification); err != nil {
+			http.Error(writer, "bad json", http.StatusBadRequest)
+			return
+		}
+
+		server.trackAway(notification.Match)
+		if notification.Type == "match_start" {
+			// queued again after a pairing whose end it did not hear of
+			server.mutex.Lock()
+			server.removeWaiter(notification.PlayerID)
+			server.mutex.Unlock()
+		}
+		server.notifyLocal(notification.PlayerID, notification.MatchMessage)
+		writer.WriteHeader(http.StatusOK)
+	}
+}
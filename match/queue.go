@@ -0,0 +1,145 @@
+package main
+
+import (
+	"net/http"
+	"time"
+)
+
+/// Why a player left the queue without a match
+const (
+	LeftCancelled = "cancelled"
+	LeftExpired   = "expired"
+)
+
+/// How often a waiting player is told their status when it stays the same
+const queueStatusEvery = 5 * time.Second
+
+/// Place of a player in the queue, sent over their websocket
+type QueueStatus struct {
+	Type string `json:"type"`
+	/// From 1, by arrival
+	Position int `json:"position"`
+	Size     int `json:"size"`
+	/// Seconds waited so far
+	Waited int `json:"waited"`
+	/// Seconds left before the player is paired, estimated from the
+	/// waits of the last players paired here; absent until one was
+	ETA *int `json:"eta,omitempty"`
+	/// Seconds left before the entry expires
+	Expires int `json:"expires"`
+}
+
+/// Remove player from the queue, or from a reservation not committed
+/// yet; false when they were in neither. Called with the mutex held.
+func (server *Server) removeWaiter(player Username) bool {
+	for i, waiter := range server.waiting {
+		if waiter.PlayerID == player {
+			server.waiting = append(server.waiting[:i:i], server.waiting[i+1:]...)
+			return true
+		}
+	}
+	return server.dropReservations(player)
+}
+
+/// Remove player from the queue and tell them why
+func (server *Server) leaveQueue(player Username, reason string) bool {
+	server.mutex.Lock()
+	removed := server.removeWaiter(player)
+	server.mutex.Unlock()
+
+	if removed {
+		server.notifyLocal(player, map[string]any{"type": "queue_left", "reason": reason})
+	}
+	return removed
+}
+
+/// Account for the wait of a player leaving the queue for a match.
+/// Called with the mutex held.
+func (server *Server) recordWait(waiter WaitingPlayer) {
+	wait := time.Since(waiter.Since)
+	if server.typicalWait == 0 {
+		server.typicalWait = wait
+		return
+	}
+	// moving average, recent waits weigh more
+	server.typicalWait = (4*server.typicalWait + wait) / 5
+}
+
+/// Drop the entries waiting for longer than queue_timeout
+func (server *Server) expireWaiters() {
+	timeout := time.Duration(server.config.QueueTimeout)
+
+	server.mutex.Lock()
+	var expired []Username
+	for _, waiter := range server.waiting {
+		if time.Since(waiter.Since) >= timeout {
+			expired = append(expired, waiter.PlayerID)
+		}
+	}
+	server.mutex.Unlock()
+
+	for _, player := range expired {
+		server.leaveQueue(player, LeftExpired)
+	}
+}
+
+/// Send their status to the waiting players whose position changed, or
+/// who were not told for a while
+func (server *Server) reportQueue() {
+	now := time.Now()
+	timeout := time.Duration(server.config.QueueTimeout)
+
+	server.mutex.Lock()
+	var players []Username
+	var statuses []QueueStatus
+	for i := range server.waiting {
+		waiter := &server.waiting[i]
+		if waiter.position == i+1 && now.Sub(waiter.reported) < queueStatusEvery {
+			continue
+		}
+		waiter.position, waiter.reported = i+1, now
+
+		waited := now.Sub(waiter.Since)
+		status := QueueStatus{
+			Type:     "queue_status",
+			Position: i + 1,
+			Size:     len(server.waiting),
+			Waited:   seconds(waited),
+			Expires:  seconds(timeout - waited),
+		}
+		if server.typicalWait > 0 {
+			eta := seconds(max(server.typicalWait-waited, 0))
+			status.ETA = &eta
+		}
+		players = append(players, waiter.PlayerID)
+		statuses = append(statuses, status)
+	}
+	server.mutex.Unlock()
+
+	for i, player := range players {
+		server.notifyLocal(player, statuses[i])
+	}
+}
+
+func seconds(duration time.Duration) int {
+	return int(duration.Round(time.Second).Seconds())
+}
+
+/// Leave the queue: DELETE /play?player_id=<id>
+///
+/// Answers 204 when the player was queued, 404 otherwise.
+func (server *Server) cancelPlay() http.HandlerFunc {
+	return func(writer http.ResponseWriter, request *http.Request) {
+		player := request.URL.Query().Get("player_id")
+		if player == "" {
+			http.Error(writer, "player_id required as query param", http.StatusBadRequest)
+			return
+		}
+
+		if !server.leaveQueue(player, LeftCancelled) {
+			http.Error(writer, "player is not queued", http.StatusNotFound)
+			return
+		}
+		writer.WriteHeader(http.StatusNoContent)
+	}
+}
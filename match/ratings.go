@@ -0,0 +1,513 @@
+package main
+
+import (
+	"cmp"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+)
+
+/// Ratings
+///
+/// Players have an Elo rating per season, starting at initialRating.
+/// The server running a match rates it once it is finished: it turns
+/// the result into a RatingChange, applies it and logs it. Peers pull
+/// the log of every server they know and apply the changes they miss.
+///
+/// A change is applied at most once per match ID, and only adds points,
+/// so servers agree on the ratings whatever the order they learn the
+/// changes in. A log that starts over, on a server restarted without
+/// data_dir, gets a new epoch: peers then read it again from the start.
+
+const (
+	initialRating = 1200
+	/// Points at stake in a match between players of the same rating
+	eloK = 32
+)
+
+/// How often changes are pulled from peers
+const ratingsSyncEvery = 2 * time.Second
+
+/// Players are grouped by rating in divisions
+type Division struct {
+	Name string
+	/// Lowest rating of the division
+	Min int
+}
+
+/// Divisions, the highest first
+var divisions = []Division{
+	{"diamond", 1600},
+	{"platinum", 1450},
+	{"gold", 1300},
+	{"silver", 1150},
+	{"bronze", math.MinInt},
+}
+
+func divisionOf(rating int) string {
+	for _, division := range divisions {
+		if rating >= division.Min {
+			return division.Name
+		}
+	}
+	return ""
+}
+
+/// Standing of a player in a season
+type Rating struct {
+	PlayerID Username `json:"player_id"`
+	Rating   int      `json:"rating"`
+	Division string   `json:"division"`
+	Matches  int      `json:"matches"`
+	Wins     int      `json:"wins"`
+	Losses   int      `json:"losses"`
+	Draws    int      `json:"draws"`
+}
+
+func newRating(player Username) Rating {
+	return Rating{PlayerID: player, Rating: initialRating, Division: divisionOf(initialRating)}
+}
+
+/// Result of a match for one player
+type RatingDelta struct {
+	PlayerID Username `json:"player_id"`
+	Points   int      `json:"points"`
+	/// 1 for a win, 0.5 for a draw, 0 for a loss
+	Result float64 `json:"result"`
+}
+
+/// Rating update made of a finished match
+type RatingChange struct {
+	MatchID MatchID       `json:"match_id"`
+	Season  int           `json:"season"`
+	Deltas  []RatingDelta `json:"deltas"`
+	/// Position in the log of the server that rated the match
+	Seq uint64 `json:"seq,omitempty"`
+}
+
+/// Add the change to rating, which must be one of its players
+func (change RatingChange) applyTo(rating *Rating) {
+	for _, delta := range change.Deltas {
+		if delta.PlayerID != rating.PlayerID {
+			continue
+		}
+		rating.Rating += delta.Points
+		rating.Division = divisionOf(rating.Rating)
+		rating.Matches++
+		switch delta.Result {
+		case 1:
+			rating.Wins++
+		case 0:
+			rating.Losses++
+		default:
+			rating.Draws++
+		}
+	}
+}
+
+/// Elo update of a finished match, with the current ratings of its players
+func eloChange(match Match, season int, host Rating, guest Rating) RatingChange {
+	result := 0.5
+	switch match.Winner {
+	case match.Host.ID:
+		result = 1
+	case match.Guest.ID:
+		result = 0
+	}
+
+	expected := 1 / (1 + math.Pow(10, float64(guest.Rating-host.Rating)/400))
+	points := int(math.Round(eloK * (result - expected)))
+
+	return RatingChange{
+		MatchID: match.ID,
+		Season:  season,
+		Deltas: []RatingDelta{
+			{PlayerID: match.Host.ID, Points: points, Result: result},
+			{PlayerID: match.Guest.ID, Points: -points, Result: 1 - result},
+		},
+	}
+}
+
+/// Season of a time, from 1; times before the first season count in it
+func (config Config) seasonAt(at time.Time) int {
+	if at.Before(config.SeasonStart) {
+		return 1
+	}
+	return int(at.Sub(config.SeasonStart)/time.Duration(config.SeasonLength)) + 1
+}
+
+/// Start and end of a season
+func (config Config) seasonBounds(season int) (time.Time, time.Time) {
+	length := time.Duration(config.SeasonLength)
+	start := config.SeasonStart.Add(time.Duration(season-1) * length)
+	return start, start.Add(length)
+}
+
+/// Where a server keeps ratings, and the log of the changes it made
+type RatingStore interface {
+	/// Apply change unless its match was already rated; with origin set,
+	/// the change is also added to the log with the next Seq
+	Apply(change RatingChange, origin bool) (bool, error)
+	Rating(season int, player Username) (Rating, error)
+	/// Every rated player of a season
+	Season(season int) ([]Rating, error)
+
+	/// Changes of the log after seq, and the last seq of the log
+	Changes(after uint64) ([]RatingChange, uint64, error)
+	/// Identifies the log; a new one starts with a new epoch
+	Epoch() string
+	/// Position in the log of peer applied here
+	Cursor(peer Address) (LogCursor, error)
+	SetCursor(peer Address, cursor LogCursor) error
+
+	Close() error
+}
+
+/// Position in the rating log of a peer
+type LogCursor struct {
+	Epoch string `json:"epoch"`
+	/// Last seq applied
+	Seq uint64 `json:"seq"`
+}
+
+/// File of the ratings, in the data directory
+const ratingsFile = "ratings.db"
+
+/// Ratings are kept in data_dir when set, in memory otherwise
+func openRatingStore(config Config) (RatingStore, error) {
+	if config.DataDir == "" {
+		return NewMemoryRatings(), nil
+	}
+
+	path := filepath.Join(config.DataDir, ratingsFile)
+	store, err := OpenBoltRatings(path)
+	if err != nil {
+		return nil, fmt.Errorf("ratings: %s: %w", path, err)
+	}
+	return store, nil
+}
+
+/// Ratings lost on restart, used without data_dir
+type MemoryRatings struct {
+	mutex   sync.RWMutex
+	seasons map[int]map[Username]Rating
+	rated   map[MatchID]bool
+	log     []RatingChange
+	epoch   string
+	cursors map[Address]LogCursor
+}
+
+func NewMemoryRatings() *MemoryRatings {
+	return &MemoryRatings{
+		seasons: make(map[int]map[Username]Rating),
+		rated:   make(map[MatchID]bool),
+		epoch:   newSessionToken(),
+		cursors: make(map[Address]LogCursor),
+	}
+}
+
+func (store *MemoryRatings) Apply(change RatingChange, origin bool) (bool, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	if store.rated[change.MatchID] {
+		return false, nil
+	}
+	store.rated[change.MatchID] = true
+
+	if store.seasons[change.Season] == nil {
+		store.seasons[change.Season] = make(map[Username]Rating)
+	}
+	ratings := store.seasons[change.Season]
+	for _, delta := range change.Deltas {
+		rating, ok := ratings[delta.PlayerID]
+		if !ok {
+			rating = newRating(delta.PlayerID)
+		}
+		change.applyTo(&rating)
+		ratings[delta.PlayerID] = rating
+	}
+
+	if origin {
+		change.Seq = uint64(len(store.log)) + 1
+		store.log = append(store.log, change)
+	}
+	return true, nil
+}
+
+func (store *MemoryRatings) Rating(season int, player Username) (Rating, error) {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+
+	if rating, ok := store.seasons[season][player]; ok {
+		return rating, nil
+	}
+	return newRating(player), nil
+}
+
+func (store *MemoryRatings) Season(season int) ([]Rating, error) {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+
+	ratings := []Rating{}
+	for _, rating := range store.seasons[season] {
+		ratings = append(ratings, rating)
+	}
+	return ratings, nil
+}
+
+func (store *MemoryRatings) Changes(after uint64) ([]RatingChange, uint64, error) {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+
+	last := uint64(len(store.log))
+	if after >= last {
+		return []RatingChange{}, last, nil
+	}
+	return slices.Clone(store.log[after:]), last, nil
+}
+
+/// New at every start, as the log is
+func (store *MemoryRatings) Epoch() string {
+	return store.epoch
+}
+
+func (store *MemoryRatings) Cursor(peer Address) (LogCursor, error) {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+
+	return store.cursors[peer], nil
+}
+
+func (store *MemoryRatings) SetCursor(peer Address, cursor LogCursor) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	store.cursors[peer] = cursor
+	return nil
+}
+
+func (store *MemoryRatings) Close() error {
+	return nil
+}
+
+/// Rate a finished match run here, once
+func (server *Server) rate(match Match) {
+	season := server.config.seasonAt(match.Finished)
+
+	host, err := server.ratings.Rating(season, match.Host.ID)
+	if err == nil {
+		var guest Rating
+		guest, err = server.ratings.Rating(season, match.Guest.ID)
+		if err == nil {
+			_, err = server.ratings.Apply(eloChange(match, season, host, guest), true)
+		}
+	}
+	if err != nil {
+		log.Printf("failed to rate match %s: %v", match.ID, err)
+	}
+}
+
+/// Pull the changes made by peers, forever
+func (server *Server) syncRatings() {
+	for range time.Tick(ratingsSyncEvery) {
+		for _, peer := range server.ListPeers() {
+			if err := server.pullRatings(peer); err != nil {
+				log.Printf("failed to pull ratings from %s: %v", peer, err)
+			}
+		}
+	}
+}
+
+func (server *Server) pullRatings(peer Address) error {
+	cursor, err := server.ratings.Cursor(peer)
+	if err != nil {
+		return err
+	}
+
+	url := fmt.Sprintf("http://%s/ratings/changes?after=%d", peer, cursor.Seq)
+	response, err := server.client.Get(url)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return fmt.Errorf("status %d", response.StatusCode)
+	}
+
+	var page struct {
+		Epoch   string         `json:"epoch"`
+		Last    uint64         `json:"last"`
+		Changes []RatingChange `json:"changes"`
+	}
+	if err := json.NewDecoder(response.Body).Decode(&page); err != nil {
+		return err
+	}
+
+	// the peer started a new log, whatever its length: read it from the
+	// start at the next pull; changes already applied are skipped
+	if page.Epoch != cursor.Epoch && cursor.Seq > 0 {
+		return server.ratings.SetCursor(peer, LogCursor{Epoch: page.Epoch})
+	}
+
+	for _, change := range page.Changes {
+		if _, err := server.ratings.Apply(change, false); err != nil {
+			return err
+		}
+	}
+	return server.ratings.SetCursor(peer, LogCursor{Epoch: page.Epoch, Seq: page.Last})
+}
+
+/// Ratings of a season, the best first
+func (server *Server) standings(season int) ([]Rating, error) {
+	ratings, err := server.ratings.Season(season)
+	if err != nil {
+		return nil, err
+	}
+	slices.SortFunc(ratings, func(a, b Rating) int {
+		return cmp.Or(cmp.Compare(b.Rating, a.Rating), cmp.Compare(a.PlayerID, b.PlayerID))
+	})
+	return ratings, nil
+}
+
+/// Page of the leaderboard
+type Leaderboard struct {
+	Season   int       `json:"season"`
+	Start    time.Time `json:"season_start"`
+	End      time.Time `json:"season_end"`
+	Division string    `json:"division,omitempty"`
+	/// Players in the leaderboard, or in the division
+	Total   int        `json:"total"`
+	Offset  int        `json:"offset"`
+	Limit   int        `json:"limit"`
+	Players []Standing `json:"players"`
+}
+
+/// Rating and rank of a player in the season, divisions included
+type Standing struct {
+	Rank int `json:"rank"`
+	Rating
+}
+
+const (
+	defaultLeaderboardLimit = 20
+	maxLeaderboardLimit     = 100
+)
+
+/// Query parameter as a number, or fallback when absent
+func intParam(request *http.Request, name string, fallback int) (int, error) {
+	value := request.URL.Query().Get(name)
+	if value == "" {
+		return fallback, nil
+	}
+	number, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, fmt.Errorf("%s must be a number, got %q", name, value)
+	}
+	return number, nil
+}
+
+/// Leaderboard of a season, the current one by default
+///
+/// Query: season, division, offset and limit (20 by default, at most 100)
+func (server *Server) leaderboard() http.HandlerFunc {
+	return func(writer http.ResponseWriter, request *http.Request) {
+		current := server.config.seasonAt(time.Now())
+		season, err := intParam(request, "season", current)
+		if err == nil && (season < 1 || season > current) {
+			err = fmt.Errorf("season must be between 1 and %d, got %d", current, season)
+		}
+		offset, offsetErr := intParam(request, "offset", 0)
+		if offsetErr == nil && offset < 0 {
+			offsetErr = fmt.Errorf("offset must not be negative, got %d", offset)
+		}
+		limit, limitErr := intParam(request, "limit", defaultLeaderboardLimit)
+		if limitErr == nil && (limit < 1 || limit > maxLeaderboardLimit) {
+			limitErr = fmt.Errorf("limit must be between 1 and %d, got %d", maxLeaderboardLimit, limit)
+		}
+		division := request.URL.Query().Get("division")
+		if division != "" && !slices.ContainsFunc(divisions, func(d Division) bool { return d.Name == division }) {
+			err = errors.Join(err, fmt.Errorf("unknown division %q", division))
+		}
+		if err := errors.Join(err, offsetErr, limitErr); err != nil {
+			http.Error(writer, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		ratings, err := server.standings(season)
+		if err != nil {
+			http.Error(writer, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		standings := []Standing{}
+		for i, rating := range ratings {
+			if division == "" || rating.Division == division {
+				standings = append(standings, Standing{Rank: i + 1, Rating: rating})
+			}
+		}
+
+		start, end := server.config.seasonBounds(season)
+		board := Leaderboard{
+			Season:   season,
+			Start:    start,
+			End:      end,
+			Division: division,
+			Total:    len(standings),
+			Offset:   offset,
+			Limit:    limit,
+			Players:  standings[min(offset, len(standings)):min(offset+limit, len(standings))],
+		}
+
+		writer.Header().Set("content-type", "application/json")
+		json.NewEncoder(writer).Encode(board)
+	}
+}
+
+/// Rating of a player in a season, the current one by default
+func (server *Server) playerRating() http.HandlerFunc {
+	return func(writer http.ResponseWriter, request *http.Request) {
+		season, err := intParam(request, "season", server.config.seasonAt(time.Now()))
+		if err != nil {
+			http.Error(writer, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		rating, err := server.ratings.Rating(season, request.PathValue("id"))
+		if err != nil {
+			http.Error(writer, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		writer.Header().Set("content-type", "application/json")
+		json.NewEncoder(writer).Encode(rating)
+	}
+}
+
+/// Changes of the matches rated by this server, pulled by peers
+func (server *Server) ratingChanges() http.HandlerFunc {
+	return func(writer http.ResponseWriter, request *http.Request) {
+		after, err := intParam(request, "after", 0)
+		if err != nil || after < 0 {
+			http.Error(writer, "after must be a positive number", http.StatusBadRequest)
+			return
+		}
+
+		changes, last, err := server.ratings.Changes(uint64(after))
+		if err != nil {
+			http.Error(writer, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		writer.Header().Set("content-type", "application/json")
+		json.NewEncoder(writer).Encode(map[string]any{"epoch": server.ratings.Epoch(), "last": last, "changes": changes})
+	}
+}
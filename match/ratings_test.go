@@ -0,0 +1,126 @@
+package main
+
+import (
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestEloChange(t *testing.T) {
+	tests := []struct {
+		name        string
+		host, guest int
+		winner      Username
+		points      int
+	}{
+		{"even, host wins", 1200, 1200, "alice", 16},
+		{"even, guest wins", 1200, 1200, "bob", -16},
+		{"even, draw", 1200, 1200, Draw, 0},
+		{"favorite wins", 1400, 1200, "alice", 8},
+		{"underdog wins", 1400, 1200, "bob", -24},
+		{"draw moves points to the lower rating", 1400, 1200, Draw, -8},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			match := Match{ID: "m1", Host: Host{ID: "alice"}, Guest: Guest{ID: "bob"}, Winner: test.winner}
+			change := eloChange(match, 1, Rating{PlayerID: "alice", Rating: test.host}, Rating{PlayerID: "bob", Rating: test.guest})
+
+			host, guest := change.Deltas[0], change.Deltas[1]
+			if host.Points != test.points || guest.Points != -test.points {
+				t.Fatalf("points %d and %d, want %d and %d", host.Points, guest.Points, test.points, -test.points)
+			}
+			if host.Result+guest.Result != 1 {
+				t.Fatalf("results %v and %v do not add up to 1", host.Result, guest.Result)
+			}
+		})
+	}
+}
+
+func TestApplyOncePerMatch(t *testing.T) {
+	store := NewMemoryRatings()
+	match := Match{ID: "m1", Host: Host{ID: "alice"}, Guest: Guest{ID: "bob"}, Winner: "alice"}
+	change := eloChange(match, 1, newRating("alice"), newRating("bob"))
+
+	for i, want := range []bool{true, false} {
+		applied, err := store.Apply(change, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if applied != want {
+			t.Fatalf("apply %d: applied %v, want %v", i+1, applied, want)
+		}
+	}
+
+	alice, _ := store.Rating(1, "alice")
+	if alice.Rating != initialRating+16 || alice.Matches != 1 || alice.Wins != 1 {
+		t.Fatalf("alice = %+v, want 1216 after one win", alice)
+	}
+	if changes, last, _ := store.Changes(0); len(changes) != 1 || last != 1 {
+		t.Fatalf("log has %d changes up to %d, want 1", len(changes), last)
+	}
+}
+
+func rateMatches(store RatingStore, ids ...MatchID) {
+	for _, id := range ids {
+		match := Match{ID: id, Host: Host{ID: "alice"}, Guest: Guest{ID: "bob"}, Winner: "alice"}
+		store.Apply(eloChange(match, 1, newRating("alice"), newRating("bob")), true)
+	}
+}
+
+func TestPullRatingsAfterPeerRestart(t *testing.T) {
+	peer := NewServer("", DefaultConfig(), nil, NewMemoryRatings())
+	web := httptest.NewServer(peer.ratingChanges())
+	defer web.Close()
+	address := strings.TrimPrefix(web.URL, "http://")
+
+	server := NewServer("", DefaultConfig(), nil, NewMemoryRatings())
+	rateMatches(peer.ratings, "m1", "m2")
+	if err := server.pullRatings(address); err != nil {
+		t.Fatal(err)
+	}
+
+	// the peer restarts without data_dir, and rates more matches than
+	// it did before the restart
+	peer.ratings = NewMemoryRatings()
+	rateMatches(peer.ratings, "m3", "m4", "m5")
+	for range 2 {
+		if err := server.pullRatings(address); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	alice, _ := server.ratings.Rating(1, "alice")
+	if alice.Matches != 5 {
+		t.Fatalf("alice has %d rated matches, want 5", alice.Matches)
+	}
+	cursor, _ := server.ratings.Cursor(address)
+	if cursor != (LogCursor{Epoch: peer.ratings.Epoch(), Seq: 3}) {
+		t.Fatalf("cursor = %+v, want seq 3 of the new log", cursor)
+	}
+}
+
+func TestBoltEpochSurvivesRestart(t *testing.T) {
+	path := filepath.Join(t.TempDir(), ratingsFile)
+	store, err := OpenBoltRatings(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	epoch := store.Epoch()
+	if err := store.SetCursor("peer:8080", LogCursor{Epoch: "e1", Seq: 4}); err != nil {
+		t.Fatal(err)
+	}
+	store.Close()
+
+	store, err = OpenBoltRatings(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	if store.Epoch() != epoch {
+		t.Fatalf("epoch %q after restart, want %q", store.Epoch(), epoch)
+	}
+	if cursor, _ := store.Cursor("peer:8080"); cursor != (LogCursor{Epoch: "e1", Seq: 4}) {
+		t.Fatalf("cursor = %+v after restart", cursor)
+	}
+}
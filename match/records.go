@@ -0,0 +1,129 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"slices"
+	"sync"
+)
+
+/// Match as stored: the match and, while it is played, the secret moves
+/// of the current round, so a restarted server can resume it
+type MatchRecord struct {
+	Match
+	Moves [2]*Move `json:"moves"`
+}
+
+func recordOf(match *Match) MatchRecord {
+	return MatchRecord{Match: *match, Moves: match.moves}
+}
+
+/// Match the record was made of, moves included
+func (record MatchRecord) restore() *Match {
+	match := record.Match
+	match.moves = record.Moves
+	match.Pending = nil
+	return &match
+}
+
+/// Where a server keeps its match records.
+///
+/// A server records the matches it runs, and the matches of its players
+/// running on peers, as they are told to it.
+type MatchStore interface {
+	Save(record MatchRecord) error
+	Get(id MatchID) (MatchRecord, bool, error)
+	/// Matches of player, the most recent first
+	OfPlayer(player Username) ([]Match, error)
+	/// Matches not finished yet
+	Playing() ([]MatchRecord, error)
+	Close() error
+}
+
+/// File of the match records, in the data directory
+const recordsFile = "matches.db"
+
+/// Records are kept in data_dir when set, in memory otherwise
+func openMatchStore(config Config) (MatchStore, error) {
+	if config.DataDir == "" {
+		return NewMemoryStore(), nil
+	}
+
+	path := filepath.Join(config.DataDir, recordsFile)
+	store, err := OpenBoltStore(path)
+	if err != nil {
+		return nil, fmt.Errorf("records: %s: %w", path, err)
+	}
+	return store, nil
+}
+
+/// Most recent first
+func sortMatches(matches []Match) {
+	slices.SortFunc(matches, func(a, b Match) int {
+		return b.Started.Compare(a.Started)
+	})
+}
+
+/// Records lost on restart, used without data_dir
+type MemoryStore struct {
+	mutex    sync.RWMutex
+	records  map[MatchID]MatchRecord
+	byPlayer map[Username][]MatchID
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		records:  make(map[MatchID]MatchRecord),
+		byPlayer: make(map[Username][]MatchID),
+	}
+}
+
+func (store *MemoryStore) Save(record MatchRecord) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	if _, ok := store.records[record.ID]; !ok {
+		for _, player := range []Username{record.Host.ID, record.Guest.ID} {
+			store.byPlayer[player] = append(store.byPlayer[player], record.ID)
+		}
+	}
+	store.records[record.ID] = record
+	return nil
+}
+
+func (store *MemoryStore) Get(id MatchID) (MatchRecord, bool, error) {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+
+	record, ok := store.records[id]
+	return record, ok, nil
+}
+
+func (store *MemoryStore) OfPlayer(player Username) ([]Match, error) {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+
+	matches := []Match{}
+	for _, id := range store.byPlayer[player] {
+		matches = append(matches, store.records[id].Match)
+	}
+	sortMatches(matches)
+	return matches, nil
+}
+
+func (store *MemoryStore) Playing() ([]MatchRecord, error) {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+
+	var playing []MatchRecord
+	for _, record := range store.records {
+		if record.Status == StatusPlaying {
+			playing = append(playing, record)
+		}
+	}
+	return playing, nil
+}
+
+func (store *MemoryStore) Close() error {
+	return nil
+}
@@ -0,0 +1,324 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"time"
+)
+
+/// Cross-server pairing
+///
+/// A server that finds no local opponent for a challenger asks a peer,
+/// in three steps:
+///
+///  1. reserve: the peer takes out of its queue a waiter its matchmaker
+///     pairs with the challenger, and holds it for reserve_timeout;
+///  2. confirm: the peer drafts the match, which it will run;
+///  3. commit: the peer starts the match and sends match_start to both.
+///
+/// A reservation released, or not committed in time, puts its waiter
+/// back in the queue at its place. A waiter is held by one reservation
+/// at a time, so concurrent requests never pair it twice.
+
+var errReservationGone = errors.New("reservation expired or released")
+
+/// Waiter held for a challenger of a peer
+type Reservation struct {
+	ID      string        `json:"id"`
+	Waiter  WaitingPlayer `json:"waiter"`
+	Expires time.Time     `json:"expires"`
+	/// Players queued on the reserving server, the reserved one included
+	Queued int `json:"queued"`
+
+	challenger WaitingPlayer
+	/// Drafted by confirm, started by commit
+	match     *Match
+	committed bool
+}
+
+/// Put a waiter back in the queue, at its place by arrival.
+/// Called with the mutex held.
+func (server *Server) putBack(waiter WaitingPlayer) {
+	i, _ := slices.BinarySearchFunc(server.waiting, waiter, func(a, b WaitingPlayer) int {
+		return a.Since.Compare(b.Since)
+	})
+	server.waiting = slices.Insert(server.waiting, i, waiter)
+}
+
+/// Drop the reservations not committed in time, and forget the
+/// committed ones once their timeout passed
+func (server *Server) expireReservations() {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+
+	now := time.Now()
+	for id, reservation := range server.reservations {
+		if now.Before(reservation.Expires) {
+			continue
+		}
+		delete(server.reservations, id)
+		if !reservation.committed {
+			log.Printf("reservation %s of %q expired", id, reservation.Waiter.PlayerID)
+			server.putBack(reservation.Waiter)
+		}
+	}
+}
+
+/// Drop the reservations holding player as waiter, not committed yet.
+/// Called with the mutex held.
+func (server *Server) dropReservations(player Username) bool {
+	dropped := false
+	for id, reservation := range server.reservations {
+		if reservation.Waiter.PlayerID == player && !reservation.committed {
+			delete(server.reservations, id)
+			dropped = true
+		}
+	}
+	return dropped
+}
+
+func (server *Server) isReserved(player Username) bool {
+	for _, reservation := range server.reservations {
+		if reservation.Waiter.PlayerID == player && !reservation.committed {
+			return true
+		}
+	}
+	return false
+}
+
+/// Reserve a waiter for the challenger of a peer
+///
+/// Request Body Format:
+/// 	{
+///			"player_id": string,
+///			"cards": [card],
+///			"server": "challenger-server-address",
+///			"rating": int
+/// 	}
+///
+/// Answers 201 with the reservation, 204 when no waiter pairs with the
+/// challenger, and 409 when the challenger is queued here as well.
+func (server *Server) reserve() http.HandlerFunc {
+	return func(writer http.ResponseWriter, request *http.Request) {
+		var data struct {
+			PlayerID Username `json:"player_id"`
+			Cards    []Card   `json:"cards"`
+			Server   Address  `json:"server"`
+			Rating   int      `json:"rating"`
+		}
+		if err := json.NewDecoder(request.Body).Decode(&data); err != nil {
+			http.Error(writer, "bad json", http.StatusBadRequest)
+			return
+		}
+		if data.PlayerID == "" {
+			http.Error(writer, "player_id required", http.StatusBadRequest)
+			return
+		}
+		if len(data.Cards) != server.config.HandSize {
+			http.Error(writer, fmt.Sprintf("must send exactly %d cards", server.config.HandSize), http.StatusBadRequest)
+			return
+		}
+		// the matchmaker never pairs a player with themselves, but one
+		// waiting here too would end up in two matches
+		if server.IsWaiting(data.PlayerID) {
+			http.Error(writer, "player is queued on this server", http.StatusConflict)
+			return
+		}
+
+		challenger := WaitingPlayer{
+			PlayerID: data.PlayerID,
+			Cards:    data.Cards,
+			Server:   data.Server,
+			Rating:   data.Rating,
+			Since:    time.Now(),
+		}
+		waiter := server.takeWaiter(challenger)
+		if waiter == nil {
+			writer.WriteHeader(http.StatusNoContent)
+			return
+		}
+
+		reservation := &Reservation{
+			ID:         newSessionToken(),
+			Waiter:     *waiter,
+			Expires:    time.Now().Add(time.Duration(server.config.ReserveTimeout)),
+			challenger: challenger,
+		}
+		server.mutex.Lock()
+		reservation.Queued = len(server.waiting) + 1
+		server.reservations[reservation.ID] = reservation
+		server.mutex.Unlock()
+
+		writer.Header().Set("content-type", "application/json")
+		writer.WriteHeader(http.StatusCreated)
+		json.NewEncoder(writer).Encode(reservation)
+	}
+}
+
+/// Draft the match of a reservation; answers 410 once it expired
+func (server *Server) confirmReservation() http.HandlerFunc {
+	return func(writer http.ResponseWriter, request *http.Request) {
+		server.mutex.Lock()
+		reservation := server.reservations[request.PathValue("id")]
+		if reservation == nil {
+			server.mutex.Unlock()
+			http.Error(writer, errReservationGone.Error(), http.StatusGone)
+			return
+		}
+		if reservation.match == nil {
+			reservation.match = server.draftMatch(reservation.Waiter, reservation.challenger)
+		}
+		view := reservation.match.View()
+		server.mutex.Unlock()
+
+		writer.Header().Set("content-type", "application/json")
+		json.NewEncoder(writer).Encode(view)
+	}
+}
+
+/// Start the match of a confirmed reservation; committing twice is fine
+func (server *Server) commitReservation() http.HandlerFunc {
+	return func(writer http.ResponseWriter, request *http.Request) {
+		server.mutex.Lock()
+		reservation := server.reservations[request.PathValue("id")]
+		if reservation == nil {
+			server.mutex.Unlock()
+			http.Error(writer, errReservationGone.Error(), http.StatusGone)
+			return
+		}
+		if reservation.match == nil {
+			server.mutex.Unlock()
+			http.Error(writer, "reservation not confirmed", http.StatusConflict)
+			return
+		}
+		start := !reservation.committed
+		reservation.committed = true
+		// kept a while, so a late release learns it was committed
+		reservation.Expires = time.Now().Add(time.Duration(server.config.ReserveTimeout))
+		match := reservation.match
+		server.mutex.Unlock()
+
+		view := match.View()
+		if start {
+			view = *server.startMatch(match)
+			server.broadcast(view, "match_start")
+		}
+
+		writer.Header().Set("content-type", "application/json")
+		json.NewEncoder(writer).Encode(view)
+	}
+}
+
+/// Give the waiter of a reservation back to the queue
+///
+/// Answers 204, or 409 when the reservation was committed already.
+func (server *Server) releaseReservation() http.HandlerFunc {
+	return func(writer http.ResponseWriter, request *http.Request) {
+		id := request.PathValue("id")
+
+		server.mutex.Lock()
+		defer server.mutex.Unlock()
+
+		reservation := server.reservations[id]
+		if reservation != nil && reservation.committed {
+			http.Error(writer, "reservation committed", http.StatusConflict)
+			return
+		}
+		if reservation != nil {
+			delete(server.reservations, id)
+			server.putBack(reservation.Waiter)
+		}
+		writer.WriteHeader(http.StatusNoContent)
+	}
+}
+
+/// Send a request to a peer, decoding a JSON answer into out
+func (server *Server) callPeer(ctx context.Context, method string, url string, body any, out any) (int, error) {
+	var payload []byte
+	if body != nil {
+		payload, _ = json.Marshal(body)
+	}
+	request, err := http.NewRequestWithContext(ctx, method, url, bytes.NewReader(payload))
+	if err != nil {
+		return 0, err
+	}
+	request.Header.Set("content-type", "application/json")
+
+	response, err := server.client.Do(request)
+	if err != nil {
+		return 0, err
+	}
+	defer response.Body.Close()
+
+	if out != nil && response.StatusCode/100 == 2 && response.StatusCode != http.StatusNoContent {
+		if err := json.NewDecoder(response.Body).Decode(out); err != nil {
+			return response.StatusCode, err
+		}
+	}
+	return response.StatusCode, nil
+}
+
+/// Reserve on peer a waiter for challenger; nil when peer has none
+func (server *Server) reserveOn(ctx context.Context, peer Address, challenger WaitingPlayer) (*Reservation, error) {
+	body := map[string]any{
+		"player_id": challenger.PlayerID,
+		"cards":     challenger.Cards,
+		"server":    server.address,
+		"rating":    challenger.Rating,
+	}
+
+	var reservation Reservation
+	status, err := server.callPeer(ctx, http.MethodPost, fmt.Sprintf("http://%s/reservations", peer), body, &reservation)
+	switch {
+	case err != nil:
+		return nil, err
+	case status == http.StatusNoContent:
+		return nil, nil
+	case status != http.StatusCreated:
+		return nil, fmt.Errorf("reserve: status %d", status)
+	}
+	return &reservation, nil
+}
+
+/// Confirm and commit a reservation made on peer, releasing it when
+/// that fails
+func (server *Server) startOn(peer Address, reservation *Reservation) (*Match, error) {
+	base := fmt.Sprintf("http://%s/reservations/%s", peer, reservation.ID)
+
+	var match Match
+	status, err := server.callPeer(context.Background(), http.MethodPost, base+"/confirm", nil, &match)
+	if err == nil && status != http.StatusOK {
+		err = fmt.Errorf("confirm: status %d", status)
+	}
+	if err == nil {
+		status, err = server.callPeer(context.Background(), http.MethodPost, base+"/commit", nil, &match)
+		if err == nil && status != http.StatusOK {
+			err = fmt.Errorf("commit: status %d", status)
+		}
+	}
+	if err == nil {
+		return &match, nil
+	}
+
+	// the commit may have been applied even though its answer was lost
+	if server.releaseOn(peer, reservation) == http.StatusConflict {
+		return &match, nil
+	}
+	return nil, err
+}
+
+/// Give back a reservation made on peer; returns the answer status
+func (server *Server) releaseOn(peer Address, reservation *Reservation) int {
+	url := fmt.Sprintf("http://%s/reservations/%s", peer, reservation.ID)
+	status, err := server.callPeer(context.Background(), http.MethodDelete, url, nil, nil)
+	if err != nil {
+		log.Printf("failed to release reservation %s on %s: %v", reservation.ID, peer, err)
+	}
+	return status
+}
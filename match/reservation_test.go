@@ -0,0 +1,133 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func testHand(config Config) []Card {
+	cards := make([]Card, config.HandSize)
+	for i := range cards {
+		cards[i] = Card{ID: string(rune('a' + i)), Power: i + 1}
+	}
+	return cards
+}
+
+/// Ask server to reserve a waiter for challenger, as a peer does
+func reserveFor(t *testing.T, server *Server, challenger Username) (*httptest.ResponseRecorder, Reservation) {
+	t.Helper()
+	body, _ := json.Marshal(map[string]any{
+		"player_id": challenger,
+		"cards":     testHand(server.config),
+		"server":    "peer:8082",
+		"rating":    initialRating,
+	})
+	recorder := httptest.NewRecorder()
+	server.reserve()(recorder, httptest.NewRequest(http.MethodPost, "/reservations", bytes.NewReader(body)))
+
+	var reservation Reservation
+	if recorder.Code == http.StatusCreated {
+		if err := json.NewDecoder(recorder.Body).Decode(&reservation); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return recorder, reservation
+}
+
+func queuedIDs(server *Server) []Username {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+
+	var ids []Username
+	for _, waiter := range server.waiting {
+		ids = append(ids, waiter.PlayerID)
+	}
+	return ids
+}
+
+func testServer() *Server {
+	server := NewServer("localhost:8081", DefaultConfig(), nil, NewMemoryRatings())
+	start := time.Now().Add(-time.Minute)
+	for i, player := range []Username{"alice", "bob"} {
+		server.enqueueWaiter(WaitingPlayer{
+			PlayerID: player,
+			Cards:    testHand(server.config),
+			Rating:   initialRating,
+			Since:    start.Add(time.Duration(i) * time.Second),
+		})
+	}
+	return server
+}
+
+func TestReservationExpires(t *testing.T) {
+	server := testServer()
+
+	recorder, reservation := reserveFor(t, server, "carol")
+	if recorder.Code != http.StatusCreated {
+		t.Fatalf("status %d, want 201", recorder.Code)
+	}
+	if reservation.Waiter.PlayerID != "alice" || reservation.Queued != 2 {
+		t.Fatalf("reserved %q with %d queued, want alice with 2", reservation.Waiter.PlayerID, reservation.Queued)
+	}
+	if queued := queuedIDs(server); len(queued) != 1 || !server.IsWaiting("alice") {
+		t.Fatalf("queue = %v while alice is reserved", queued)
+	}
+
+	server.expireReservations()
+	if _, held := server.reservations[reservation.ID]; !held {
+		t.Fatal("reservation dropped before its timeout")
+	}
+
+	server.reservations[reservation.ID].Expires = time.Now().Add(-time.Second)
+	server.expireReservations()
+	if _, held := server.reservations[reservation.ID]; held {
+		t.Fatal("reservation kept after its timeout")
+	}
+	if queued := queuedIDs(server); len(queued) != 2 || queued[0] != "alice" {
+		t.Fatalf("queue = %v, want alice back first", queued)
+	}
+}
+
+func TestCommittedReservationExpires(t *testing.T) {
+	server := testServer()
+	_, reservation := reserveFor(t, server, "carol")
+
+	held := server.reservations[reservation.ID]
+	held.committed = true
+	held.Expires = time.Now().Add(-time.Second)
+	server.expireReservations()
+
+	if _, kept := server.reservations[reservation.ID]; kept {
+		t.Fatal("committed reservation kept after its timeout")
+	}
+	if queued := queuedIDs(server); len(queued) != 1 || queued[0] != "bob" {
+		t.Fatalf("queue = %v, want only bob", queued)
+	}
+}
+
+func TestReserveRejects(t *testing.T) {
+	tests := []struct {
+		name       string
+		challenger Username
+		status     int
+	}{
+		{"no player", "", http.StatusBadRequest},
+		{"player queued here", "alice", http.StatusConflict},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			server := testServer()
+			recorder, _ := reserveFor(t, server, test.challenger)
+			if recorder.Code != test.status {
+				t.Fatalf("status %d, want %d", recorder.Code, test.status)
+			}
+			if queued := queuedIDs(server); len(queued) != 2 {
+				t.Fatalf("queue = %v, want both waiters", queued)
+			}
+		})
+	}
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"log"
+	"slices"
+	"time"
+)
+
+/// Peer choice policies, when several peers reserve a waiter
+const (
+	PeerChoiceRotate = "rotate"
+	PeerChoiceQueue  = "queue"
+)
+
+/// Reservation a peer answered a search with
+type offer struct {
+	peer Address
+	/// Place of the peer in the rotation of this search
+	rank        int
+	reservation *Reservation
+}
+
+/// Peers, starting one further in the list at every search
+func (server *Server) peerRotation() []Address {
+	peers := server.ListPeers()
+	if len(peers) == 0 {
+		return nil
+	}
+
+	server.mutex.Lock()
+	start := server.rotation % len(peers)
+	server.rotation++
+	server.mutex.Unlock()
+	return append(peers[start:], peers[:start]...)
+}
+
+/// Ask every peer at once for a waiter, within search_timeout
+func (server *Server) searchPeers(challenger WaitingPlayer) []offer {
+	peers := server.peerRotation()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(server.config.SearchTimeout))
+	defer cancel()
+
+	answers := make(chan offer, len(peers))
+	for rank, peer := range peers {
+		go func() {
+			reservation, err := server.reserveOn(ctx, peer, challenger)
+			if err != nil {
+				log.Printf("error contacting peer %s: %v", peer, err)
+			}
+			answers <- offer{peer: peer, rank: rank, reservation: reservation}
+		}()
+	}
+
+	var offers []offer
+	pending := len(peers)
+collect:
+	for ; pending > 0; pending-- {
+		select {
+		case answer := <-answers:
+			if answer.reservation != nil {
+				offers = append(offers, answer)
+			}
+		case <-ctx.Done():
+			break collect
+		}
+	}
+
+	if pending > 0 {
+		log.Printf("search for %q: %d peers did not answer in %s", challenger.PlayerID, pending, server.config.SearchTimeout)
+		// a peer may still reserve before it sees the cancel
+		go func() {
+			for range pending {
+				if late := <-answers; late.reservation != nil {
+					server.releaseOn(late.peer, late.reservation)
+				}
+			}
+		}()
+	}
+	return offers
+}
+
+/// Order offers by the peer choice policy
+func (server *Server) rankOffers(offers []offer) {
+	slices.SortFunc(offers, func(a, b offer) int {
+		if server.config.PeerChoice == PeerChoiceQueue {
+			if c := cmp.Compare(b.reservation.Queued, a.reservation.Queued); c != 0 {
+				return c
+			}
+		}
+		return cmp.Compare(a.rank, b.rank)
+	})
+}
+
+/// Find an opponent for challenger on the peers, and start the match
+/// there; nil when no peer has one.
+///
+/// The first offer of the policy that starts wins; the others are
+/// released, so their waiters go back to the queue of their peer.
+func (server *Server) matchOnPeers(challenger WaitingPlayer) *Match {
+	offers := server.searchPeers(challenger)
+	server.rankOffers(offers)
+
+	var match *Match
+	for _, offer := range offers {
+		if match != nil {
+			go server.releaseOn(offer.peer, offer.reservation)
+			continue
+		}
+
+		started, err := server.startOn(offer.peer, offer.reservation)
+		if err != nil {
+			log.Printf("failed to start match with %q on %s: %v", offer.reservation.Waiter.PlayerID, offer.peer, err)
+			continue
+		}
+		match = started
+	}
+	return match
+}
+
+func validatePeerChoice(config Config) []error {
+	var errs []error
+	switch config.PeerChoice {
+	case PeerChoiceRotate, PeerChoiceQueue:
+	default:
+		errs = append(errs, fmt.Errorf("peer_choice must be %q or %q, got %q", PeerChoiceRotate, PeerChoiceQueue, config.PeerChoice))
+	}
+	if config.SearchTimeout <= 0 {
+		errs = append(errs, fmt.Errorf("search_timeout must be positive, got %s", config.SearchTimeout))
+	}
+	return errs
+}
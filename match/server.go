@@ -1,90 +1,75 @@
 package main
 
 import (
-	"bytes"
-	"encoding/json"
 	"log"
 	"net/http"
-	"slices"
 	"sync"
+	"time"
 )
 
 type Server struct {
 	mutex sync.Mutex
 
 	/// Match Related
-	players map[string]*PlayerConnection
-	waiting []WaitingPlayer
+	/// Websocket sessions, by player
+	sessions map[Username]*Session
+	waiting  []WaitingPlayer
+	/// Picks who plays against whom
+	matchmaker Matchmaker
+	/// Recent wait before a match, for queue ETAs
+	typicalWait time.Duration
+	/// Waiters held for challengers of peers, by reservation ID
+	reservations map[string]*Reservation
+	/// Matches running here, and the home of those running on peers
+	matches map[MatchID]*Match
+	away    map[MatchID]Address
+	records MatchStore
+	ratings RatingStore
 
 	/// Peer Related
+	/// Where peers and players reach this server, the advertise address
 	address Address
-	peers   []Address
+	peers   []*Peer
+	/// This server, as it gossips about itself
+	self Member
+	/// Incarnations of the peers removed by hand, ignored by gossip
+	removed map[Address]uint64
+	/// Searches made so far, to start each at the next peer
+	rotation int
+	/// Match messages waiting to be sent, by server of the player
+	notifiers map[Address]chan Notification
+	client    *http.Client
+
+	config Config
 }
 
-func NewServer(address Address) *Server {
+func NewServer(address Address, config Config, records MatchStore, ratings RatingStore) *Server {
 	return &Server{
-		peers:   []string{},
-		players: make(map[string]*PlayerConnection),
-		waiting: make([]WaitingPlayer, 0),
-		address: address,
+		peers:        []*Peer{},
+		self:         Member{Address: address, State: PeerHealthy, Incarnation: startIncarnation()},
+		removed:      make(map[Address]uint64),
+		sessions:     make(map[Username]*Session),
+		waiting:      make([]WaitingPlayer, 0),
+		matchmaker:   newMatchmaker(config),
+		reservations: make(map[string]*Reservation),
+		matches:      make(map[MatchID]*Match),
+		away:         make(map[MatchID]Address),
+		notifiers:    make(map[Address]chan Notification),
+		records:      records,
+		ratings:      ratings,
+		address:      address,
+		client:       &http.Client{Timeout: time.Duration(config.PeerTimeout)},
+		config:       config,
 	}
 }
 
-func (server *Server) AddPeer(peer Address) {
-	server.mutex.Lock()
-	defer server.mutex.Unlock()
-
-	if !slices.Contains(server.peers, peer) {
-		server.peers = append(server.peers, peer)
-	}
-}
-
-func (server *Server) ListPeers() []Address {
-	server.mutex.Lock()
-	defer server.mutex.Unlock()
-
-	out := make([]Address, len(server.peers))
-	copy(out, server.peers)
-	return out
-}
-
-func (server *Server) LinkPlayer(
-	player Username,
-	connection *PlayerConnection,
-) {
-	server.mutex.Lock()
-	defer server.mutex.Unlock()
-
-	server.players[player] = connection
-}
-
-func (server *Server) UnlinkPlayer(player Username) {
-	server.mutex.Lock()
-	defer server.mutex.Unlock()
-
-	delete(server.players, player)
-}
-
-func (server *Server) Connection(playerID string) *PlayerConnection {
-	server.mutex.Lock()
-	defer server.mutex.Unlock()
-
-	return server.players[playerID]
-}
-
 /// Try to match locally
 func (server *Server) tryLocalMatch(player Challenger) (*Match, bool) {
-	server.mutex.Lock()
-	defer server.mutex.Unlock()
-
-	if len(server.waiting) == 0 {
+	waiter := server.takeWaiter(player)
+	if waiter == nil {
 		return nil, false
 	}
-
-	waiter := server.waiting[0]
-	server.waiting = server.waiting[1:]
-	match := createMatch(waiter, player, server.address)
-	return match, true
+	return server.createMatch(*waiter, player), true
 }
 
 func (server *Server) enqueueWaiter(waiter WaitingPlayer) {
@@ -111,125 +96,88 @@ func (server *Server) IsWaiting(player Username) bool {
 			return true
 		}
 	}
-	return false
+	return server.isReserved(player)
 }
 
-func (server *Server) popWaiter() *WaitingPlayer {
-	server.mutex.Lock()
-	defer server.mutex.Unlock()
-
-	if len(server.waiting) == 0 {
-		return nil
-	}
-
-	waiter := server.waiting[0]
-	server.waiting = server.waiting[1:]
-	return &waiter
+/// Start a match between host and guest, run by this server
+func (server *Server) createMatch(host WaitingPlayer, guest WaitingPlayer) *Match {
+	return server.startMatch(server.draftMatch(host, guest))
 }
 
-func createMatch(
-	host WaitingPlayer,
-	guest WaitingPlayer,
-	local Address,
-) *Match {
-
+/// Match between host and guest, not started yet
+func (server *Server) draftMatch(host WaitingPlayer, guest WaitingPlayer) *Match {
 	hostInfo := PlayerInfo{
 		ID:     host.PlayerID,
-		Server: local,
+		Server: host.Server,
 		Cards:  host.Cards,
 	}
 
 	guestInfo := PlayerInfo{
 		ID:     guest.PlayerID,
-		Server: local,
+		Server: guest.Server,
 		Cards:  guest.Cards,
 	}
 
-	match := &Match{
-		ID:    newCardID(),
-		Host:  hostInfo,
-		Guest: guestInfo,
-	}
+	return newMatch(hostInfo, guestInfo, server.address, server.config.Rounds)
+}
 
-	hostScore := scoreOf(host.Cards)
-	guestScore := scoreOf(guest.Cards)
+/// Run a drafted match here
+func (server *Server) startMatch(match *Match) *Match {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
 
-	if hostScore > guestScore {
-		match.Winner = host.PlayerID
-	} else if guestScore > hostScore {
-		match.Winner = guest.PlayerID
-	} else {
-		match.Winner = "draw"
-	}
-	return match
+	match.startTurn(time.Duration(server.config.MoveTimeout))
+	server.matches[match.ID] = match
+	server.save(match)
+	view := match.View()
+	return &view
 }
 
-func scoreOf(cards []Card) int {
-	s := 0
-	for _, c := range cards {
-		s += c.Power
+/// Record a match run here; called with the mutex held, so records
+/// are written in the order of the moves
+func (server *Server) save(match *Match) {
+	if err := server.records.Save(recordOf(match)); err != nil {
+		log.Printf("failed to record match %s: %v", match.ID, err)
 	}
-	return s
 }
 
-/// Send JSON message to the player's websocket connection if present
-func (server *Server) notifyLocal(player Username, payload any) {
-	socket := server.Connection(player)
-
-	if socket == nil {
-		// Print player with %q so empty player IDs are visible in logs
-		log.Printf("no websocket for player %q\n", player)
-		return
+/// Resume the matches left playing by the previous run of the server
+func (server *Server) restoreMatches() error {
+	playing, err := server.records.Playing()
+	if err != nil {
+		return err
 	}
 
-	socket.sendJSON(payload)
-}
-
-/// Invoked when a remote server wants a waiting player.
-///
-/// The payload includes the challenger info and a callback URL.
-/// If there is a waiter, a match is created pairing both players and
-/// notify the waiter.
-func (server *Server) FindWaiter(
-	writer http.ResponseWriter,
-	request *http.Request,
-) {
-
-	var data struct {
-		PlayerID    string `json:"player_id"`
-		Cards       []Card `json:"cards"`
-		CallbackURL string `json:"callback"`
-		Server      string `json:"server"`
-	}
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
 
-	if err := json.NewDecoder(request.Body).Decode(&data); err != nil {
-		http.Error(writer, "bad json", http.StatusBadRequest)
-		return
+	for _, record := range playing {
+		// older runs named their matches after the listen address
+		if record.Home == server.address || record.Home == server.config.Address() {
+			match := record.restore()
+			match.Home = server.address
+			// the players may not have seen the match while the server was down
+			match.startTurn(time.Duration(server.config.MoveTimeout))
+			server.matches[record.ID] = match
+		} else {
+			server.away[record.ID] = record.Home
+		}
 	}
+	return nil
+}
 
-	waiter := server.popWaiter()
+/// Send JSON message to the player's websocket session if present; it
+/// is kept for a reconnection when the player is not connected
+func (server *Server) notifyLocal(player Username, payload any) {
+	session := server.session(player)
 
-	if waiter == nil {
-		writer.WriteHeader(http.StatusNoContent)
+	if session == nil {
+		// Print player with %q so empty player IDs are visible in logs
+		log.Printf("no websocket session for player %q\n", player)
 		return
 	}
 
-	challenger := WaitingPlayer{PlayerID: data.PlayerID, Cards: data.Cards}
-	match := createMatch(*waiter, challenger, server.address)
-
-	go server.notifyLocal(waiter.PlayerID, map[string]any{
-		"type":  "match_start",
-		"match": match,
-	})
-
-	body, _ := json.Marshal(match)
-	go func() {
-		_, err := http.Post(data.CallbackURL, "application/json", bytes.NewReader(body))
-		if err != nil {
-			log.Printf("failed to POST match to callback %s: %v", data.CallbackURL, err)
-		}
-	}()
-
-	writer.Header().Set("content-type", "application/json")
-	json.NewEncoder(writer).Encode(match)
+	if err := session.send(payload, server.config.OutboxSize); err != nil {
+		log.Printf("failed to send to %q: %v", player, err)
+	}
 }
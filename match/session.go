@@ -0,0 +1,188 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"maps"
+	"sync"
+	"time"
+)
+
+/// Websocket session of a player
+///
+/// A session outlives its connection for session_grace: the messages
+/// sent meanwhile are numbered and kept in its outbox, and a client
+/// reconnecting with the token of the session and the seq of the last
+/// message it got receives those it missed, in order, before any new
+/// one. A player whose session expires leaves the queue.
+type Session struct {
+	Token string
+
+	/// Guards the fields below, and orders the writes to the connection
+	mutex      sync.Mutex
+	connection *PlayerConnection
+	/// Seq of the last message sent
+	seq uint64
+	/// Last outbox_size messages, oldest first
+	outbox []outgoing
+	/// When the connection dropped; zero while connected
+	detached time.Time
+}
+
+/// Message of the outbox, encoded with its seq
+type outgoing struct {
+	seq  uint64
+	data []byte
+}
+
+func newSessionToken() string {
+	b := make([]byte, 16)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+/// Session of player for a new connection: the one of token when it
+/// did not expire, a new one otherwise
+func (server *Server) LinkPlayer(player Username, token string) (session *Session, resumed bool) {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+
+	session = server.sessions[player]
+	if session != nil && token != "" && session.Token == token {
+		return session, true
+	}
+	session = &Session{Token: newSessionToken()}
+	server.sessions[player] = session
+	return session, false
+}
+
+/// Detach the connection of a player from their session, unless they
+/// reconnected since; the session is kept for session_grace
+func (server *Server) UnlinkPlayer(player Username, connection *PlayerConnection) {
+	server.mutex.Lock()
+	session := server.sessions[player]
+	server.mutex.Unlock()
+
+	if session == nil {
+		return
+	}
+	session.mutex.Lock()
+	defer session.mutex.Unlock()
+
+	if session.connection == connection {
+		session.connection = nil
+		session.detached = time.Now()
+	}
+}
+
+func (server *Server) session(player Username) *Session {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+
+	return server.sessions[player]
+}
+
+/// Drop the sessions detached for longer than session_grace, and their
+/// players from the queue
+func (server *Server) expireSessions() {
+	server.mutex.Lock()
+	sessions := maps.Clone(server.sessions)
+	server.mutex.Unlock()
+
+	for player, session := range sessions {
+		// a session may be sending; only hold the server for expired ones
+		if !session.expired(time.Duration(server.config.SessionGrace)) {
+			continue
+		}
+
+		server.mutex.Lock()
+		if server.sessions[player] == session && session.expired(time.Duration(server.config.SessionGrace)) {
+			log.Printf("session of %q expired", player)
+			delete(server.sessions, player)
+			server.removeWaiter(player)
+		}
+		server.mutex.Unlock()
+	}
+}
+
+func (session *Session) expired(grace time.Duration) bool {
+	session.mutex.Lock()
+	defer session.mutex.Unlock()
+
+	return session.connection == nil && time.Since(session.detached) >= grace
+}
+
+/// Attach connection, greet it and send the messages after last
+func (session *Session) open(connection *PlayerConnection, welcome map[string]any, last uint64, resumed bool) {
+	session.mutex.Lock()
+	defer session.mutex.Unlock()
+
+	session.connection = connection
+	session.detached = time.Time{}
+
+	if !resumed {
+		last = 0
+	}
+	welcome["token"] = session.Token
+	welcome["resumed"] = resumed
+	// not seq, which only numbered messages carry
+	welcome["last_seq"] = session.seq
+	// some missed messages left the outbox already
+	welcome["gap"] = resumed && len(session.outbox) > 0 && session.outbox[0].seq > last+1
+	connection.sendJSON(welcome)
+
+	for _, message := range session.outbox {
+		if message.seq > last {
+			connection.sendRaw(message.data)
+		}
+	}
+}
+
+/// Number payload, keep it in the outbox and send it when connected
+func (session *Session) send(payload any, outboxSize int) error {
+	session.mutex.Lock()
+	defer session.mutex.Unlock()
+
+	data, err := withSeq(session.seq+1, payload)
+	if err != nil {
+		return err
+	}
+	session.seq++
+	session.outbox = append(session.outbox, outgoing{seq: session.seq, data: data})
+	if extra := len(session.outbox) - outboxSize; extra > 0 {
+		session.outbox = session.outbox[extra:]
+	}
+
+	if session.connection != nil {
+		session.connection.sendRaw(data)
+	}
+	return nil
+}
+
+/// Encode payload, a JSON object, with a seq field
+func withSeq(seq uint64, payload any) ([]byte, error) {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return nil, err
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return nil, fmt.Errorf("message is not a JSON object: %w", err)
+	}
+	fields["seq"], _ = json.Marshal(seq)
+	return json.Marshal(fields)
+}
+
+func validateSessions(config Config) []error {
+	var errs []error
+	if config.SessionGrace <= 0 {
+		errs = append(errs, fmt.Errorf("session_grace must be positive, got %s", config.SessionGrace))
+	}
+	if config.OutboxSize <= 0 {
+		errs = append(errs, fmt.Errorf("outbox_size must be positive, got %d", config.OutboxSize))
+	}
+	return errs
+}
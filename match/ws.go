@@ -9,10 +9,11 @@ import "github.com/gorilla/websocket"
 type PlayerConnection struct {
 	connection *websocket.Conn
 	mutex      sync.Mutex
+	timeout    time.Duration
 }
 
-func newPlayerConnection(connection *websocket.Conn) *PlayerConnection {
-	return &PlayerConnection{connection: connection}
+func newPlayerConnection(connection *websocket.Conn, timeout time.Duration) *PlayerConnection {
+	return &PlayerConnection{connection: connection, timeout: timeout}
 }
 
 func (player *PlayerConnection) sendJSON(value any) {
@@ -22,8 +23,21 @@ func (player *PlayerConnection) sendJSON(value any) {
 	if player.connection == nil {
 		return
 	}
-	timeout := time.Now().Add(5 * time.Second)
-	player.connection.SetWriteDeadline(timeout)
+	deadline := time.Now().Add(player.timeout)
+	player.connection.SetWriteDeadline(deadline)
 	_ = player.connection.WriteJSON(value)
 }
 
+/// Send a message already encoded
+func (player *PlayerConnection) sendRaw(data []byte) {
+	player.mutex.Lock()
+	defer player.mutex.Unlock()
+
+	if player.connection == nil {
+		return
+	}
+	deadline := time.Now().Add(player.timeout)
+	player.connection.SetWriteDeadline(deadline)
+	_ = player.connection.WriteMessage(websocket.TextMessage, data)
+}
+